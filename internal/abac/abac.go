@@ -2,7 +2,9 @@ package abac
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -92,6 +94,128 @@ func (a *ABAC) Update(rules map[string]*Rule) error {
 	return nil
 }
 
+// MaxRows returns the smallest row limit of the named rules with the MaxRows
+// action, or zero if there is none.
+func (a *ABAC) MaxRows(ruleNames []string) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var maxRows int64
+	for _, name := range ruleNames {
+		rule, ok := a.Rules[name]
+		if !ok || rule == nil || rule.Actions&MaxRows == 0 || rule.MaxRows <= 0 {
+			continue
+		}
+		if maxRows == 0 || rule.MaxRows < maxRows {
+			maxRows = rule.MaxRows
+		}
+	}
+	return maxRows
+}
+
+// DurationLimit is the time a query may run before it is cancelled.
+type DurationLimit struct {
+	Max        time.Duration
+	Disconnect bool
+}
+
+// MaxDuration returns the smallest duration limit of the named rules with the
+// MaxDuration action. The session is disconnected on timeout if a rule with
+// that limit asks for it.
+func (a *ABAC) MaxDuration(ruleNames []string) DurationLimit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var limit DurationLimit
+	for _, name := range ruleNames {
+		rule, ok := a.Rules[name]
+		if !ok || rule == nil || rule.Actions&MaxDuration == 0 || rule.MaxDuration <= 0 {
+			continue
+		}
+		switch {
+		case limit.Max == 0 || rule.MaxDuration < limit.Max:
+			limit = DurationLimit{Max: rule.MaxDuration, Disconnect: rule.MaxDurationDisconnect}
+		case rule.MaxDuration == limit.Max:
+			limit.Disconnect = limit.Disconnect || rule.MaxDurationDisconnect
+		}
+	}
+	return limit
+}
+
+// ColumnMask is the masking style of the columns matched by the query
+// conditions of a rule.
+type ColumnMask struct {
+	Rule       string
+	Style      string
+	conditions []*QueryCondition
+}
+
+// Matches reports whether the column of the table is masked.
+func (m ColumnMask) Matches(table, column string) bool {
+	for _, condition := range m.conditions {
+		if condition.MatchesColumn(table, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// Masks returns the column masks of the named rules with the Mask action.
+// Negated query conditions do not select columns.
+func (a *ABAC) Masks(ruleNames []string) []ColumnMask {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var masks []ColumnMask
+	for _, name := range ruleNames {
+		rule, ok := a.Rules[name]
+		if !ok || rule == nil || rule.Actions&Mask == 0 {
+			continue
+		}
+		mask := ColumnMask{Rule: name, Style: rule.Mask, conditions: rule.queryConditions()}
+		if len(mask.conditions) > 0 {
+			masks = append(masks, mask)
+		}
+	}
+	sort.Slice(masks, func(i, j int) bool { return masks[i].Rule < masks[j].Rule })
+	return masks
+}
+
+// RowFilter is the row filter of a rule applied to the tables matched by its
+// query conditions.
+type RowFilter struct {
+	Rule string
+	TableRowFilter
+	conditions []*QueryCondition
+}
+
+// Matches reports whether the rows of the table are filtered.
+func (f RowFilter) Matches(table string) bool {
+	for _, condition := range f.conditions {
+		if condition.MatchesTable(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// RowFilters returns the row filters of the named rules with the FilterRows
+// action. Negated query conditions do not select tables.
+func (a *ABAC) RowFilters(ruleNames []string) []RowFilter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var filters []RowFilter
+	for _, name := range ruleNames {
+		rule, ok := a.Rules[name]
+		if !ok || rule == nil || rule.Actions&FilterRows == 0 || rule.RowFilter == nil {
+			continue
+		}
+		filter := RowFilter{Rule: name, TableRowFilter: *rule.RowFilter, conditions: rule.queryConditions()}
+		if len(filter.conditions) > 0 {
+			filters = append(filters, filter)
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Rule < filters[j].Rule })
+	return filters
+}
+
 func (a *ABAC) matchState(state state) (Action, []string, error) {
 	var (
 		errs         []error
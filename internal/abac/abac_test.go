@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/sql"
 )
 
 func TestABAC(t *testing.T) {
@@ -85,6 +87,26 @@ func TestABAC(t *testing.T) {
 		require.Equal(t, rules["rule1"].Actions, actions)
 	})
 
+	t.Run("ip-condition-address-forms", func(t *testing.T) {
+		condition := &IPCondition{Subnets: []string{"10.0.0.0/8", "416a:707c:06b9:8143::/64"}}
+		require.NoError(t, condition.Init())
+
+		for address, expected := range map[string]bool{
+			"10.1.2.3":                true,
+			"10.1.2.3:5432":           true,
+			"192.168.1.1:5432":        false,
+			"[" + matchingIP + "]:22": true,
+			matchingIP:                true,
+			notMatchingIP:             false,
+			"10.1.2.3:5432:1":         false,
+			"[" + matchingIP + "]":    false,
+			"not-an-address":          false,
+		} {
+			s := state{ip: optional[string]{value: address, set: true}}
+			require.Equal(t, expected, condition.Matches(s), address)
+		}
+	})
+
 	t.Run("time-condition", func(t *testing.T) {
 		rules := map[string]*Rule{
 			"rule1": {
@@ -187,4 +209,119 @@ func TestABAC(t *testing.T) {
 		require.Equal(t, Notify|NotPermit, actions)
 		require.ElementsMatch(t, names, []string{"rule1"})
 	})
+
+	t.Run("max-rows", func(t *testing.T) {
+		rules := map[string]*Rule{
+			"rule1": {
+				Conditions: []Condition{&DatabaseNameCondition{Regexps: []string{"a.*"}}},
+				Actions:    MaxRows,
+				MaxRows:    1000,
+			},
+			"rule2": {
+				Conditions: []Condition{&DatabaseNameCondition{Regexps: []string{".*"}}},
+				Actions:    MaxRows,
+				MaxRows:    100,
+			},
+			"rule3": {
+				Conditions: []Condition{&DatabaseNameCondition{Regexps: []string{".*"}}},
+				Actions:    Notify,
+				MaxRows:    10,
+			},
+		}
+		abac, err := New(rules)
+		require.NoError(t, err)
+
+		stateID := abac.NewState(nil)
+		actions, names, err := abac.Observe(stateID, DatabaseNameEvent("abracadabra"))
+		require.NoError(t, err)
+		require.Equal(t, Notify|MaxRows, actions)
+		require.Equal(t, int64(100), abac.MaxRows(names))
+		require.Equal(t, int64(1000), abac.MaxRows([]string{"rule1", "rule3"}))
+		require.Zero(t, abac.MaxRows(nil))
+	})
+
+	t.Run("max duration", func(t *testing.T) {
+		rules := map[string]*Rule{
+			"slow": {
+				Conditions:  []Condition{&DatabaseNameCondition{Regexps: []string{".*"}}},
+				Actions:     MaxDuration,
+				MaxDuration: time.Minute,
+			},
+			"fast": {
+				Conditions:            []Condition{&DatabaseNameCondition{Regexps: []string{".*"}}},
+				Actions:               MaxDuration,
+				MaxDuration:           30 * time.Second,
+				MaxDurationDisconnect: true,
+			},
+			"fast-cancel": {
+				Conditions:  []Condition{&DatabaseNameCondition{Regexps: []string{".*"}}},
+				Actions:     MaxDuration,
+				MaxDuration: 30 * time.Second,
+			},
+		}
+		abac, err := New(rules)
+		require.NoError(t, err)
+
+		require.Equal(t, DurationLimit{Max: 30 * time.Second, Disconnect: true}, abac.MaxDuration([]string{"slow", "fast-cancel", "fast"}))
+		require.Equal(t, DurationLimit{Max: 30 * time.Second}, abac.MaxDuration([]string{"slow", "fast-cancel"}))
+		require.Equal(t, DurationLimit{Max: time.Minute}, abac.MaxDuration([]string{"slow"}))
+		require.Zero(t, abac.MaxDuration(nil))
+	})
+
+	t.Run("mask", func(t *testing.T) {
+		rules := map[string]*Rule{
+			"pii": {
+				Conditions: []Condition{
+					&DatabaseUsernameCondition{Regexps: []string{"support_.*"}},
+					&QueryCondition{TableRegexps: []string{"^users$"}, ColumnRegexps: []string{"^(email|phone)$"}, Strict: true},
+				},
+				Actions: Mask,
+				Mask:    MaskPartial,
+			},
+		}
+		abac, err := New(rules)
+		require.NoError(t, err)
+
+		stateID := abac.NewState(nil)
+		actions, names, err := abac.Observe(stateID,
+			DatabaseUsernameEvent("support_bob"),
+			QueryStatementsEvent([]sql.QueryStatement{{Type: sql.Select, Table: "users"}}),
+		)
+		require.NoError(t, err)
+		require.Equal(t, Mask, actions)
+
+		masks := abac.Masks(names)
+		require.Len(t, masks, 1)
+		require.Equal(t, MaskPartial, masks[0].Style)
+		require.True(t, masks[0].Matches("users", "email"))
+		require.False(t, masks[0].Matches("users", "id"))
+		require.False(t, masks[0].Matches("orders", "email"))
+	})
+
+	t.Run("row-filter", func(t *testing.T) {
+		rules := map[string]*Rule{
+			"tenant": {
+				Conditions: []Condition{&QueryCondition{TableRegexps: []string{"^orders$"}, ColumnRegexps: []string{".*"}, Strict: true}},
+				Actions:    FilterRows,
+				RowFilter:  &TableRowFilter{Column: "tenant_id", Attribute: AttributeKeyID},
+			},
+		}
+		abac, err := New(rules)
+		require.NoError(t, err)
+
+		stateID := abac.NewState(nil)
+		actions, names, err := abac.Observe(stateID, QueryStatementsEvent([]sql.QueryStatement{{Type: sql.Delete, Table: "orders"}}))
+		require.NoError(t, err)
+		require.Equal(t, FilterRows, actions)
+
+		filters := abac.RowFilters(names)
+		require.Len(t, filters, 1)
+		require.Equal(t, "tenant_id", filters[0].Column)
+		require.True(t, filters[0].Matches("orders"))
+		require.False(t, filters[0].Matches("products"))
+
+		require.True(t, ValidAttribute("extension:tenant@example.com"))
+		require.False(t, ValidAttribute("extension:"))
+		require.False(t, ValidAttribute("principal"))
+	})
 }
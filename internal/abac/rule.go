@@ -5,6 +5,7 @@ import (
 	"math"
 	"net"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,8 +18,46 @@ const (
 	NotPermit Action = 1 << iota
 	Disconnect
 	Notify
+	// RequireMFA denies access unless the SSH connection passed the second
+	// authentication factor.
+	RequireMFA
+	// MaxRows limits the number of rows returned to the client for each
+	// result set of a query to Rule.MaxRows.
+	MaxRows
+	// Mask masks the result columns matched by the query conditions of the
+	// rule in the Rule.Mask style.
+	Mask
+	// FilterRows rewrites queries so that the tables matched by the query
+	// conditions of the rule only return rows passing Rule.RowFilter.
+	FilterRows
+	// ReadOnly makes the session read-only. It is evaluated when the session
+	// connects to the database.
+	ReadOnly
+	// MaxDuration cancels queries running longer than Rule.MaxDuration and
+	// disconnects the session if Rule.MaxDurationDisconnect is set.
+	MaxDuration
 )
 
+// Masking styles of the Mask action.
+const (
+	MaskFull    = "full"
+	MaskPartial = "partial"
+	MaskHash    = "hash"
+	MaskFormat  = "format"
+)
+
+var validMaskStyles = map[string]bool{
+	MaskFull:    true,
+	MaskPartial: true,
+	MaskHash:    true,
+	MaskFormat:  true,
+}
+
+// ValidMaskStyle reports whether style is one of the masking styles.
+func ValidMaskStyle(style string) bool {
+	return validMaskStyles[style]
+}
+
 var validMonths = map[string]time.Month{
 	"january":   time.January,
 	"february":  time.February,
@@ -51,8 +90,40 @@ type Condition interface {
 }
 
 type Rule struct {
-	Conditions []Condition `yaml:"conditions"`
-	Actions    Action      `yaml:"actions"`
+	Conditions []Condition     `yaml:"conditions"`
+	Actions    Action          `yaml:"actions"`
+	MaxRows    int64           `yaml:"max_rows"`
+	Mask       string          `yaml:"mask"`
+	RowFilter  *TableRowFilter `yaml:"row_filter"`
+
+	MaxDuration           time.Duration `yaml:"max_duration"`
+	MaxDurationDisconnect bool          `yaml:"max_duration_disconnect"`
+}
+
+// Session attributes a row filter compares with.
+const (
+	AttributeKeyID            = "key_id"
+	AttributeDatabaseUsername = "database_username"
+	AttributeExtensionPrefix  = "extension:"
+)
+
+// ValidAttribute reports whether attribute names a session attribute.
+func ValidAttribute(attribute string) bool {
+	switch {
+	case attribute == AttributeKeyID, attribute == AttributeDatabaseUsername:
+		return true
+	case strings.HasPrefix(attribute, AttributeExtensionPrefix):
+		return len(attribute) > len(AttributeExtensionPrefix)
+	default:
+		return false
+	}
+}
+
+// TableRowFilter keeps the rows whose Column equals the Attribute of the
+// session: key_id, database_username or extension:<name> of the certificate.
+type TableRowFilter struct {
+	Column    string `yaml:"column"`
+	Attribute string `yaml:"attribute"`
 }
 
 func (c *Rule) Init() error {
@@ -67,6 +138,17 @@ func (c *Rule) Init() error {
 	return nil
 }
 
+// queryConditions returns the query conditions of the rule that are not negated.
+func (c *Rule) queryConditions() []*QueryCondition {
+	var conditions []*QueryCondition
+	for _, condition := range c.Conditions {
+		if query, ok := condition.(*QueryCondition); ok && !query.Not {
+			conditions = append(conditions, query)
+		}
+	}
+	return conditions
+}
+
 func (c *Rule) Matches(state state) (Action, error) {
 	if c == nil {
 		return 0, nil
@@ -116,10 +198,11 @@ func (c *IPCondition) Matches(state state) bool {
 
 	ip, _, err := net.SplitHostPort(state.ip.value)
 	if err != nil {
-		if strings.Contains(err.Error(), "missing port in address") {
-			ip = state.ip.value
+		// A bare IP address has no port, anything else is malformed.
+		if net.ParseIP(state.ip.value) == nil {
+			return false
 		}
-		return false
+		ip = state.ip.value
 	}
 
 	ipAddr, err := net.ResolveIPAddr("ip6", ip)
@@ -459,6 +542,18 @@ func (c *QueryCondition) IsNot() bool {
 	return c.Not
 }
 
+// MatchesColumn reports whether the column of the table matches the table and
+// column regexps regardless of the statement type.
+func (c *QueryCondition) MatchesColumn(table, column string) bool {
+	return c.MatchesTable(table) &&
+		slices.ContainsFunc(c.columnRegexps, func(re *regexp.Regexp) bool { return re.MatchString(column) })
+}
+
+// MatchesTable reports whether the table matches the table regexps.
+func (c *QueryCondition) MatchesTable(table string) bool {
+	return slices.ContainsFunc(c.tableRegexps, func(re *regexp.Regexp) bool { return re.MatchString(table) })
+}
+
 func (c *QueryCondition) Matches(state state) bool {
 	for _, statement := range state.queryStatements {
 		if c.statementType != sql.NoOp {
@@ -0,0 +1,272 @@
+package authkeys
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	wrapssh "ssh-db-proxy/internal/ssh"
+)
+
+const (
+	PrincipalsOption = "principals"
+	FromOption       = "from"
+	ExpiryTimeOption = "expiry-time"
+	DatabasesOption  = "databases"
+)
+
+var (
+	ErrNotChanged        = errors.New("authorized keys not changed")
+	ErrUnknownKey        = errors.New("unknown public key")
+	ErrExpired           = errors.New("public key has expired")
+	ErrUnsupportedOption = errors.New("unsupported option")
+)
+
+// noopOptions restrict features the proxy never provides, so they are accepted
+// and ignored.
+var noopOptions = []string{"restrict", "no-pty", "no-agent-forwarding", "no-x11-forwarding", "no-user-rc"}
+
+var expiryTimeLayouts = []string{"20060102150405", "200601021504", "20060102"}
+
+// Entry is a line of the authorized keys file.
+type Entry struct {
+	Key        ssh.PublicKey
+	Comment    string
+	Principals []string
+	From       string
+	ExpiryTime time.Time
+	Databases  []string
+
+	from []fromPattern
+}
+
+// fromPattern is an item of the from option: an address, a CIDR subnet or an
+// address pattern with '*' and '?' wildcards, negated by a leading '!'.
+type fromPattern struct {
+	negated bool
+	subnet  *net.IPNet
+	pattern string
+}
+
+// Keys is a set of plain public keys allowed to authenticate without a
+// certificate.
+type Keys struct {
+	mu       sync.RWMutex
+	entries  []Entry
+	checksum []byte
+}
+
+func New(path string) (*Keys, error) {
+	k := &Keys{}
+	if err := k.Update(path); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Update rereads the authorized keys file. An empty path removes all keys. It
+// returns ErrNotChanged if the file has not changed.
+func (k *Keys) Update(path string) error {
+	var (
+		entries []Entry
+		data    []byte
+	)
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read authorized keys %s: %w", path, err)
+		}
+		entries, err = Parse(data)
+		if err != nil {
+			return fmt.Errorf("parse authorized keys %s: %w", path, err)
+		}
+	}
+	checksum := sha256.Sum256(data)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.checksum != nil && bytes.Equal(k.checksum, checksum[:]) {
+		return ErrNotChanged
+	}
+	k.entries = entries
+	k.checksum = checksum[:]
+	return nil
+}
+
+// Authenticate finds the entry of the key and checks its options against the
+// client address and the current time.
+func (k *Keys) Authenticate(key ssh.PublicKey, remoteAddr net.Addr, now time.Time) (*Entry, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keyBytes := key.Marshal()
+	for i := range k.entries {
+		entry := &k.entries[i]
+		if subtle.ConstantTimeCompare(entry.Key.Marshal(), keyBytes) == 0 {
+			continue
+		}
+		if !entry.ExpiryTime.IsZero() && !now.Before(entry.ExpiryTime) {
+			return nil, fmt.Errorf("%w: %s", ErrExpired, entry.ExpiryTime.Format(time.RFC3339))
+		}
+		if entry.From != "" && !matchFrom(entry.from, remoteAddr) {
+			return nil, fmt.Errorf("%w: %s", wrapssh.ErrSourceAddressNotAllowed, remoteAddr)
+		}
+		return entry, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// Parse parses an authorized_keys-format file. Every key must have the
+// principals option.
+func Parse(data []byte) ([]Entry, error) {
+	var entries []Entry
+	rest := data
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, comment, options, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			// The rest holds only comments and lines that are not keys.
+			break
+		}
+		rest = next
+		entry := Entry{Key: key, Comment: comment}
+		for _, option := range options {
+			if err := entry.setOption(option); err != nil {
+				return nil, fmt.Errorf("key %s: %w", comment, err)
+			}
+		}
+		if len(entry.Principals) == 0 {
+			return nil, fmt.Errorf("key %s: missing %s option", comment, PrincipalsOption)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (e *Entry) setOption(option string) error {
+	name, value, hasValue := strings.Cut(option, "=")
+	name = strings.ToLower(name)
+	if hasValue {
+		value = strings.Trim(value, `"`)
+	}
+	switch name {
+	case PrincipalsOption:
+		e.Principals = splitList(value)
+	case FromOption:
+		e.From = value
+		for _, item := range splitList(value) {
+			pattern, err := parseFromPattern(item)
+			if err != nil {
+				return err
+			}
+			e.from = append(e.from, pattern)
+		}
+	case DatabasesOption:
+		e.Databases = splitList(value)
+		for _, database := range e.Databases {
+			if _, err := path.Match(database, ""); err != nil {
+				return fmt.Errorf("invalid database pattern %q: %w", database, err)
+			}
+		}
+	case ExpiryTimeOption:
+		expiryTime, err := parseExpiryTime(value)
+		if err != nil {
+			return err
+		}
+		e.ExpiryTime = expiryTime
+	default:
+		if hasValue || !slices.Contains(noopOptions, name) {
+			return fmt.Errorf("%w: %s", ErrUnsupportedOption, name)
+		}
+	}
+	return nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] in the local time zone or in UTC
+// with the Z suffix, as sshd does.
+func parseExpiryTime(value string) (time.Time, error) {
+	location := time.Local
+	if trimmed, ok := strings.CutSuffix(value, "Z"); ok {
+		value = trimmed
+		location = time.UTC
+	}
+	for _, layout := range expiryTimeLayouts {
+		if len(value) != len(layout) {
+			continue
+		}
+		if expiryTime, err := time.ParseInLocation(layout, value, location); err == nil {
+			return expiryTime, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q", ExpiryTimeOption, value)
+}
+
+// parseFromPattern parses an item of the from option. Host name patterns are
+// rejected: the proxy does not resolve client addresses, so they would never
+// match.
+func parseFromPattern(item string) (fromPattern, error) {
+	value, negated := strings.CutPrefix(item, "!")
+	pattern := fromPattern{negated: negated}
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		pattern.subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return pattern, nil
+	}
+	if _, subnet, err := net.ParseCIDR(value); err == nil {
+		pattern.subnet = subnet
+		return pattern, nil
+	}
+	if strings.ContainsAny(value, "*?") && strings.Trim(value, "0123456789abcdefABCDEF.:*?") == "" {
+		pattern.pattern = strings.ToLower(value)
+		return pattern, nil
+	}
+	return fromPattern{}, fmt.Errorf("invalid %s pattern %q: only addresses, subnets and address wildcards are supported", FromOption, item)
+}
+
+// matchFrom matches the client address against the from option as sshd does
+// for a pattern list: a negated match denies, otherwise any match allows.
+func matchFrom(patterns []fromPattern, remoteAddr net.Addr) bool {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	address := tcpAddr.IP.String()
+	matched := false
+	for _, pattern := range patterns {
+		var match bool
+		if pattern.subnet != nil {
+			match = pattern.subnet.Contains(tcpAddr.IP)
+		} else {
+			match, _ = path.Match(pattern.pattern, address)
+		}
+		if match && pattern.negated {
+			return false
+		}
+		matched = matched || match
+	}
+	return matched
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
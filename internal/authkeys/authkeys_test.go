@@ -0,0 +1,112 @@
+package authkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	wrapssh "ssh-db-proxy/internal/ssh"
+)
+
+func newKey(t *testing.T) (ssh.PublicKey, string) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestKeys(t *testing.T) {
+	ciKey, ciLine := newKey(t)
+	contractorKey, contractorLine := newKey(t)
+	unknownKey, _ := newKey(t)
+
+	keysPath := filepath.Join(t.TempDir(), "authorized_keys")
+	require.NoError(t, os.WriteFile(keysPath, []byte(
+		"# CI and contractors\n"+
+			`principals="deploy",databases="orders,billing-*",no-pty `+ciLine+" ci-deploy\n"+
+			`principals="alice,readonly",from="10.0.0.0/8",expiry-time="20300101Z" `+contractorLine+" contractor\n",
+	), 0o644))
+
+	keys, err := New(keysPath)
+	require.NoError(t, err)
+	now := time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)
+	allowedAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 51234}
+	deniedAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 51234}
+
+	t.Run("authenticate", func(t *testing.T) {
+		entry, err := keys.Authenticate(ciKey, deniedAddr, now)
+		require.NoError(t, err)
+		require.Equal(t, "ci-deploy", entry.Comment)
+		require.Equal(t, []string{"deploy"}, entry.Principals)
+		require.Equal(t, []string{"orders", "billing-*"}, entry.Databases)
+
+		entry, err = keys.Authenticate(contractorKey, allowedAddr, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"alice", "readonly"}, entry.Principals)
+		require.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), entry.ExpiryTime)
+
+		_, err = keys.Authenticate(unknownKey, allowedAddr, now)
+		require.ErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		_, err := keys.Authenticate(contractorKey, deniedAddr, now)
+		require.ErrorIs(t, err, wrapssh.ErrSourceAddressNotAllowed)
+
+		_, err = keys.Authenticate(contractorKey, allowedAddr, now.AddDate(1, 0, 0))
+		require.ErrorIs(t, err, ErrExpired)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		require.ErrorIs(t, keys.Update(keysPath), ErrNotChanged)
+
+		require.NoError(t, os.WriteFile(keysPath, []byte(`principals="deploy" `+contractorLine+"\n"), 0o644))
+		require.NoError(t, keys.Update(keysPath))
+		_, err := keys.Authenticate(ciKey, deniedAddr, now)
+		require.ErrorIs(t, err, ErrUnknownKey)
+		_, err = keys.Authenticate(contractorKey, deniedAddr, now)
+		require.NoError(t, err)
+
+		require.NoError(t, keys.Update(""))
+		_, err = keys.Authenticate(contractorKey, deniedAddr, now)
+		require.ErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Parse([]byte(ciLine + "\n"))
+		require.Error(t, err)
+		_, err = Parse([]byte(`principals="deploy",port-forwarding="yes" ` + ciLine + "\n"))
+		require.ErrorIs(t, err, ErrUnsupportedOption)
+		_, err = Parse([]byte(`principals="deploy",expiry-time="2030" ` + ciLine + "\n"))
+		require.Error(t, err)
+		_, err = Parse([]byte(`principals="deploy",from="*.corp" ` + ciLine + "\n"))
+		require.Error(t, err)
+	})
+}
+
+func TestFromPatterns(t *testing.T) {
+	entries, err := Parse([]byte(`principals="deploy",from="10.0.0.*,!10.0.0.13,192.168.0.0/16,2001:db8::?" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDpMBiSYuEbVuxfcvqyqqmKDqaXzeVVYX0KNvmU7Kf3d ci` + "\n"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	for address, expected := range map[string]bool{
+		"10.0.0.1":      true,
+		"10.0.0.13":     false,
+		"10.0.1.1":      false,
+		"192.168.3.4":   true,
+		"2001:db8::5":   true,
+		"2001:db8::1:5": false,
+	} {
+		require.Equal(t, expected, matchFrom(entries[0].from, &net.TCPAddr{IP: net.ParseIP(address)}), address)
+	}
+	require.False(t, matchFrom(entries[0].from, &net.UnixAddr{Name: "/tmp/socket"}))
+}
@@ -3,19 +3,44 @@ package buffered
 import (
 	"io"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
+const readBufferSize = 32 * 1024
+
 type CloserReadWriter interface {
 	io.Reader
 	io.Writer
 	io.Closer
 }
 
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// Conn adapts a stream without deadline support, such as an SSH channel, to
+// net.Conn. Once a deadline is set, reads and writes are performed in
+// background goroutines, so a call can return on deadline while the
+// underlying operation is still blocked. Such a connection is expected to be
+// closed afterwards.
 type Conn struct {
 	conn       CloserReadWriter
 	localAddr  net.Addr
 	remoteAddr net.Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readerOnce sync.Once
+	reads      chan readResult
+	pending    readResult
+
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 func NewConn(conn CloserReadWriter, localAddr, remoteAddr net.Addr) *Conn {
@@ -23,21 +48,101 @@ func NewConn(conn CloserReadWriter, localAddr, remoteAddr net.Addr) *Conn {
 		conn:       conn,
 		localAddr:  localAddr,
 		remoteAddr: remoteAddr,
+		closed:     make(chan struct{}),
 	}
 	return c
 }
 
 func (c *Conn) Read(b []byte) (n int, err error) {
-	n, err = c.conn.Read(b)
+	c.mu.Lock()
+	deadline := c.readDeadline
+	async := c.reads != nil
+	c.mu.Unlock()
+
+	if !async && deadline.IsZero() {
+		n, err = c.conn.Read(b)
+		return
+	}
+	c.startReader()
+
+	if len(c.pending.data) == 0 && c.pending.err == nil {
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case c.pending = <-c.reads:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n = copy(b, c.pending.data)
+	c.pending.data = c.pending.data[n:]
+	if len(c.pending.data) == 0 {
+		err = c.pending.err
+		c.pending.err = nil
+	}
 	return
 }
 
+func (c *Conn) startReader() {
+	c.readerOnce.Do(func() {
+		c.mu.Lock()
+		c.reads = make(chan readResult)
+		c.mu.Unlock()
+		go func() {
+			for {
+				buf := make([]byte, readBufferSize)
+				n, err := c.conn.Read(buf)
+				select {
+				case c.reads <- readResult{data: buf[:n], err: err}:
+				case <-c.closed:
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+}
+
 func (c *Conn) Write(b []byte) (n int, err error) {
-	n, err = c.conn.Write(b)
-	return
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	if deadline.IsZero() {
+		n, err = c.conn.Write(b)
+		return
+	}
+	if !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := c.conn.Write(b)
+		done <- readResult{data: b[:n], err: err}
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return len(res.data), res.err
+	case <-timer.C:
+		return 0, os.ErrDeadlineExceeded
+	}
 }
 
 func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
 	return c.conn.Close()
 }
 
@@ -50,13 +155,23 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
 	return nil
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
 	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
 	return nil
 }
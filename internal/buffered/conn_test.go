@@ -0,0 +1,72 @@
+package buffered
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type pipe struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipe) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+func newPipes() (*Conn, *Conn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return NewConn(pipe{r1, w2}, nil, nil), NewConn(pipe{r2, w1}, nil, nil)
+}
+
+func TestConn(t *testing.T) {
+	t.Run("no-deadline", func(t *testing.T) {
+		client, server := newPipes()
+		go func() {
+			_, _ = client.Write([]byte("hello"))
+		}()
+		b := make([]byte, 16)
+		n, err := server.Read(b)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b[:n]))
+	})
+
+	t.Run("read-deadline", func(t *testing.T) {
+		client, server := newPipes()
+		require.NoError(t, server.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+		b := make([]byte, 3)
+		_, err := server.Read(b)
+		require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+		require.NoError(t, server.SetReadDeadline(time.Time{}))
+		go func() {
+			_, _ = client.Write([]byte("hello"))
+		}()
+		n, err := server.Read(b)
+		require.NoError(t, err)
+		require.Equal(t, "hel", string(b[:n]))
+		n, err = server.Read(b)
+		require.NoError(t, err)
+		require.Equal(t, "lo", string(b[:n]))
+
+		require.NoError(t, server.Close())
+		_, err = server.Read(b)
+		require.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("write-deadline", func(t *testing.T) {
+		client, _ := newPipes()
+		require.NoError(t, client.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err := client.Write([]byte("nobody reads"))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
@@ -10,7 +10,9 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -38,10 +40,41 @@ func NewCertIssuer(caFilePath string, caPrivateKeyPath string) (*CertIssuer, err
 }
 
 func (c *CertIssuer) Issue(commonName string) (tls.Certificate, error) {
+	return c.issue(commonName, &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"DBProxy"},
+			CommonName:   commonName,
+		},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, false)
+}
+
+// IssueServer issues a server certificate for the host names and IP addresses.
+// The certificate chain includes the issuing CA.
+func (c *CertIssuer) IssueServer(commonName string, hosts []string) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"DBProxy"},
+			CommonName:   commonName,
+		},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return c.issue("server:"+commonName+":"+strings.Join(hosts, ","), template, true)
+}
+
+func (c *CertIssuer) issue(cacheKey string, cert *x509.Certificate, withChain bool) (tls.Certificate, error) {
 	now := time.Now()
 
 	c.mu.RLock()
-	if cert, ok := c.cache[commonName]; ok && now.Before(cert.Leaf.NotAfter) {
+	if cert, ok := c.cache[cacheKey]; ok && now.Before(cert.Leaf.NotAfter) {
 		c.mu.RUnlock()
 		return cert, nil
 	}
@@ -54,16 +87,9 @@ func (c *CertIssuer) Issue(commonName string) (tls.Certificate, error) {
 		return tls.Certificate{}, err
 	}
 
-	cert := &x509.Certificate{
-		SerialNumber: n,
-		Subject: pkix.Name{
-			Organization: []string{"DBProxy"},
-			CommonName:   commonName,
-		},
-		NotBefore:   now,
-		NotAfter:    now.Add(10 * time.Minute),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-	}
+	cert.SerialNumber = n
+	cert.NotBefore = now
+	cert.NotAfter = now.Add(10 * time.Minute)
 	certPKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
 		return tls.Certificate{}, err
@@ -94,8 +120,11 @@ func (c *CertIssuer) Issue(commonName string) (tls.Certificate, error) {
 	if err != nil {
 		return tls.Certificate{}, err
 	}
+	if withChain {
+		tlsCert.Certificate = append(tlsCert.Certificate, c.ca.Raw)
+	}
 
-	c.addToCache(commonName, tlsCert, now)
+	c.addToCache(cacheKey, tlsCert, now)
 
 	return tlsCert, nil
 }
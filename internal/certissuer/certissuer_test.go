@@ -43,3 +43,44 @@ func TestCertIssuer_Issue(t *testing.T) {
 	require.NotNil(t, tlsCert.Leaf)
 	require.Equal(t, commonName, tlsCert.Leaf.Subject.CommonName)
 }
+
+func TestCertIssuer_IssueServer(t *testing.T) {
+	const (
+		interCACertFile = "files/inter-ca.pem"
+		interCAKeyFile  = "files/inter-ca.key"
+
+		caCertFile = "files/chain.pem"
+	)
+
+	issuer, err := NewCertIssuer(interCACertFile, interCAKeyFile)
+	require.NoError(t, err)
+
+	tlsCert, err := issuer.IssueServer("billing", []string{"billing", "localhost", "127.0.0.1"})
+	require.NoError(t, err)
+	require.Len(t, tlsCert.Certificate, 2)
+
+	caCert, err := parseCertificate(caCertFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	inters := x509.NewCertPool()
+	interCACert, err := x509.ParseCertificate(tlsCert.Certificate[1])
+	require.NoError(t, err)
+	inters.AddCert(interCACert)
+
+	for _, name := range []string{"billing", "localhost", "127.0.0.1"} {
+		_, err = tlsCert.Leaf.Verify(x509.VerifyOptions{
+			DNSName:       name,
+			Intermediates: inters,
+			Roots:         roots,
+		})
+		require.NoError(t, err, name)
+	}
+	_, err = tlsCert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Intermediates: inters, Roots: roots})
+	require.Error(t, err)
+
+	cached, err := issuer.IssueServer("billing", []string{"billing", "localhost", "127.0.0.1"})
+	require.NoError(t, err)
+	require.Equal(t, tlsCert.Leaf.SerialNumber, cached.Leaf.SerialNumber)
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -17,26 +19,89 @@ import (
 
 var ErrConfigNotChanged = errors.New("config not changed")
 
+// Upstream authentication modes of databases.
+const (
+	DatabaseAuthCertificate = "certificate"
+	DatabaseAuthPassword    = "password"
+	DatabaseAuthPassthrough = "passthrough"
+)
+
 type Config struct {
-	Host               string                                `json:"host"`
-	Port               string                                `json:"port"`
-	NoClientAuth       bool                                  `yaml:"no_client_auth"`
-	HostKeyPrivatePath string                                `yaml:"host_key_private_path"`
-	UserCAPath         string                                `json:"user_ca_path"`
-	MITM               MITMConfig                            `yaml:"mitm_config"`
-	ABACRulesConfig    map[string]ABACRule                   `yaml:"abac_rules"`
-	ABACRules          atomic.Pointer[map[string]*abac.Rule] `yaml:"-"`
-	HotReload          HotReload                             `yaml:"hot_reload"`
-	Notifier           NotifierConfig                        `yaml:"notifier"`
-	ConfigPath         string                                `yaml:"-"`
+	Host                     string                                `json:"host"`
+	Port                     string                                `json:"port"`
+	NoClientAuth             bool                                  `yaml:"no_client_auth"`
+	HostKeyPrivatePath       string                                `yaml:"host_key_private_path"`
+	HostCertificatePath      string                                `yaml:"host_certificate_path"`
+	HostKeys                 []HostKey                             `yaml:"host_keys"`
+	UserCAPath               string                                `json:"user_ca_path"`
+	UserCAs                  []UserCA                              `yaml:"user_cas"`
+	KRLPath                  string                                `yaml:"krl_path"`
+	AuthorizedKeysPath       string                                `yaml:"authorized_keys_path"`
+	SupportedCriticalOptions []string                              `yaml:"supported_critical_options"`
+	MITM                     MITMConfig                            `yaml:"mitm_config"`
+	Databases                map[string]Database                   `yaml:"databases"`
+	RoleMapping              RoleMapping                           `yaml:"role_mapping"`
+	ABACRulesConfig          map[string]ABACRule                   `yaml:"abac_rules"`
+	ABACRules                atomic.Pointer[map[string]*abac.Rule] `yaml:"-"`
+	HotReload                HotReload                             `yaml:"hot_reload"`
+	Timeouts                 Timeouts                              `yaml:"timeouts"`
+	Session                  SessionConfig                         `yaml:"session"`
+	MFA                      MFAConfig                             `yaml:"mfa"`
+	Lockout                  Lockout                               `yaml:"lockout"`
+	Notifier                 NotifierConfig                        `yaml:"notifier"`
+	ConfigPath               string                                `yaml:"-"`
 
 	checksum []byte
 }
 
+type HostKey struct {
+	PrivateKeyPath  string `yaml:"private_key_path"`
+	CertificatePath string `yaml:"certificate_path"`
+}
+
+type UserCA struct {
+	Path       string   `yaml:"path"`
+	Principals []string `yaml:"principals"`
+}
+
 type MITMConfig struct {
-	DatabaseCAPath       string `yaml:"database_ca_path"`
-	ClientCAFilePath     string `yaml:"client_ca_path"`
-	ClientPrivateKeyPath string `yaml:"client_private_key_path"`
+	ClientCAFilePath     string          `yaml:"client_ca_path"`
+	ClientPrivateKeyPath string          `yaml:"client_private_key_path"`
+	ClientTLS            ClientTLSConfig `yaml:"client_tls"`
+}
+
+type ClientTLSConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	ServerNames []string `yaml:"server_names"`
+}
+
+type Database struct {
+	Host              string       `yaml:"host"`
+	Port              uint32       `yaml:"port"`
+	Socket            string       `yaml:"socket"`
+	Alias             string       `yaml:"alias"`
+	CAPath            string       `yaml:"ca_path"`
+	TLSCertPath       string       `yaml:"tls_cert_path"`
+	TLSKeyPath        string       `yaml:"tls_key_path"`
+	Auth              DatabaseAuth `yaml:"auth"`
+	AllowedPrincipals []string     `yaml:"allowed_principals"`
+}
+
+type DatabaseAuth struct {
+	Mode        string `yaml:"mode"`
+	SecretsPath string `yaml:"secrets_path"`
+}
+
+type RoleMapping struct {
+	GroupsExtension string            `yaml:"groups_extension"`
+	Rules           []RoleMappingRule `yaml:"rules"`
+}
+
+type RoleMappingRule struct {
+	Principals []string `yaml:"principals"`
+	Groups     []string `yaml:"groups"`
+	Roles      []string `yaml:"roles"`
+	Databases  []string `yaml:"databases"`
 }
 
 type ABACRule struct {
@@ -53,9 +118,17 @@ type ABACCondition struct {
 }
 
 type ABACActions struct {
-	Notify     bool `yaml:"notify"`
-	NotPermit  bool `yaml:"not_permit"`
-	Disconnect bool `yaml:"disconnect"`
+	Notify     bool                 `yaml:"notify"`
+	NotPermit  bool                 `yaml:"not_permit"`
+	Disconnect bool                 `yaml:"disconnect"`
+	RequireMFA bool                 `yaml:"require_mfa"`
+	MaxRows    int64                `yaml:"max_rows"`
+	Mask       string               `yaml:"mask"`
+	RowFilter  *abac.TableRowFilter `yaml:"row_filter"`
+	ReadOnly   bool                 `yaml:"read_only"`
+
+	MaxDuration           time.Duration `yaml:"max_duration"`
+	MaxDurationDisconnect bool          `yaml:"max_duration_disconnect"`
 }
 
 type HotReload struct {
@@ -63,6 +136,38 @@ type HotReload struct {
 	Period  time.Duration `yaml:"period"`
 }
 
+type Timeouts struct {
+	ConnectionIdle          time.Duration `yaml:"connection_idle"`
+	RequestIdle             time.Duration `yaml:"request_idle"`
+	IdleInTransaction       time.Duration `yaml:"idle_in_transaction"`
+	MaxSessionDuration      time.Duration `yaml:"max_session_duration"`
+	KeepaliveInterval       time.Duration `yaml:"keepalive_interval"`
+	KeepaliveCountMax       int           `yaml:"keepalive_count_max"`
+	CertificateExpiryNotice time.Duration `yaml:"certificate_expiry_notice"`
+}
+
+type SessionConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Banner        string `yaml:"banner"`
+	PublicAddress string `yaml:"public_address"`
+}
+
+type MFAConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Required    bool   `yaml:"required"`
+	SecretsPath string `yaml:"secrets_path"`
+}
+
+type Lockout struct {
+	Enabled        bool          `yaml:"enabled"`
+	MaxFailures    int           `yaml:"max_failures"`
+	FailureWindow  time.Duration `yaml:"failure_window"`
+	BaseBackoff    time.Duration `yaml:"base_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	BanDuration    time.Duration `yaml:"ban_duration"`
+	MaxBanDuration time.Duration `yaml:"max_ban_duration"`
+}
+
 type NotifierConfig struct {
 	Enabled bool `yaml:"enabled"`
 	Listen  struct {
@@ -104,17 +209,42 @@ func LoadConfig(path string, oldConfig *Config) (*Config, error) {
 
 	if oldConfig != nil {
 		newConfig = &Config{
-			Host:               oldConfig.Host,
-			Port:               oldConfig.Port,
-			NoClientAuth:       oldConfig.NoClientAuth,
-			HostKeyPrivatePath: oldConfig.HostKeyPrivatePath,
-			UserCAPath:         oldConfig.UserCAPath,
-			MITM:               oldConfig.MITM,
-			ABACRulesConfig:    readConfig.ABACRulesConfig,
-			HotReload:          readConfig.HotReload,
+			Host:                     oldConfig.Host,
+			Port:                     oldConfig.Port,
+			NoClientAuth:             oldConfig.NoClientAuth,
+			HostKeyPrivatePath:       oldConfig.HostKeyPrivatePath,
+			HostCertificatePath:      oldConfig.HostCertificatePath,
+			HostKeys:                 oldConfig.HostKeys,
+			UserCAPath:               oldConfig.UserCAPath,
+			UserCAs:                  readConfig.UserCAs,
+			KRLPath:                  readConfig.KRLPath,
+			AuthorizedKeysPath:       readConfig.AuthorizedKeysPath,
+			SupportedCriticalOptions: readConfig.SupportedCriticalOptions,
+			MITM:                     oldConfig.MITM,
+			Databases:                readConfig.Databases,
+			RoleMapping:              readConfig.RoleMapping,
+			ABACRulesConfig:          readConfig.ABACRulesConfig,
+			HotReload:                readConfig.HotReload,
+			Timeouts:                 readConfig.Timeouts,
+			Session:                  readConfig.Session,
+			MFA:                      oldConfig.MFA,
+			Lockout:                  readConfig.Lockout,
 		}
+		// Secrets are loaded on start only if MFA is enabled, so only the
+		// requirement follows the file.
+		newConfig.MFA.Required = readConfig.MFA.Required
 	} else {
 		newConfig = &readConfig
+		if newConfig.HostKeyPrivatePath != "" {
+			newConfig.HostKeys = append(newConfig.HostKeys, HostKey{
+				PrivateKeyPath:  newConfig.HostKeyPrivatePath,
+				CertificatePath: newConfig.HostCertificatePath,
+			})
+		}
+	}
+
+	if newConfig.UserCAPath != "" {
+		newConfig.UserCAs = append(newConfig.UserCAs, UserCA{Path: newConfig.UserCAPath})
 	}
 
 	if err := validateConfig(newConfig); err != nil {
@@ -134,6 +264,120 @@ func validateConfig(config *Config) error {
 			return fmt.Errorf("hot reload period must be greater than zero")
 		}
 	}
+	timeouts := config.Timeouts
+	for _, timeout := range []time.Duration{timeouts.ConnectionIdle, timeouts.RequestIdle, timeouts.IdleInTransaction, timeouts.MaxSessionDuration, timeouts.KeepaliveInterval, timeouts.CertificateExpiryNotice} {
+		if timeout < 0 {
+			return fmt.Errorf("timeouts must not be negative")
+		}
+	}
+	if timeouts.KeepaliveCountMax < 0 {
+		return fmt.Errorf("keepalive count max must not be negative")
+	}
+	if len(config.HostKeys) == 0 {
+		return fmt.Errorf("at least one host key must be configured")
+	}
+	for _, hostKey := range config.HostKeys {
+		if hostKey.PrivateKeyPath == "" {
+			return fmt.Errorf("host key private key path must be set")
+		}
+	}
+	if config.HostCertificatePath != "" && config.HostKeyPrivatePath == "" {
+		return fmt.Errorf("host certificate requires host key private path")
+	}
+	if !config.NoClientAuth && len(config.UserCAs) == 0 && config.AuthorizedKeysPath == "" {
+		return fmt.Errorf("at least one user CA or authorized keys must be configured")
+	}
+	if config.Lockout.Enabled {
+		lockout := config.Lockout
+		for _, duration := range []time.Duration{lockout.FailureWindow, lockout.BaseBackoff, lockout.MaxBackoff, lockout.BanDuration, lockout.MaxBanDuration} {
+			if duration < 0 {
+				return fmt.Errorf("lockout durations must not be negative")
+			}
+		}
+		if lockout.MaxFailures < 0 {
+			return fmt.Errorf("lockout max failures must not be negative")
+		}
+		if lockout.MaxFailures > 0 && lockout.BanDuration == 0 {
+			return fmt.Errorf("lockout ban duration must be set with max failures")
+		}
+	}
+	if config.MFA.Enabled {
+		if config.NoClientAuth {
+			return fmt.Errorf("MFA requires client authentication")
+		}
+		if config.MFA.SecretsPath == "" {
+			return fmt.Errorf("MFA secrets path must be set")
+		}
+	}
+	for _, ca := range config.UserCAs {
+		if ca.Path == "" {
+			return fmt.Errorf("user CA path must be set")
+		}
+		for _, principal := range ca.Principals {
+			if _, err := path.Match(principal, ""); err != nil {
+				return fmt.Errorf("user CA %s: invalid principal pattern %q: %w", ca.Path, principal, err)
+			}
+		}
+	}
+	aliases := make(map[string]string, len(config.Databases))
+	for name, database := range config.Databases {
+		if database.Socket != "" {
+			if database.Host != "" || database.Port != 0 {
+				return fmt.Errorf("database %s must have either socket or host and port", name)
+			}
+			if !path.IsAbs(database.Socket) {
+				return fmt.Errorf("database %s socket path must be absolute", name)
+			}
+		} else {
+			if database.Host == "" || database.Port == 0 {
+				return fmt.Errorf("database %s must have host and port", name)
+			}
+			if database.CAPath == "" {
+				return fmt.Errorf("database %s must have CA path", name)
+			}
+		}
+		switch database.Auth.Mode {
+		case "", DatabaseAuthCertificate, DatabaseAuthPassthrough:
+			if database.Auth.SecretsPath != "" {
+				return fmt.Errorf("database %s: secrets path is only used with %s auth", name, DatabaseAuthPassword)
+			}
+		case DatabaseAuthPassword:
+			if database.Auth.SecretsPath == "" {
+				return fmt.Errorf("database %s must have auth secrets path", name)
+			}
+		default:
+			return fmt.Errorf("database %s: unknown auth mode %q", name, database.Auth.Mode)
+		}
+		if (database.TLSCertPath == "") != (database.TLSKeyPath == "") {
+			return fmt.Errorf("database %s must have both TLS certificate and key paths", name)
+		}
+		if database.Alias != "" {
+			if other, ok := aliases[database.Alias]; ok {
+				return fmt.Errorf("databases %s and %s have the same alias %s", name, other, database.Alias)
+			}
+			aliases[database.Alias] = name
+		}
+		for _, principal := range database.AllowedPrincipals {
+			if _, err := path.Match(principal, ""); err != nil {
+				return fmt.Errorf("database %s: invalid principal pattern %q: %w", name, principal, err)
+			}
+		}
+	}
+	for i, rule := range config.RoleMapping.Rules {
+		if len(rule.Principals) == 0 && len(rule.Groups) == 0 {
+			return fmt.Errorf("role mapping rule %d must have principals or groups", i)
+		}
+		if len(rule.Roles) == 0 {
+			return fmt.Errorf("role mapping rule %d must have roles", i)
+		}
+		for _, patterns := range [][]string{rule.Principals, rule.Groups, rule.Roles, rule.Databases} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("role mapping rule %d: invalid pattern %q: %w", i, pattern, err)
+				}
+			}
+		}
+	}
 	for ruleName, rule := range config.ABACRulesConfig {
 		for _, condition := range rule.Conditions {
 			notNil := 0
@@ -159,10 +403,45 @@ func validateConfig(config *Config) error {
 				return fmt.Errorf("rule %s must have at most one condition", ruleName)
 			}
 		}
+		if rule.Actions.MaxRows < 0 {
+			return fmt.Errorf("rule %s: max_rows must not be negative", ruleName)
+		}
+		if rule.Actions.Mask != "" {
+			if !abac.ValidMaskStyle(rule.Actions.Mask) {
+				return fmt.Errorf("rule %s: invalid mask style %q", ruleName, rule.Actions.Mask)
+			}
+			if !hasQueryCondition(rule) {
+				return fmt.Errorf("rule %s: mask requires a query condition", ruleName)
+			}
+		}
+		if filter := rule.Actions.RowFilter; filter != nil {
+			if filter.Column == "" {
+				return fmt.Errorf("rule %s: row_filter must have a column", ruleName)
+			}
+			if !abac.ValidAttribute(filter.Attribute) {
+				return fmt.Errorf("rule %s: invalid row_filter attribute %q", ruleName, filter.Attribute)
+			}
+			if !hasQueryCondition(rule) {
+				return fmt.Errorf("rule %s: row_filter requires a query condition", ruleName)
+			}
+		}
+		if rule.Actions.MaxDuration < 0 {
+			return fmt.Errorf("rule %s: max_duration must not be negative", ruleName)
+		}
+		if rule.Actions.MaxDurationDisconnect && rule.Actions.MaxDuration == 0 {
+			return fmt.Errorf("rule %s: max_duration_disconnect requires max_duration", ruleName)
+		}
+		if rule.Actions.ReadOnly && hasQueryCondition(rule) {
+			return fmt.Errorf("rule %s: read_only is evaluated on connect and cannot have a query condition", ruleName)
+		}
 	}
 	return nil
 }
 
+func hasQueryCondition(rule ABACRule) bool {
+	return slices.ContainsFunc(rule.Conditions, func(condition ABACCondition) bool { return condition.QueryCondition != nil })
+}
+
 func buildABACRules(config *Config) {
 	abacRules := make(map[string]*abac.Rule, len(config.ABACRulesConfig))
 	for ruleName, rule := range config.ABACRulesConfig {
@@ -193,6 +472,29 @@ func buildABACRules(config *Config) {
 		if rule.Actions.Disconnect {
 			abacRules[ruleName].Actions |= abac.Disconnect
 		}
+		if rule.Actions.RequireMFA {
+			abacRules[ruleName].Actions |= abac.RequireMFA
+		}
+		if rule.Actions.MaxRows > 0 {
+			abacRules[ruleName].Actions |= abac.MaxRows
+			abacRules[ruleName].MaxRows = rule.Actions.MaxRows
+		}
+		if rule.Actions.Mask != "" {
+			abacRules[ruleName].Actions |= abac.Mask
+			abacRules[ruleName].Mask = rule.Actions.Mask
+		}
+		if rule.Actions.RowFilter != nil {
+			abacRules[ruleName].Actions |= abac.FilterRows
+			abacRules[ruleName].RowFilter = rule.Actions.RowFilter
+		}
+		if rule.Actions.ReadOnly {
+			abacRules[ruleName].Actions |= abac.ReadOnly
+		}
+		if rule.Actions.MaxDuration > 0 {
+			abacRules[ruleName].Actions |= abac.MaxDuration
+			abacRules[ruleName].MaxDuration = rule.Actions.MaxDuration
+			abacRules[ruleName].MaxDurationDisconnect = rule.Actions.MaxDurationDisconnect
+		}
 	}
 	config.ABACRules.Store(&abacRules)
 }
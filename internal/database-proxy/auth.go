@@ -0,0 +1,100 @@
+package database_proxy
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/authkeys"
+	"ssh-db-proxy/internal/config"
+	wrapssh "ssh-db-proxy/internal/ssh"
+	"ssh-db-proxy/internal/userca"
+)
+
+var (
+	ErrCertificateNotYetValid = errors.New("certificate is not yet valid")
+	ErrCertificateExpired     = errors.New("certificate has expired")
+	ErrNoPrincipals           = errors.New("no valid principals")
+	ErrNonCertificateKey      = errors.New("received non-certificate key")
+	ErrLockedOut              = errors.New("locked out")
+)
+
+// authSettings are the authentication settings read on every attempt, so they
+// follow the hot reloaded config.
+type authSettings struct {
+	supportedCriticalOptions []string
+	mfaRequired              bool
+}
+
+func newAuthSettings(config *config.Config) *authSettings {
+	return &authSettings{
+		supportedCriticalOptions: config.SupportedCriticalOptions,
+		mfaRequired:              config.MFA.Required,
+	}
+}
+
+// Machine-readable reasons of failed authentication reported in audit events.
+const (
+	authReasonExpired           = "expired"
+	authReasonNotYetValid       = "not-yet-valid"
+	authReasonUnknownCA         = "unknown-ca"
+	authReasonInvalidSignature  = "invalid-signature"
+	authReasonNoPrincipals      = "no-principals"
+	authReasonNonCertificateKey = "non-certificate-key"
+	authReasonRevoked           = "revoked"
+	authReasonSourceAddress     = "source-address"
+	authReasonCriticalOption    = "critical-option"
+	authReasonLockedOut         = "locked-out"
+	authReasonOther             = "other"
+)
+
+// authFailureReason maps an authentication error to its audit reason. It
+// returns an empty string for successful authentication.
+func authFailureReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrCertificateExpired), errors.Is(err, authkeys.ErrExpired):
+		return authReasonExpired
+	case errors.Is(err, ErrCertificateNotYetValid):
+		return authReasonNotYetValid
+	case errors.Is(err, userca.ErrUnknownAuthority):
+		return authReasonUnknownCA
+	case errors.Is(err, userca.ErrInvalidSignature), errors.Is(err, userca.ErrNotUserCertificate):
+		return authReasonInvalidSignature
+	case errors.Is(err, ErrNoPrincipals), errors.Is(err, userca.ErrForbiddenPrincipals):
+		return authReasonNoPrincipals
+	case errors.Is(err, ErrNonCertificateKey), errors.Is(err, authkeys.ErrUnknownKey):
+		return authReasonNonCertificateKey
+	case errors.Is(err, userca.ErrRevoked):
+		return authReasonRevoked
+	case errors.Is(err, wrapssh.ErrSourceAddressNotAllowed):
+		return authReasonSourceAddress
+	case errors.Is(err, wrapssh.ErrUnsupportedCriticalOption), errors.Is(err, userca.ErrUnsupportedCriticalOption):
+		return authReasonCriticalOption
+	case errors.Is(err, ErrLockedOut):
+		return authReasonLockedOut
+	default:
+		return authReasonOther
+	}
+}
+
+// isAuthFailure reports whether a handshake failed because the client's
+// credentials were rejected. Scanners, resets and clients that disconnect
+// before trying a key do not count, and neither do attempts of a locked out
+// KeyId.
+func isAuthFailure(err error) bool {
+	var authErr *ssh.ServerAuthError
+	if !errors.As(err, &authErr) {
+		return false
+	}
+	for _, err := range authErr.Errors {
+		if errors.Is(err, ErrLockedOut) {
+			continue
+		}
+		if errors.Is(err, ErrAuthError) || errors.Is(err, ErrNonCertificateKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package database_proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/authkeys"
+	wrapssh "ssh-db-proxy/internal/ssh"
+	"ssh-db-proxy/internal/userca"
+)
+
+func TestAuthFailureReason(t *testing.T) {
+	for err, reason := range map[error]string{
+		nil:                       "",
+		ErrCertificateExpired:     authReasonExpired,
+		ErrCertificateNotYetValid: authReasonNotYetValid,
+		ErrNoPrincipals:           authReasonNoPrincipals,
+		authkeys.ErrExpired:       authReasonExpired,
+		authkeys.ErrUnknownKey:    authReasonNonCertificateKey,
+		userca.ErrRevoked:         authReasonRevoked,
+		fmt.Errorf("%w: serial 1", userca.ErrRevoked):                      authReasonRevoked,
+		fmt.Errorf("%w: %w", ErrAuthError, userca.ErrUnknownAuthority):     authReasonUnknownCA,
+		fmt.Errorf("%w: %w", ErrAuthError, userca.ErrForbiddenPrincipals):  authReasonNoPrincipals,
+		fmt.Errorf("%w: bad", userca.ErrInvalidSignature):                  authReasonInvalidSignature,
+		fmt.Errorf("%w: type 2", userca.ErrNotUserCertificate):             authReasonInvalidSignature,
+		fmt.Errorf("%w: permit-pty", userca.ErrUnsupportedCriticalOption):  authReasonCriticalOption,
+		fmt.Errorf("%w: 10.0.0.1", wrapssh.ErrSourceAddressNotAllowed):     authReasonSourceAddress,
+		fmt.Errorf("%w: permit-pty", wrapssh.ErrUnsupportedCriticalOption): authReasonCriticalOption,
+		fmt.Errorf("%w: key id alice until tomorrow", ErrLockedOut):        authReasonLockedOut,
+		fmt.Errorf("something else"):                                       authReasonOther,
+	} {
+		require.Equal(t, reason, authFailureReason(err), "%v", err)
+	}
+}
+
+func TestIsAuthFailure(t *testing.T) {
+	for err, failure := range map[error]bool{
+		io.EOF: false,
+		errors.New("ssh: overflow reading version string"):   false,
+		&ssh.ServerAuthError{}:                               false,
+		&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth}}: false,
+		&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth, fmt.Errorf("%w: %w", ErrAuthError, ErrLockedOut)}}:                        false,
+		&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth, fmt.Errorf("%w type: *ssh.rsaPublicKey", ErrNonCertificateKey)}}:          true,
+		fmt.Errorf("handshake: %w", &ssh.ServerAuthError{Errors: []error{fmt.Errorf("%w: %w", ErrAuthError, ErrCertificateExpired)}}): true,
+	} {
+		require.Equal(t, failure, isAuthFailure(err), "%v", err)
+	}
+}
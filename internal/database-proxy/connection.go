@@ -0,0 +1,286 @@
+package database_proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/config"
+	"ssh-db-proxy/internal/metadata"
+	"ssh-db-proxy/internal/mitm"
+	"ssh-db-proxy/internal/rolemap"
+	wrapssh "ssh-db-proxy/internal/ssh"
+)
+
+const (
+	keepaliveRequest      = "keepalive@openssh.com"
+	defaultKeepaliveCount = 3
+	connectionCheckPeriod = time.Second
+
+	defaultCertificateExpiryNotice = time.Minute
+)
+
+// connection is the state of an authenticated SSH connection shared by its channels.
+type connection struct {
+	sConn      *ssh.ServerConn
+	metadata   metadata.Metadata
+	principals []string
+	groups     []string
+	grants     rolemap.Grants
+	attributes map[string]string
+	databases  []string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	validBefore    time.Time
+	hasValidBefore bool
+
+	mu           sync.Mutex
+	sessions     map[string]*mitm.MITM
+	lastActivity time.Time
+	terminated   error
+}
+
+func newConnection(sConn *ssh.ServerConn, data metadata.Metadata, principals, groups []string, grants rolemap.Grants, localAddr, remoteAddr net.Addr) *connection {
+	validBefore, hasValidBefore := wrapssh.ValidBefore(sConn.Permissions)
+	return &connection{
+		validBefore:    validBefore,
+		hasValidBefore: hasValidBefore,
+		sConn:          sConn,
+		metadata:       data,
+		principals:     principals,
+		groups:         groups,
+		grants:         grants,
+		attributes:     sessionAttributes(sConn.Permissions),
+		databases:      wrapssh.AllowedDatabases(sConn.Permissions),
+		localAddr:      localAddr,
+		remoteAddr:     remoteAddr,
+		sessions:       make(map[string]*mitm.MITM),
+		lastActivity:   time.Now(),
+	}
+}
+
+// sessionAttributes returns the attributes of the authenticated key that ABAC
+// row filters compare with.
+func sessionAttributes(permissions *ssh.Permissions) map[string]string {
+	attributes := make(map[string]string)
+	if keyID := permissions.Extensions[wrapssh.KeyIDExtension]; keyID != "" {
+		attributes[abac.AttributeKeyID] = keyID
+	}
+	for name, value := range wrapssh.CertExtensions(permissions) {
+		attributes[abac.AttributeExtensionPrefix+name] = value
+	}
+	return attributes
+}
+
+// allowsDatabase reports whether the key the connection was authenticated with
+// may reach the database.
+func (c *connection) allowsDatabase(name string) bool {
+	if len(c.databases) == 0 {
+		return true
+	}
+	for _, pattern := range c.databases {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// addSession registers a MITM session of the connection. It returns false if
+// the connection is already being terminated.
+func (c *connection) addSession(requestID string, m *mitm.MITM) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.terminated != nil {
+		return false
+	}
+	c.sessions[requestID] = m
+	c.lastActivity = time.Now()
+	return true
+}
+
+func (c *connection) removeSession(requestID string) {
+	c.mu.Lock()
+	delete(c.sessions, requestID)
+	c.lastActivity = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *connection) terminationReason() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.terminated
+}
+
+func (c *connection) notice(message string) {
+	c.mu.Lock()
+	sessions := make([]*mitm.MITM, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	c.mu.Unlock()
+	for _, session := range sessions {
+		session.Notice(message)
+	}
+}
+
+func (c *connection) idleSince() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lastActivity := c.lastActivity
+	for _, session := range c.sessions {
+		if sessionActivity := session.LastActivity(); sessionActivity.After(lastActivity) {
+			lastActivity = sessionActivity
+		}
+	}
+	return lastActivity
+}
+
+// terminate terminates every MITM session of the connection with the reason
+// and closes the connection. It returns the number of terminated sessions and
+// whether the call had an effect, which only the first one does.
+func (c *connection) terminate(reason error) (int, bool) {
+	c.mu.Lock()
+	if c.terminated != nil {
+		c.mu.Unlock()
+		return 0, false
+	}
+	c.terminated = reason
+	sessions := make([]*mitm.MITM, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.Terminate(reason)
+		}()
+	}
+	wg.Wait()
+	c.sConn.Close()
+	return len(sessions), true
+}
+
+func (proxy *DatabaseProxy) terminateConnection(conn *connection, reason error) {
+	sessions, ok := conn.terminate(reason)
+	if !ok {
+		return
+	}
+	proxy.logger.Infow("terminated connection", "id", conn.metadata.ConnectionID, "reason", reason)
+	if sessions > 0 {
+		// Every terminated MITM session reports its termination itself.
+		return
+	}
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-session-terminated-event"), func(ctx context.Context) {
+		proxy.notifier.OnSessionTerminated(reason, conn.metadata)
+	})
+}
+
+// watchConnection enforces the maximum session lifetime and the idle timeout of the connection.
+func (proxy *DatabaseProxy) watchConnection(ctx context.Context, conn *connection, timeouts config.Timeouts) {
+	if timeouts.MaxSessionDuration <= 0 && timeouts.ConnectionIdle <= 0 {
+		return
+	}
+	var deadline <-chan time.Time
+	if timeouts.MaxSessionDuration > 0 {
+		timer := time.NewTimer(timeouts.MaxSessionDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(connectionCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			proxy.terminateConnection(conn, mitm.ErrSessionLifetimeExceeded)
+			return
+		case now := <-ticker.C:
+			if timeouts.ConnectionIdle > 0 && now.Sub(conn.idleSince()) >= timeouts.ConnectionIdle {
+				proxy.terminateConnection(conn, mitm.ErrIdleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// watchCertificateExpiry warns the clients before the SSH certificate expires
+// and closes the connection when it does.
+func (proxy *DatabaseProxy) watchCertificateExpiry(ctx context.Context, conn *connection, timeouts config.Timeouts) {
+	if !conn.hasValidBefore {
+		return
+	}
+	noticeBefore := timeouts.CertificateExpiryNotice
+	if noticeBefore <= 0 {
+		noticeBefore = defaultCertificateExpiryNotice
+	}
+	noticeTimer := time.NewTimer(time.Until(conn.validBefore.Add(-noticeBefore)))
+	defer noticeTimer.Stop()
+	expiryTimer := time.NewTimer(time.Until(conn.validBefore))
+	defer expiryTimer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-noticeTimer.C:
+			conn.notice(fmt.Sprintf("SSH certificate expires at %s, the session will be closed", conn.validBefore.Format(time.RFC3339)))
+		case <-expiryTimer.C:
+			proxy.terminateConnection(conn, mitm.ErrCertificateExpired)
+			return
+		}
+	}
+}
+
+// keepalive probes the client with keepalive@openssh.com requests, as sshd's
+// ClientAliveInterval does. Any reply counts as alive.
+func (proxy *DatabaseProxy) keepalive(ctx context.Context, conn *connection, timeouts config.Timeouts) {
+	if timeouts.KeepaliveInterval <= 0 {
+		return
+	}
+	countMax := timeouts.KeepaliveCountMax
+	if countMax <= 0 {
+		countMax = defaultKeepaliveCount
+	}
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(timeouts.KeepaliveInterval):
+		}
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.sConn.SendRequest(keepaliveRequest, true, nil)
+			replied <- err
+		}()
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-replied:
+			if err != nil {
+				proxy.terminateConnection(conn, mitm.ErrKeepaliveTimeout)
+				return
+			}
+			missed = 0
+		case <-time.After(timeouts.KeepaliveInterval):
+			missed++
+			if missed >= countMax {
+				proxy.terminateConnection(conn, mitm.ErrKeepaliveTimeout)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package database_proxy
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/lockout"
+	"ssh-db-proxy/internal/mfa"
+	"ssh-db-proxy/internal/notifier"
+	wrapssh "ssh-db-proxy/internal/ssh"
+)
+
+const (
+	mfaMethodTOTP  = "totp"
+	mfaPrompt      = "Verification code: "
+	mfaMaxAttempts = 3
+)
+
+// requireMFA chains a keyboard-interactive TOTP step after a successful public
+// key step if the user has a TOTP secret. Users without a secret pass without
+// the second factor unless it is required.
+func requireMFA(secrets *mfa.Secrets, required bool, permissions *ssh.Permissions, guard *lockout.Guard, auditor *notifier.Notifier, logger *zap.SugaredLogger) (*ssh.Permissions, error) {
+	var names []string
+	if keyID := permissions.Extensions[wrapssh.KeyIDExtension]; keyID != "" {
+		names = append(names, keyID)
+	}
+	names = append(names, strings.Split(permissions.Extensions[wrapssh.UsersExtension], ",")...)
+	name, ok := secrets.Lookup(names...)
+	if !ok {
+		if required {
+			return nil, fmt.Errorf("%w: %w", ErrAuthError, mfa.ErrNoSecret)
+		}
+		return permissions, nil
+	}
+
+	return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			var err error
+			for range mfaMaxAttempts {
+				var answers []string
+				answers, err = client("", "", []string{mfaPrompt}, []bool{false})
+				if err != nil {
+					break
+				}
+				if len(answers) != 1 {
+					err = fmt.Errorf("expected one answer, got %d", len(answers))
+					break
+				}
+				if err = secrets.Verify(name, answers[0], time.Now()); err == nil {
+					break
+				}
+			}
+			remoteAddr := conn.RemoteAddr().String()
+			go pprof.Do(context.Background(), pprof.Labels("name", "on-mfa-event"), func(ctx context.Context) {
+				auditor.OnMFA(mfaMethodTOTP, name, remoteAddr, err)
+			})
+			if err != nil {
+				if wrapssh.AuthMethod(permissions) == wrapssh.AuthMethodCertificate {
+					guard.Failure(lockout.KindKeyID, permissions.Extensions[wrapssh.KeyIDExtension])
+				}
+				logger.Infow("failed MFA", "name", name, "remote-addr", remoteAddr, "err", err)
+				return nil, fmt.Errorf("%w: %w", ErrAuthError, err)
+			}
+			permissions.Extensions[wrapssh.MFAExtension] = mfaMethodTOTP
+			return permissions, nil
+		},
+	}}
+}
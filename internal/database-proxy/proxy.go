@@ -2,15 +2,14 @@ package database_proxy
 
 import (
 	"context"
-	"crypto/subtle"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
-	"os"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,18 +17,25 @@ import (
 	"golang.org/x/crypto/ssh"
 
 	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/authkeys"
 	"ssh-db-proxy/internal/buffered"
 	"ssh-db-proxy/internal/certissuer"
+	"ssh-db-proxy/internal/lockout"
 	"ssh-db-proxy/internal/metadata"
+	"ssh-db-proxy/internal/mfa"
 	"ssh-db-proxy/internal/mitm"
 	"ssh-db-proxy/internal/notifier"
+	"ssh-db-proxy/internal/rolemap"
 	wrapssh "ssh-db-proxy/internal/ssh"
+	"ssh-db-proxy/internal/upstream"
+	"ssh-db-proxy/internal/userca"
 
 	"ssh-db-proxy/internal/config"
 )
 
 var (
-	ErrAuthError = errors.New("auth error")
+	ErrAuthError         = errors.New("auth error")
+	ErrForbiddenDatabase = errors.New("database is not allowed for the key")
 )
 
 type DatabaseProxy struct {
@@ -40,8 +46,15 @@ type DatabaseProxy struct {
 	notifier *notifier.Notifier
 	abac     *abac.ABAC
 
-	certIssuer         *certissuer.CertIssuer
-	databaseCACertPool *x509.CertPool
+	userCAs        *userca.Authorities
+	authorizedKeys *authkeys.Keys
+	mfaSecrets     *mfa.Secrets
+	lockout        *lockout.Guard
+	authSettings   *atomic.Pointer[authSettings]
+	certIssuer     *certissuer.CertIssuer
+	cancelKeys     *mitm.CancelKeys
+	databases      *upstream.Registry
+	roles          *rolemap.Mapper
 }
 
 type ConnWithMetadata struct {
@@ -59,66 +72,138 @@ func NewDatabaseProxy(config *config.Config, auditor *notifier.Notifier, logger
 	if err != nil {
 		return nil, err
 	}
-	certPool := x509.NewCertPool()
-	pems, err := os.ReadFile(mitmConfig.DatabaseCAPath)
+	databases, err := upstream.NewRegistry(config.Databases)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("load databases: %w", err)
 	}
-	certPool.AppendCertsFromPEM(pems)
 
+	guard := lockout.New(config.Lockout, func(l lockout.Lockout) {
+		logger.Infow("locked out", "kind", l.Kind, "subject", l.Subject, "banned", l.Banned, "until", l.Until)
+		go pprof.Do(context.Background(), pprof.Labels("name", "on-lockout-event"), func(ctx context.Context) {
+			auditor.OnLockout(l)
+		})
+	})
+	auditor.Handle("/lockouts", guard)
+
+	settings := new(atomic.Pointer[authSettings])
+	settings.Store(newAuthSettings(config))
+
+	var (
+		userCAs        *userca.Authorities
+		authorizedKeys *authkeys.Keys
+		mfaSecrets     *mfa.Secrets
+	)
 	sshConfig := &ssh.ServerConfig{}
 	if config.NoClientAuth {
 		sshConfig.NoClientAuth = true
 	} else {
-		userCABytes, err := os.ReadFile(config.UserCAPath)
+		userCAs, err = userca.New(config.UserCAs, config.KRLPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read user CA bundle: %w", err)
+			return nil, fmt.Errorf("load user CAs: %w", err)
 		}
-		userCA, _, _, _, err := ssh.ParseAuthorizedKey(userCABytes)
+		authorizedKeys, err = authkeys.New(config.AuthorizedKeysPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse user CA bundle: %w", err)
+			return nil, fmt.Errorf("load authorized keys: %w", err)
 		}
-		sshConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if config.MFA.Enabled {
+			mfaSecrets, err = mfa.NewSecrets(config.MFA.SecretsPath)
+			if err != nil {
+				return nil, fmt.Errorf("load MFA secrets: %w", err)
+			}
+		}
+		verifyCertificate := func(conn ssh.ConnMetadata, cert *ssh.Certificate) ([]string, error) {
+			validAfter := time.Unix(int64(cert.ValidAfter), 0)
+			validBefore := time.Unix(int64(cert.ValidBefore), 0)
+			logger.Infow("tries to auth",
+				"key-id", cert.KeyId,
+				"valid-after", validAfter,
+				"valid-before", validBefore,
+			)
+			if until, locked := guard.Check(lockout.KindKeyID, cert.KeyId); locked {
+				return nil, fmt.Errorf("%w: key id %s until %s", ErrLockedOut, cert.KeyId, until.Format(time.RFC3339))
+			}
+			if validAfter.After(time.Now()) {
+				return nil, ErrCertificateNotYetValid
+			}
+			if validBefore.Before(time.Now()) {
+				return nil, ErrCertificateExpired
+			}
+			if len(cert.ValidPrincipals) == 0 {
+				return nil, ErrNoPrincipals
+			}
+			supported := settings.Load().supportedCriticalOptions
+			if err := wrapssh.CheckCriticalOptions(cert, conn.RemoteAddr(), supported); err != nil {
+				return nil, err
+			}
+			return userCAs.Verify(cert, wrapssh.EnforcedCriticalOptions(supported))
+		}
+		authenticate := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			remoteAddr := conn.RemoteAddr().String()
+			clientVersion := string(conn.ClientVersion())
 			switch cert := key.(type) {
 			case *ssh.Certificate:
+				principals, err := verifyCertificate(conn, cert)
+				reason := authFailureReason(err)
 				go pprof.Do(context.Background(), pprof.Labels("name", "on-auth-certificate-event"), func(ctx context.Context) {
-					auditor.OnAuthCertificate(cert)
+					auditor.OnAuthCertificate(cert, remoteAddr, clientVersion, reason, err)
 				})
-				validAfter := time.Unix(int64(cert.ValidAfter), 0)
-				validBefore := time.Unix(int64(cert.ValidBefore), 0)
-				logger.Infow("tries to auth",
-					"key-id", cert.KeyId,
-					"valid-after", validAfter,
-					"valid-before", validBefore,
-				)
-				if validAfter.After(time.Now()) {
-					return nil, fmt.Errorf("%w: certificate is not active", ErrAuthError)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", ErrAuthError, err)
 				}
-				if validBefore.Before(time.Now()) {
-					return nil, fmt.Errorf("%w: certificate has expired", ErrAuthError)
+				return wrapssh.NewPermissions(cert, principals), nil
+			default:
+				entry, err := authorizedKeys.Authenticate(key, conn.RemoteAddr(), time.Now())
+				if err == nil && userCAs.IsRevoked(key) {
+					err = userca.ErrRevoked
 				}
-				if subtle.ConstantTimeCompare(userCA.Marshal(), cert.SignatureKey.Marshal()) == 0 {
-					return nil, fmt.Errorf("%w: invalid signature", ErrAuthError)
+				var comment string
+				if entry != nil {
+					comment = entry.Comment
 				}
-				if len(cert.ValidPrincipals) == 0 {
-					return nil, fmt.Errorf("%w: no valid principals", ErrAuthError)
+				reason := authFailureReason(err)
+				go pprof.Do(context.Background(), pprof.Labels("name", "on-auth-public-key-event"), func(ctx context.Context) {
+					auditor.OnAuthPublicKey(key, comment, remoteAddr, clientVersion, reason, err)
+				})
+				if errors.Is(err, authkeys.ErrUnknownKey) {
+					return nil, fmt.Errorf("%w type: %T", ErrNonCertificateKey, key)
 				}
-				cert.Permissions.Extensions["users"] = strings.Join(cert.ValidPrincipals, ",")
-				return &cert.Permissions, nil
-			default:
-				return nil, fmt.Errorf("received non-certificate key type: %T", key)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", ErrAuthError, err)
+				}
+				logger.Infow("authenticated with public key", "fingerprint", ssh.FingerprintSHA256(key), "comment", entry.Comment)
+				return wrapssh.NewKeyPermissions(entry.Comment, entry.Principals, entry.Databases), nil
 			}
 		}
+		sshConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			permissions, err := authenticate(conn, key)
+			current := settings.Load()
+			if err != nil {
+				// Only certificates of trusted CAs count, so anyone cannot lock out
+				// a KeyId with self-signed certificates.
+				if cert, ok := key.(*ssh.Certificate); ok && !errors.Is(err, ErrLockedOut) && userCAs.Trusts(cert, wrapssh.EnforcedCriticalOptions(current.supportedCriticalOptions)) {
+					guard.Failure(lockout.KindKeyID, cert.KeyId)
+				}
+				return nil, err
+			}
+			if mfaSecrets == nil {
+				return permissions, nil
+			}
+			return requireMFA(mfaSecrets, current.mfaRequired, permissions, guard, auditor, logger)
+		}
 	}
-	privateKeyBytes, err := os.ReadFile(config.HostKeyPrivatePath)
-	if err != nil {
-		return nil, fmt.Errorf("read private host key: %w", err)
-	}
-	privateKey, err := ssh.ParsePrivateKey(privateKeyBytes)
-	if err != nil {
-		return nil, fmt.Errorf("parse private key: %w", err)
+	hostKeyTypes := make(map[string]string, len(config.HostKeys))
+	for _, hostKey := range config.HostKeys {
+		signer, err := wrapssh.LoadHostSigner(hostKey.PrivateKeyPath, hostKey.CertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("load host key: %w", err)
+		}
+		keyType := signer.PublicKey().Type()
+		if other, ok := hostKeyTypes[keyType]; ok {
+			return nil, fmt.Errorf("host keys %s and %s have the same type %s", other, hostKey.PrivateKeyPath, keyType)
+		}
+		hostKeyTypes[keyType] = hostKey.PrivateKeyPath
+		sshConfig.AddHostKey(signer)
 	}
-	sshConfig.AddHostKey(privateKey)
 
 	a, err := abac.New(*config.ABACRules.Load())
 	if err != nil {
@@ -126,13 +211,20 @@ func NewDatabaseProxy(config *config.Config, auditor *notifier.Notifier, logger
 	}
 
 	return &DatabaseProxy{
-		c:                  config,
-		sshConfig:          sshConfig,
-		logger:             logger,
-		notifier:           auditor,
-		abac:               a,
-		certIssuer:         certIssuer,
-		databaseCACertPool: certPool}, nil
+		c:              config,
+		sshConfig:      sshConfig,
+		logger:         logger,
+		notifier:       auditor,
+		abac:           a,
+		userCAs:        userCAs,
+		authorizedKeys: authorizedKeys,
+		mfaSecrets:     mfaSecrets,
+		lockout:        guard,
+		authSettings:   settings,
+		certIssuer:     certIssuer,
+		cancelKeys:     mitm.NewCancelKeys(),
+		databases:      databases,
+		roles:          rolemap.New(config.RoleMapping)}, nil
 }
 
 func (proxy *DatabaseProxy) Serve(ctx context.Context) error {
@@ -183,6 +275,11 @@ func (proxy *DatabaseProxy) acceptConnections(ctx context.Context, listener net.
 			if err != nil || ctx.Err() != nil {
 				break
 			}
+			if until, locked := proxy.lockout.Check(lockout.KindIP, remoteIP(conn.RemoteAddr())); locked {
+				proxy.logger.Infow("rejected locked out connection", "remote-addr", conn.RemoteAddr().String(), "until", until)
+				conn.Close()
+				continue
+			}
 			id := uuid.New().String()
 			proxy.logger.Infow("accepted connection", "id", id)
 			connWithMetadata := ConnWithMetadata{
@@ -237,40 +334,76 @@ func (proxy *DatabaseProxy) observeConnection(connWithMetadata *ConnWithMetadata
 }
 
 func (proxy *DatabaseProxy) handleConnection(ctx context.Context, conn ConnWithMetadata) error {
+	ip := remoteIP(conn.Conn.RemoteAddr())
 	sConn, newChans, reqs, err := ssh.NewServerConn(conn.Conn, proxy.sshConfig)
 	if err != nil {
+		if isAuthFailure(err) {
+			proxy.lockout.Failure(lockout.KindIP, ip)
+		}
 		return fmt.Errorf("handshake failed: %w", err)
 	}
+	proxy.lockout.Success(lockout.KindIP, ip)
+	if wrapssh.AuthMethod(sConn.Permissions) == wrapssh.AuthMethodCertificate {
+		proxy.lockout.Success(lockout.KindKeyID, sConn.Permissions.Extensions[wrapssh.KeyIDExtension])
+	}
+	var c *connection
 	defer func() {
 		proxy.logger.Infow("closed connection", "id", conn.Metadata.ConnectionID)
+		var reason error
+		if c != nil {
+			reason = c.terminationReason()
+		}
 		go pprof.Do(ctx, pprof.Labels("name", "on-closed-connection-event"), func(ctx context.Context) {
 			err := sConn.Close()
 			if strings.Contains(err.Error(), "use of closed network connection") {
 				err = nil
 			}
-			proxy.notifier.OnConnectionClosed(err, conn.Metadata)
+			proxy.notifier.OnConnectionClosed(err, reason, conn.Metadata)
 			proxy.abac.DeleteState(conn.Metadata.StateID)
 		})
 	}()
 
-	databaseUsersString, ok := sConn.Permissions.Extensions["users"]
+	conn.Metadata.AuthMethod = wrapssh.AuthMethod(sConn.Permissions)
+	conn.Metadata.MFA = sConn.Permissions.Extensions[wrapssh.MFAExtension] != ""
+	databaseUsersString, ok := sConn.Permissions.Extensions[wrapssh.UsersExtension]
 	if !ok {
 		return fmt.Errorf("missing user permissions")
 	}
 	databaseUsers := strings.Split(databaseUsersString, ",")
+	var groups []string
+	if groupsExtension := proxy.roles.GroupsExtension(); groupsExtension != "" {
+		if groupsString := wrapssh.CertExtensions(sConn.Permissions)[groupsExtension]; groupsString != "" {
+			groups = strings.Split(groupsString, ",")
+		}
+	}
+	grants := proxy.roles.Resolve(databaseUsers, groups)
 	go pprof.Do(ctx, pprof.Labels("name", "on-database-users-event"), func(ctx context.Context) {
-		proxy.notifier.OnDatabaseUsers(databaseUsers, conn.Metadata)
+		proxy.notifier.OnDatabaseUsers(databaseUsers, groups, grants, conn.Metadata)
 	})
 
 	go ssh.DiscardRequests(reqs)
 
+	c = newConnection(sConn, conn.Metadata, databaseUsers, groups, grants, conn.Conn.LocalAddr(), conn.Conn.RemoteAddr())
+	timeouts := proxy.c.Timeouts
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go pprof.Do(watchCtx, pprof.Labels("name", "watch-connection"), func(ctx context.Context) {
+		proxy.watchConnection(ctx, c, timeouts)
+	})
+	go pprof.Do(watchCtx, pprof.Labels("name", "watch-certificate-expiry"), func(ctx context.Context) {
+		proxy.watchCertificateExpiry(ctx, c, timeouts)
+	})
+	go pprof.Do(watchCtx, pprof.Labels("name", "keepalive"), func(ctx context.Context) {
+		proxy.keepalive(ctx, c, timeouts)
+	})
+
 	var wg sync.WaitGroup
 	for newChan := range newChans {
 		newChan := newChan
 		wg.Add(1)
 		go pprof.Do(ctx, pprof.Labels("name", "handle-new-channel"), func(ctx context.Context) {
 			defer wg.Done()
-			err := proxy.handleChannel(ctx, conn.Metadata, databaseUsers, newChan, conn.Conn.LocalAddr(), conn.Conn.RemoteAddr())
+			err := proxy.handleChannel(ctx, c, newChan, timeouts)
 			if err != nil {
 				if errors.Is(err, mitm.ErrDisconnectUser) {
 					if err := conn.Conn.Close(); err != nil {
@@ -286,22 +419,82 @@ func (proxy *DatabaseProxy) handleConnection(ctx context.Context, conn ConnWithM
 	return nil
 }
 
-func (proxy *DatabaseProxy) handleChannel(ctx context.Context, metadata metadata.Metadata, databaseUsers []string, newChan ssh.NewChannel, localAddr, remoteAddr net.Addr) error {
-	if newChan.ChannelType() != "direct-tcpip" {
+func (proxy *DatabaseProxy) handleChannel(ctx context.Context, conn *connection, newChan ssh.NewChannel, timeouts config.Timeouts) error {
+	if newChan.ChannelType() == sessionChannelType && proxy.c.Session.Enabled {
+		return proxy.handleSession(ctx, conn, newChan)
+	}
+	channelType := newChan.ChannelType()
+	if channelType != wrapssh.DirectTCPIPChannelType && channelType != wrapssh.DirectStreamLocalChannelType {
 		if err := newChan.Reject(ssh.UnknownChannelType, "unsupported channel type"); err != nil {
 			return fmt.Errorf("reject channel: %w", err)
 		}
 		return nil
 	}
 	requestID := uuid.New().String()
+	metadata := conn.metadata
 	metadata.RequestID = requestID
-	proxy.logger.Infow("accepted new request", "id", requestID)
+	proxy.logger.Infow("accepted new request", "id", requestID, "type", channelType)
 	defer func() {
 		proxy.logger.Infow("finished request", "id", requestID)
 	}()
-	go pprof.Do(ctx, pprof.Labels("name", "on-direct-tcpip-request-event"), func(ctx context.Context) {
-		proxy.notifier.OnDirectTCPIPRequest(metadata)
-	})
+
+	var (
+		database       *upstream.Database
+		target         string
+		notifyRejected func(reason error)
+		err            error
+	)
+	if channelType == wrapssh.DirectTCPIPChannelType {
+		go pprof.Do(ctx, pprof.Labels("name", "on-direct-tcpip-request-event"), func(ctx context.Context) {
+			proxy.notifier.OnDirectTCPIPRequest(metadata)
+		})
+		var p wrapssh.DirectTCPIPPayload
+		if err := ssh.Unmarshal(newChan.ExtraData(), &p); err != nil {
+			if err := newChan.Reject(ssh.ConnectionFailed, "invalid payload"); err != nil {
+				return fmt.Errorf("reject channel: %w", err)
+			}
+			return fmt.Errorf("unmarshal payload: %w", err)
+		}
+		database, err = proxy.databases.Lookup(p.HostToConnect, p.PortToConnect)
+		target = net.JoinHostPort(p.HostToConnect, strconv.FormatUint(uint64(p.PortToConnect), 10))
+		notifyRejected = func(reason error) {
+			proxy.notifier.OnDirectTCPIPRejected(p.HostToConnect, p.PortToConnect, reason, metadata)
+		}
+	} else {
+		var p wrapssh.DirectStreamLocalPayload
+		if err := ssh.Unmarshal(newChan.ExtraData(), &p); err != nil {
+			if err := newChan.Reject(ssh.ConnectionFailed, "invalid payload"); err != nil {
+				return fmt.Errorf("reject channel: %w", err)
+			}
+			return fmt.Errorf("unmarshal payload: %w", err)
+		}
+		go pprof.Do(ctx, pprof.Labels("name", "on-direct-streamlocal-request-event"), func(ctx context.Context) {
+			proxy.notifier.OnDirectStreamLocalRequest(p.SocketPath, metadata)
+		})
+		database, err = proxy.databases.LookupSocket(p.SocketPath)
+		target = p.SocketPath
+		notifyRejected = func(reason error) {
+			proxy.notifier.OnDirectStreamLocalRejected(p.SocketPath, reason, metadata)
+		}
+	}
+
+	if err == nil && !database.Permits(conn.principals) {
+		err = fmt.Errorf("%w: %s", upstream.ErrForbiddenPrincipals, database.Name)
+	}
+	if err == nil && !conn.allowsDatabase(database.Name) {
+		err = fmt.Errorf("%w: %s", ErrForbiddenDatabase, database.Name)
+	}
+	if err != nil {
+		go pprof.Do(ctx, pprof.Labels("name", "on-channel-rejected-event"), func(ctx context.Context) {
+			notifyRejected(err)
+		})
+		if err := newChan.Reject(ssh.Prohibited, "target is not allowed"); err != nil {
+			return fmt.Errorf("reject channel: %w", err)
+		}
+		proxy.logger.Infow("rejected request", "id", requestID, "target", target, "err", err)
+		return nil
+	}
+	metadata.Upstream = database.Name
 
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
@@ -309,18 +502,18 @@ func (proxy *DatabaseProxy) handleChannel(ctx context.Context, metadata metadata
 	}
 	defer ch.Close()
 
-	var p wrapssh.DirectTCPIPPayload
-	data := newChan.ExtraData()
-	if err := ssh.Unmarshal(data, &p); err != nil {
-		return fmt.Errorf("unmarshal payload: %w", err)
-	}
-
 	go ssh.DiscardRequests(reqs)
 
-	m, err := mitm.NewMITM(metadata, databaseUsers, buffered.NewConn(ch, localAddr, remoteAddr), p.HostToConnect, p.PortToConnect, proxy.certIssuer, proxy.databaseCACertPool, proxy.notifier, proxy.abac, proxy.logger.With("name", "mitm", "connection-id", metadata.ConnectionID, "request-id", metadata.RequestID))
+	mitmTimeouts := mitm.Timeouts{Idle: timeouts.RequestIdle, IdleInTransaction: timeouts.IdleInTransaction}
+	clientTLS := mitm.ClientTLS{Enabled: proxy.c.MITM.ClientTLS.Enabled, ServerNames: proxy.c.MITM.ClientTLS.ServerNames}
+	m, err := mitm.NewMITM(metadata, conn.grants, conn.attributes, buffered.NewConn(ch, conn.localAddr, conn.remoteAddr), database, proxy.cancelKeys, proxy.certIssuer, clientTLS, proxy.notifier, proxy.abac, mitmTimeouts, proxy.logger.With("name", "mitm", "connection-id", metadata.ConnectionID, "request-id", metadata.RequestID))
 	if err != nil {
 		return fmt.Errorf("create MITM: %w", err)
 	}
+	if !conn.addSession(requestID, m) {
+		return nil
+	}
+	defer conn.removeSession(requestID)
 
 	return m.Proxy(ctx)
 }
@@ -336,9 +529,18 @@ func (proxy *DatabaseProxy) hotReloadConfig(ctx context.Context, conf *config.Co
 				if !errors.Is(err, config.ErrConfigNotChanged) {
 					logger.Errorf("hot reload config from file %s: %s", conf.ConfigPath, err)
 				}
+				proxy.reloadCredentials(conf, logger)
 				continue
 			}
 			conf = newConfig
+			proxy.reloadCredentials(conf, logger)
+			if err := proxy.databases.Update(conf.Databases); err != nil {
+				logger.Errorf("update databases: %s", err)
+				continue
+			}
+			proxy.roles.Update(conf.RoleMapping)
+			proxy.lockout.Update(conf.Lockout)
+			proxy.authSettings.Store(newAuthSettings(conf))
 			if err := proxy.abac.Update(*conf.ABACRules.Load()); err != nil {
 				logger.Errorf("update ABAC: %s", err)
 				continue
@@ -348,3 +550,44 @@ func (proxy *DatabaseProxy) hotReloadConfig(ctx context.Context, conf *config.Co
 		}
 	}
 }
+
+func (proxy *DatabaseProxy) reloadCredentials(conf *config.Config, logger *zap.SugaredLogger) {
+	if proxy.userCAs != nil {
+		if err := proxy.userCAs.Update(conf.UserCAs, conf.KRLPath); err != nil {
+			if !errors.Is(err, userca.ErrNotChanged) {
+				logger.Errorf("reload user CAs: %s", err)
+			}
+		} else {
+			logger.Infof("reloaded user CAs and KRL")
+		}
+	}
+	if proxy.authorizedKeys != nil {
+		if err := proxy.authorizedKeys.Update(conf.AuthorizedKeysPath); err != nil {
+			if !errors.Is(err, authkeys.ErrNotChanged) {
+				logger.Errorf("reload authorized keys: %s", err)
+			}
+		} else {
+			logger.Infof("reloaded authorized keys")
+		}
+	}
+	if proxy.mfaSecrets != nil {
+		if err := proxy.mfaSecrets.Update(conf.MFA.SecretsPath); err != nil {
+			if !errors.Is(err, mfa.ErrNotChanged) {
+				logger.Errorf("reload MFA secrets: %s", err)
+			}
+		} else {
+			logger.Infof("reloaded MFA secrets")
+		}
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
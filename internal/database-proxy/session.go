@@ -0,0 +1,215 @@
+package database_proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/rolemap"
+	wrapssh "ssh-db-proxy/internal/ssh"
+)
+
+const (
+	sessionChannelType  = "session"
+	defaultPostgresPort = 5432
+
+	defaultSessionBanner = "ssh-db-proxy: this server only forwards connections to PostgreSQL databases."
+)
+
+// sessionInfo is what an interactive session shows to the user.
+type sessionInfo struct {
+	Banner       string
+	User         string
+	KeyID        string
+	Principals   []string
+	Groups       []string
+	ProxyHost    string
+	ProxyPort    string
+	Databases    []sessionDatabase
+	TerminalMode bool
+}
+
+// sessionDatabase is a database reachable by the user. Port is zero if the
+// database is reached through a Unix socket at Target.
+type sessionDatabase struct {
+	Name   string
+	Target string
+	Port   uint32
+	Roles  []string
+}
+
+// handleSession serves a read-only session channel: on shell or exec request
+// it prints the identity of the user and the databases they may reach, then
+// exits.
+func (proxy *DatabaseProxy) handleSession(ctx context.Context, conn *connection, newChan ssh.NewChannel) error {
+	metadata := conn.metadata
+	metadata.RequestID = uuid.New().String()
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return fmt.Errorf("accept channel: %w", err)
+	}
+	defer ch.Close()
+
+	var terminalMode bool
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			terminalMode = true
+			if err := req.Reply(true, nil); err != nil {
+				return fmt.Errorf("reply to %s request: %w", req.Type, err)
+			}
+		case "env", "window-change":
+			if err := req.Reply(true, nil); err != nil {
+				return fmt.Errorf("reply to %s request: %w", req.Type, err)
+			}
+		case "shell", "exec":
+			if err := req.Reply(true, nil); err != nil {
+				return fmt.Errorf("reply to %s request: %w", req.Type, err)
+			}
+			requestType := req.Type
+			go pprof.Do(ctx, pprof.Labels("name", "on-session-request-event"), func(ctx context.Context) {
+				proxy.notifier.OnSessionRequest(requestType, metadata)
+			})
+			info := proxy.sessionInfo(conn)
+			info.TerminalMode = terminalMode
+			if err := renderSessionInfo(ch, info); err != nil {
+				return fmt.Errorf("write session info: %w", err)
+			}
+			exitStatus := struct{ Status uint32 }{0}
+			if _, err := ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatus)); err != nil {
+				return fmt.Errorf("send exit status: %w", err)
+			}
+			return nil
+		default:
+			if err := req.Reply(false, nil); err != nil {
+				return fmt.Errorf("reply to %s request: %w", req.Type, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (proxy *DatabaseProxy) sessionInfo(conn *connection) sessionInfo {
+	banner := proxy.c.Session.Banner
+	if banner == "" {
+		banner = defaultSessionBanner
+	}
+	proxyHost, proxyPort, _ := net.SplitHostPort(conn.localAddr.String())
+	if publicAddress := proxy.c.Session.PublicAddress; publicAddress != "" {
+		if host, port, err := net.SplitHostPort(publicAddress); err == nil {
+			proxyHost, proxyPort = host, port
+		} else {
+			proxyHost = publicAddress
+		}
+	}
+
+	info := sessionInfo{
+		Banner:     banner,
+		User:       conn.sConn.User(),
+		KeyID:      conn.sConn.Permissions.Extensions[wrapssh.KeyIDExtension],
+		Principals: conn.principals,
+		Groups:     conn.groups,
+		ProxyHost:  proxyHost,
+		ProxyPort:  proxyPort,
+	}
+	for _, database := range proxy.databases.List() {
+		if !database.Permits(conn.principals) || !conn.allowsDatabase(database.Name) {
+			continue
+		}
+		roles := conn.grants.Roles(database.Name)
+		if len(roles) == 0 {
+			continue
+		}
+		target, port := database.Host, database.Port
+		if database.Socket != "" {
+			target, port = database.Socket, 0
+		}
+		if database.Alias != "" {
+			target = database.Alias
+			if port == 0 {
+				port = defaultPostgresPort
+			}
+		}
+		info.Databases = append(info.Databases, sessionDatabase{
+			Name:   database.Name,
+			Target: target,
+			Port:   port,
+			Roles:  roles,
+		})
+	}
+	return info
+}
+
+// renderSessionInfo writes the session info with ready-to-paste ssh and psql
+// commands. Databases sharing a port get distinct local ports.
+func renderSessionInfo(w io.Writer, info sessionInfo) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", strings.TrimRight(info.Banner, "\n"))
+	fmt.Fprintf(&b, "User:       %s\n", info.User)
+	if info.KeyID != "" {
+		fmt.Fprintf(&b, "Key ID:     %s\n", info.KeyID)
+	}
+	fmt.Fprintf(&b, "Principals: %s\n", strings.Join(info.Principals, ", "))
+	if len(info.Groups) > 0 {
+		fmt.Fprintf(&b, "Groups:     %s\n", strings.Join(info.Groups, ", "))
+	}
+	b.WriteString("\n")
+
+	if len(info.Databases) == 0 {
+		b.WriteString("No databases are available.\n")
+	} else {
+		b.WriteString("Databases:\n")
+	}
+	usedPorts := make(map[uint32]bool, len(info.Databases))
+	for _, database := range info.Databases {
+		localPort := database.Port
+		if localPort == 0 {
+			localPort = defaultPostgresPort
+		}
+		for usedPorts[localPort] {
+			localPort++
+		}
+		usedPorts[localPort] = true
+
+		roles := make([]string, 0, len(database.Roles))
+		username := "<role>"
+		for _, role := range database.Roles {
+			literal, ok := rolemap.Literal(role)
+			if !ok {
+				roles = append(roles, role)
+				continue
+			}
+			roles = append(roles, literal)
+			if username == "<role>" {
+				username = literal
+			}
+		}
+
+		fmt.Fprintf(&b, "\n  %s\n", database.Name)
+		fmt.Fprintf(&b, "    roles: %s\n", strings.Join(roles, ", "))
+		forward := fmt.Sprintf("localhost:%d:%s", localPort, database.Target)
+		if database.Port != 0 {
+			forward = fmt.Sprintf("%s:%d", forward, database.Port)
+		}
+		fmt.Fprintf(&b, "    ssh -N -L %s %s@%s", forward, info.User, info.ProxyHost)
+		if info.ProxyPort != "" {
+			fmt.Fprintf(&b, " -p %s", info.ProxyPort)
+		}
+		b.WriteString("\n")
+		fmt.Fprintf(&b, "    psql --username %s --host localhost --port %d --dbname <db-name>\n", username, localPort)
+	}
+
+	text := b.String()
+	if info.TerminalMode {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
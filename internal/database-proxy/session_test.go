@@ -0,0 +1,62 @@
+package database_proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderSessionInfo(t *testing.T) {
+	info := sessionInfo{
+		Banner:     "Welcome",
+		User:       "alice",
+		KeyID:      "alice@example.com",
+		Principals: []string{"alice", "dba"},
+		ProxyHost:  "proxy.example.com",
+		ProxyPort:  "8080",
+		Databases: []sessionDatabase{
+			{Name: "billing", Target: "billing", Port: 5432, Roles: []string{"app_*", "analyst"}},
+			{Name: "local", Target: "/var/run/postgresql/.s.PGSQL.5432", Roles: []string{"postgres"}},
+			{Name: "orders", Target: "orders.db.internal", Port: 5432, Roles: []string{`app\*`}},
+		},
+	}
+
+	t.Run("databases", func(t *testing.T) {
+		var b strings.Builder
+		require.NoError(t, renderSessionInfo(&b, info))
+		require.Equal(t, `Welcome
+
+User:       alice
+Key ID:     alice@example.com
+Principals: alice, dba
+
+Databases:
+
+  billing
+    roles: app_*, analyst
+    ssh -N -L localhost:5432:billing:5432 alice@proxy.example.com -p 8080
+    psql --username analyst --host localhost --port 5432 --dbname <db-name>
+
+  local
+    roles: postgres
+    ssh -N -L localhost:5433:/var/run/postgresql/.s.PGSQL.5432 alice@proxy.example.com -p 8080
+    psql --username postgres --host localhost --port 5433 --dbname <db-name>
+
+  orders
+    roles: app*
+    ssh -N -L localhost:5434:orders.db.internal:5432 alice@proxy.example.com -p 8080
+    psql --username app* --host localhost --port 5434 --dbname <db-name>
+`, b.String())
+	})
+
+	t.Run("no-databases", func(t *testing.T) {
+		info := info
+		info.Databases = nil
+		info.TerminalMode = true
+		var b strings.Builder
+		require.NoError(t, renderSessionInfo(&b, info))
+		require.True(t, strings.HasSuffix(b.String(), "\r\nNo databases are available.\r\n"))
+		require.NotContains(t, strings.ReplaceAll(b.String(), "\r\n", ""), "\n")
+	})
+}
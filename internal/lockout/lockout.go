@@ -0,0 +1,231 @@
+package lockout
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"ssh-db-proxy/internal/config"
+)
+
+const (
+	KindIP    = "ip"
+	KindKeyID = "key-id"
+
+	defaultFailureWindow = 15 * time.Minute
+	pruneInterval        = time.Minute
+	maxDoublings         = 32
+)
+
+// Lockout is the state of a subject that is temporarily not allowed to
+// authenticate.
+type Lockout struct {
+	Kind     string    `json:"kind"`
+	Subject  string    `json:"subject"`
+	Failures int       `json:"failures"`
+	Bans     int       `json:"bans"`
+	Banned   bool      `json:"banned"`
+	Until    time.Time `json:"until"`
+}
+
+type subject struct {
+	kind string
+	name string
+}
+
+type entry struct {
+	failures    int
+	bans        int
+	banned      bool
+	lastFailure time.Time
+	until       time.Time
+}
+
+// Guard counts authentication failures per client IP and per certificate
+// KeyId. Every failure locks the subject out for an exponentially growing
+// backoff, and MaxFailures failures in a row ban it for BanDuration, doubled
+// for every subsequent ban.
+type Guard struct {
+	mu        sync.Mutex
+	config    config.Lockout
+	entries   map[subject]*entry
+	lastPrune time.Time
+	onLockout func(Lockout)
+	now       func() time.Time
+}
+
+// New creates a guard. onLockout is called without the lock held every time a
+// subject gets locked out, both for a backoff and for a ban.
+func New(config config.Lockout, onLockout func(Lockout)) *Guard {
+	return &Guard{
+		config:    config,
+		entries:   make(map[subject]*entry),
+		onLockout: onLockout,
+		now:       time.Now,
+	}
+}
+
+func (g *Guard) Update(config config.Lockout) {
+	g.mu.Lock()
+	g.config = config
+	if !config.Enabled {
+		g.entries = make(map[subject]*entry)
+	}
+	g.mu.Unlock()
+}
+
+// Check returns the time the subject is locked out until. It returns false if
+// the subject may authenticate.
+func (g *Guard) Check(kind, name string) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.config.Enabled {
+		return time.Time{}, false
+	}
+	e, ok := g.entries[subject{kind, name}]
+	if !ok || !g.now().Before(e.until) {
+		return time.Time{}, false
+	}
+	return e.until, true
+}
+
+// Failure records a failed authentication of the subject.
+func (g *Guard) Failure(kind, name string) {
+	g.mu.Lock()
+	if !g.config.Enabled {
+		g.mu.Unlock()
+		return
+	}
+	now := g.now()
+	g.prune(now)
+
+	key := subject{kind, name}
+	e, ok := g.entries[key]
+	if !ok {
+		e = &entry{}
+		g.entries[key] = e
+	}
+	if now.Sub(e.lastFailure) > g.failureWindow() {
+		e.failures = 0
+	}
+	e.failures++
+	e.lastFailure = now
+	e.banned = false
+
+	if g.config.MaxFailures > 0 && e.failures >= g.config.MaxFailures {
+		e.until = now.Add(exponential(g.config.BanDuration, e.bans, g.config.MaxBanDuration))
+		e.banned = true
+		e.bans++
+		e.failures = 0
+	} else {
+		e.until = now.Add(exponential(g.config.BaseBackoff, e.failures-1, g.config.MaxBackoff))
+	}
+	lockout := e.lockout(key)
+	g.mu.Unlock()
+
+	if g.onLockout != nil {
+		g.onLockout(lockout)
+	}
+}
+
+// Success resets the failure counter of the subject after a successful
+// authentication. Previous bans are still taken into account.
+func (g *Guard) Success(kind, name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := subject{kind, name}
+	e, ok := g.entries[key]
+	if !ok {
+		return
+	}
+	if e.bans == 0 {
+		delete(g.entries, key)
+		return
+	}
+	e.failures = 0
+	e.until = time.Time{}
+	e.banned = false
+}
+
+// Lockouts returns the subjects that are locked out now.
+func (g *Guard) Lockouts() []Lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	lockouts := make([]Lockout, 0)
+	for key, e := range g.entries {
+		if now.Before(e.until) {
+			lockouts = append(lockouts, e.lockout(key))
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].Kind != lockouts[j].Kind {
+			return lockouts[i].Kind < lockouts[j].Kind
+		}
+		return lockouts[i].Subject < lockouts[j].Subject
+	})
+	return lockouts
+}
+
+// ServeHTTP lists the current lockouts as JSON.
+func (g *Guard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.Marshal(g.Lockouts())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// prune forgets subjects that are not locked out and whose failures are
+// outside of the failure window.
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < pruneInterval {
+		return
+	}
+	g.lastPrune = now
+	for key, e := range g.entries {
+		if now.Before(e.until) {
+			continue
+		}
+		if now.Sub(e.lastFailure) > g.failureWindow() {
+			delete(g.entries, key)
+		}
+	}
+}
+
+func (g *Guard) failureWindow() time.Duration {
+	if g.config.FailureWindow > 0 {
+		return g.config.FailureWindow
+	}
+	return defaultFailureWindow
+}
+
+func (e *entry) lockout(key subject) Lockout {
+	return Lockout{
+		Kind:     key.kind,
+		Subject:  key.name,
+		Failures: e.failures,
+		Bans:     e.bans,
+		Banned:   e.banned,
+		Until:    e.until,
+	}
+}
+
+func exponential(base time.Duration, exponent int, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < exponent && i < maxDoublings && (max <= 0 || d < max); i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
@@ -0,0 +1,105 @@
+package lockout
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/config"
+)
+
+func TestGuard(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var lockouts []Lockout
+	guard := New(config.Lockout{
+		Enabled:        true,
+		MaxFailures:    3,
+		FailureWindow:  time.Hour,
+		BaseBackoff:    time.Second,
+		MaxBackoff:     time.Minute,
+		BanDuration:    10 * time.Minute,
+		MaxBanDuration: 15 * time.Minute,
+	}, func(lockout Lockout) {
+		lockouts = append(lockouts, lockout)
+	})
+	guard.now = func() time.Time { return now }
+
+	t.Run("backoff", func(t *testing.T) {
+		_, locked := guard.Check(KindIP, "10.0.0.1")
+		require.False(t, locked)
+
+		guard.Failure(KindIP, "10.0.0.1")
+		until, locked := guard.Check(KindIP, "10.0.0.1")
+		require.True(t, locked)
+		require.Equal(t, now.Add(time.Second), until)
+		require.Equal(t, []Lockout{{Kind: KindIP, Subject: "10.0.0.1", Failures: 1, Until: until}}, lockouts)
+
+		guard.Failure(KindIP, "10.0.0.1")
+		until, _ = guard.Check(KindIP, "10.0.0.1")
+		require.Equal(t, now.Add(2*time.Second), until)
+		require.Len(t, lockouts, 2)
+
+		_, locked = guard.Check(KindKeyID, "10.0.0.1")
+		require.False(t, locked)
+
+		now = now.Add(3 * time.Second)
+		_, locked = guard.Check(KindIP, "10.0.0.1")
+		require.False(t, locked)
+	})
+
+	t.Run("ban", func(t *testing.T) {
+		guard.Failure(KindIP, "10.0.0.1")
+		until, locked := guard.Check(KindIP, "10.0.0.1")
+		require.True(t, locked)
+		require.Equal(t, now.Add(10*time.Minute), until)
+		require.Len(t, lockouts, 3)
+		require.Equal(t, Lockout{Kind: KindIP, Subject: "10.0.0.1", Bans: 1, Banned: true, Until: until}, lockouts[2])
+
+		now = now.Add(11 * time.Minute)
+		for range 3 {
+			guard.Failure(KindIP, "10.0.0.1")
+		}
+		until, _ = guard.Check(KindIP, "10.0.0.1")
+		require.Equal(t, now.Add(15*time.Minute), until)
+		require.Len(t, lockouts, 6)
+		require.True(t, lockouts[5].Banned)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		guard.Failure(KindKeyID, "alice")
+		guard.Success(KindKeyID, "alice")
+		_, locked := guard.Check(KindKeyID, "alice")
+		require.False(t, locked)
+
+		guard.Failure(KindKeyID, "alice")
+		now = now.Add(2 * time.Hour)
+		guard.Failure(KindKeyID, "alice")
+		until, _ := guard.Check(KindKeyID, "alice")
+		require.Equal(t, now.Add(time.Second), until)
+	})
+
+	t.Run("api", func(t *testing.T) {
+		guard.Failure(KindIP, "10.0.0.2")
+		recorder := httptest.NewRecorder()
+		guard.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/lockouts", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var lockouts []Lockout
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &lockouts))
+		require.Len(t, lockouts, 2)
+		require.Equal(t, "10.0.0.2", lockouts[0].Subject)
+		require.Equal(t, "alice", lockouts[1].Subject)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		guard.Update(config.Lockout{})
+		_, locked := guard.Check(KindIP, "10.0.0.2")
+		require.False(t, locked)
+		guard.Failure(KindIP, "10.0.0.2")
+		require.Empty(t, guard.Lockouts())
+	})
+}
@@ -5,9 +5,17 @@ type Metadata struct {
 	RequestID        string           `json:"request_id"`
 	StateID          string           `json:"state_id"`
 	RemoteAddr       string           `json:"remote_addr"`
+	AuthMethod       string           `json:"auth_method"`
+	MFA              bool             `json:"mfa"`
+	ReadOnly         bool             `json:"read_only,omitempty"`
+	Upstream         string           `json:"upstream"`
+	UpstreamAuth     string           `json:"upstream_auth"`
+	ClientTLS        *TLS             `json:"client_tls,omitempty"`
 	DatabaseName     string           `json:"database_name"`
 	DatabaseUsername string           `json:"database_username"`
+	QueryID          string           `json:"query_id,omitempty"`
 	Query            string           `json:"query"`
+	RewrittenQuery   string           `json:"rewritten_query,omitempty"`
 	QueryStatements  []QueryStatement `json:"query_statements"`
 }
 
@@ -19,6 +27,12 @@ func (m *Metadata) Copy() Metadata {
 		RequestID:        m.RequestID,
 		StateID:          m.StateID,
 		RemoteAddr:       m.RemoteAddr,
+		AuthMethod:       m.AuthMethod,
+		MFA:              m.MFA,
+		ReadOnly:         m.ReadOnly,
+		Upstream:         m.Upstream,
+		UpstreamAuth:     m.UpstreamAuth,
+		ClientTLS:        m.ClientTLS,
 		DatabaseName:     m.DatabaseName,
 		DatabaseUsername: m.DatabaseUsername,
 		QueryStatements:  queryStatements,
@@ -30,3 +44,28 @@ type QueryStatement struct {
 	Table         string `json:"table"`
 	Column        string `json:"column"`
 }
+
+// TLS describes the TLS connection negotiated with the PostgreSQL client.
+type TLS struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipher_suite"`
+	ServerName         string `json:"server_name,omitempty"`
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+	Certificate        string `json:"certificate"`
+}
+
+// Parameter is a bind parameter of an executed statement. Value is nil for NULL.
+type Parameter struct {
+	OID       uint32  `json:"oid"`
+	Format    string  `json:"format"`
+	Value     *string `json:"value"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+// MaskedColumn is a result column masked by an ABAC rule.
+type MaskedColumn struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Style  string `json:"style"`
+	Rule   string `json:"rule,omitempty"`
+}
@@ -0,0 +1,71 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors of RFC 6238 truncated to six digits.
+	key := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		require.Equal(t, code, GenerateCode(key, Counter(time.Unix(unix, 0))))
+	}
+
+	decoded, err := DecodeSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	require.NoError(t, err)
+	require.Equal(t, key, decoded)
+	_, err = DecodeSecret("not base32!")
+	require.Error(t, err)
+}
+
+func TestSecrets(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secretsPath := filepath.Join(t.TempDir(), "mfa.yaml")
+	require.NoError(t, os.WriteFile(secretsPath, []byte(
+		"alice@example.com: "+base32.StdEncoding.EncodeToString(key)+"\n",
+	), 0o600))
+
+	secrets, err := NewSecrets(secretsPath)
+	require.NoError(t, err)
+	now := time.Unix(1111111109, 0)
+
+	t.Run("lookup", func(t *testing.T) {
+		name, ok := secrets.Lookup("bob", "alice@example.com")
+		require.True(t, ok)
+		require.Equal(t, "alice@example.com", name)
+		_, ok = secrets.Lookup("bob")
+		require.False(t, ok)
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		require.ErrorIs(t, secrets.Verify("alice@example.com", "000000", now), ErrInvalidCode)
+		require.ErrorIs(t, secrets.Verify("bob", "081804", now), ErrNoSecret)
+
+		previous := GenerateCode(key, Counter(now)-1)
+		require.NoError(t, secrets.Verify("alice@example.com", previous, now))
+		require.NoError(t, secrets.Verify("alice@example.com", "081804", now))
+		require.ErrorIs(t, secrets.Verify("alice@example.com", "081804", now), ErrCodeReplayed)
+		require.ErrorIs(t, secrets.Verify("alice@example.com", previous, now), ErrCodeReplayed)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		require.ErrorIs(t, secrets.Update(secretsPath), ErrNotChanged)
+		require.NoError(t, secrets.Update(""))
+		_, ok := secrets.Lookup("alice@example.com")
+		require.False(t, ok)
+
+		require.NoError(t, os.WriteFile(secretsPath, []byte("alice: '%%%'\n"), 0o600))
+		require.Error(t, secrets.Update(secretsPath))
+	})
+}
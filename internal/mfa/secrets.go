@@ -0,0 +1,104 @@
+package mfa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrNotChanged   = errors.New("MFA secrets not changed")
+	ErrNoSecret     = errors.New("no TOTP secret")
+	ErrInvalidCode  = errors.New("invalid TOTP code")
+	ErrCodeReplayed = errors.New("TOTP code was already used")
+)
+
+// Secrets holds TOTP secrets keyed by certificate KeyId or principal.
+type Secrets struct {
+	mu       sync.Mutex
+	keys     map[string][]byte
+	used     map[string]uint64
+	checksum []byte
+}
+
+func NewSecrets(path string) (*Secrets, error) {
+	s := &Secrets{used: make(map[string]uint64)}
+	if err := s.Update(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update rereads the secrets file, a YAML map of names to base32 secrets. An
+// empty path removes all secrets. It returns ErrNotChanged if the file has not
+// changed.
+func (s *Secrets) Update(path string) error {
+	var data []byte
+	keys := make(map[string][]byte)
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read MFA secrets %s: %w", path, err)
+		}
+		var secrets map[string]string
+		if err := yaml.Unmarshal(data, &secrets); err != nil {
+			return fmt.Errorf("unmarshal MFA secrets %s: %w", path, err)
+		}
+		for name, secret := range secrets {
+			key, err := DecodeSecret(secret)
+			if err != nil {
+				return fmt.Errorf("MFA secret of %s: %w", name, err)
+			}
+			keys[name] = key
+		}
+	}
+	checksum := sha256.Sum256(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.checksum != nil && bytes.Equal(s.checksum, checksum[:]) {
+		return ErrNotChanged
+	}
+	s.keys = keys
+	s.checksum = checksum[:]
+	return nil
+}
+
+// Lookup returns the first of the names that has a secret.
+func (s *Secrets) Lookup(names ...string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if _, ok := s.keys[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Verify checks the TOTP code against the secret of name. A code is accepted
+// only once.
+func (s *Secrets) Verify(name, code string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSecret, name)
+	}
+	counter, ok := validateCode(key, code, now)
+	if !ok {
+		return ErrInvalidCode
+	}
+	if last, ok := s.used[name]; ok && counter <= last {
+		return ErrCodeReplayed
+	}
+	s.used[name] = counter
+	return nil
+}
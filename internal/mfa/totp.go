@@ -0,0 +1,69 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is the number of periods a code may lag behind or run ahead
+	// of the server clock.
+	totpSkew = 1
+)
+
+// DecodeSecret decodes a base32 TOTP secret as shown by authenticator apps.
+func DecodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decode TOTP secret: %w", err)
+	}
+	return key, nil
+}
+
+// GenerateCode returns the RFC 6238 code of the key for the time step counter.
+func GenerateCode(key []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for range totpDigits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// Counter returns the time step counter of t.
+func Counter(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(totpPeriod/time.Second)
+}
+
+// validateCode returns the counter the code was generated for. It returns
+// false if the code does not match any counter within the allowed skew.
+func validateCode(key []byte, code string, now time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := Counter(now)
+	for delta := -totpSkew; delta <= totpSkew; delta++ {
+		counter := current + uint64(delta)
+		if subtle.ConstantTimeCompare([]byte(GenerateCode(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
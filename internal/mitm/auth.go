@@ -0,0 +1,54 @@
+package mitm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/upstream"
+)
+
+var ErrNoUpstreamPassword = errors.New("no upstream password")
+
+// setPassword sets the password the proxy authenticates to the database with.
+// pgconn answers whichever password method the server asks for, including
+// SCRAM-SHA-256. Passwords are never put into metadata or audit events.
+func (m *MITM) setPassword(config *pgconn.Config, user string) error {
+	switch m.database.Auth {
+	case upstream.AuthPassword:
+		password, ok := m.database.Password(user)
+		if !ok {
+			return fmt.Errorf("%w: %w for role %s", ErrUserPermissionDenied, ErrNoUpstreamPassword, user)
+		}
+		config.Password = password
+	case upstream.AuthPassthrough:
+		password, err := m.receiveClientPassword()
+		if err != nil {
+			return fmt.Errorf("receive client password: %w", err)
+		}
+		config.Password = password
+	}
+	return nil
+}
+
+// receiveClientPassword asks the client for a cleartext password. The client
+// side is protected by the SSH tunnel and optionally by TLS.
+func (m *MITM) receiveClientPassword() (string, error) {
+	if err := m.backend.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+		return "", fmt.Errorf("set auth type: %w", err)
+	}
+	if err := m.sendToClient(&pgproto3.AuthenticationCleartextPassword{}); err != nil {
+		return "", fmt.Errorf("send authentication request: %w", err)
+	}
+	msg, err := m.backend.Receive()
+	if err != nil {
+		return "", err
+	}
+	password, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", fmt.Errorf("unexpected message instead of password: %T", msg)
+	}
+	return password.Password, nil
+}
@@ -0,0 +1,52 @@
+package mitm
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/upstream"
+)
+
+func TestSetPassword(t *testing.T) {
+	t.Run("certificate", func(t *testing.T) {
+		m := &MITM{database: &upstream.Database{Auth: upstream.AuthCertificate}}
+		var config pgconn.Config
+		require.NoError(t, m.setPassword(&config, "app"))
+		require.Empty(t, config.Password)
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		proxySide, clientSide := net.Pipe()
+		defer proxySide.Close()
+		defer clientSide.Close()
+		m := &MITM{
+			database: &upstream.Database{Auth: upstream.AuthPassthrough},
+			backend:  &Backend{Conn: proxySide, Backend: pgproto3.NewBackend(pgproto3.NewChunkReader(proxySide), proxySide)},
+		}
+
+		clientErr := make(chan error, 1)
+		go func() {
+			client := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientSide), clientSide)
+			msg, err := client.Receive()
+			if err != nil {
+				clientErr <- err
+				return
+			}
+			if _, ok := msg.(*pgproto3.AuthenticationCleartextPassword); !ok {
+				clientErr <- fmt.Errorf("unexpected message %T", msg)
+				return
+			}
+			clientErr <- client.Send(&pgproto3.PasswordMessage{Password: "from-client"})
+		}()
+
+		var config pgconn.Config
+		require.NoError(t, m.setPassword(&config, "app"))
+		require.NoError(t, <-clientErr)
+		require.Equal(t, "from-client", config.Password)
+	})
+}
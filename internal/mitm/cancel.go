@@ -0,0 +1,180 @@
+package mitm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/upstream"
+)
+
+const (
+	cancelTimeout = 10 * time.Second
+	useSSL        = 'S'
+)
+
+var ErrUnknownCancelKey = errors.New("unknown cancel key")
+
+type cancelTarget struct {
+	secretKey         uint32
+	database          *upstream.Database
+	upstreamProcessID uint32
+	upstreamSecretKey uint32
+}
+
+// CancelKeys maps the BackendKeyData the proxy gives to clients to the keys of
+// the upstream sessions. Clients never see upstream keys, so they can only
+// cancel queries of sessions proxied for them.
+type CancelKeys struct {
+	mu      sync.Mutex
+	targets map[uint32]cancelTarget
+}
+
+func NewCancelKeys() *CancelKeys {
+	return &CancelKeys{targets: make(map[uint32]cancelTarget)}
+}
+
+// Register issues a random client key for the upstream session.
+func (k *CancelKeys) Register(database *upstream.Database, upstreamProcessID, upstreamSecretKey uint32) (processID, secretKey uint32, err error) {
+	var b [8]byte
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, 0, fmt.Errorf("generate cancel key: %w", err)
+		}
+		processID = binary.BigEndian.Uint32(b[:4])
+		secretKey = binary.BigEndian.Uint32(b[4:])
+		if _, ok := k.targets[processID]; !ok && processID != 0 {
+			break
+		}
+	}
+	k.targets[processID] = cancelTarget{
+		secretKey:         secretKey,
+		database:          database,
+		upstreamProcessID: upstreamProcessID,
+		upstreamSecretKey: upstreamSecretKey,
+	}
+	return processID, secretKey, nil
+}
+
+func (k *CancelKeys) Unregister(processID uint32) {
+	k.mu.Lock()
+	delete(k.targets, processID)
+	k.mu.Unlock()
+}
+
+func (k *CancelKeys) lookup(processID, secretKey uint32) (cancelTarget, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	target, ok := k.targets[processID]
+	if !ok {
+		return cancelTarget{}, false
+	}
+	var expected, actual [4]byte
+	binary.BigEndian.PutUint32(expected[:], target.secretKey)
+	binary.BigEndian.PutUint32(actual[:], secretKey)
+	if subtle.ConstantTimeCompare(expected[:], actual[:]) == 0 {
+		return cancelTarget{}, false
+	}
+	return target, true
+}
+
+// Cancel forwards the cancel request to the upstream server over a fresh
+// connection if the key was issued by Register.
+func (k *CancelKeys) Cancel(ctx context.Context, msg pgproto3.CancelRequest) error {
+	target, ok := k.lookup(msg.ProcessID, msg.SecretKey)
+	if !ok {
+		return fmt.Errorf("%w: process id %d", ErrUnknownCancelKey, msg.ProcessID)
+	}
+	return target.cancel(ctx)
+}
+
+// cancel sends the cancel request of the upstream session.
+func (target cancelTarget) cancel(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, cancelTimeout)
+	defer cancel()
+
+	conn, err := dialCancel(ctx, target.database)
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", target.database.Name, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("set deadline: %w", err)
+		}
+	}
+	request, err := (&pgproto3.CancelRequest{
+		ProcessID: target.upstreamProcessID,
+		SecretKey: target.upstreamSecretKey,
+	}).Encode(nil)
+	if err != nil {
+		return fmt.Errorf("encode cancel request: %w", err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("send cancel request: %w", err)
+	}
+	// The server closes the connection without a response.
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("wait for server to close: %w", err)
+	}
+	return nil
+}
+
+// dialCancel connects to the database the same way sessions do: Unix sockets
+// in plain text, TCP with TLS verifying the server certificate.
+func dialCancel(ctx context.Context, database *upstream.Database) (net.Conn, error) {
+	var dialer net.Dialer
+	if database.Socket != "" {
+		return dialer.DialContext(ctx, "unix", database.Socket)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(database.Host, strconv.FormatUint(uint64(database.Port), 10)))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	sslRequest, err := (&pgproto3.SSLRequest{}).Encode(nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(sslRequest); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send SSL request: %w", err)
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read SSL response: %w", err)
+	}
+	if response[0] != useSSL {
+		conn.Close()
+		return nil, fmt.Errorf("server refused SSL")
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: database.Host,
+		RootCAs:    database.CACertPool,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return tlsConn, nil
+}
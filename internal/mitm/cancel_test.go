@@ -0,0 +1,58 @@
+package mitm
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/upstream"
+)
+
+func TestCancelKeys(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), ".s.PGSQL.5432")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan *pgproto3.CancelRequest, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn).ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if cancel, ok := msg.(*pgproto3.CancelRequest); ok {
+			received <- cancel
+		}
+	}()
+
+	keys := NewCancelKeys()
+	processID, secretKey, err := keys.Register(&upstream.Database{Name: "local", Socket: socket}, 4242, 777)
+	require.NoError(t, err)
+
+	t.Run("unknown key", func(t *testing.T) {
+		err := keys.Cancel(context.Background(), pgproto3.CancelRequest{ProcessID: 4242, SecretKey: 777})
+		require.ErrorIs(t, err, ErrUnknownCancelKey)
+		err = keys.Cancel(context.Background(), pgproto3.CancelRequest{ProcessID: processID, SecretKey: secretKey + 1})
+		require.ErrorIs(t, err, ErrUnknownCancelKey)
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		require.NoError(t, keys.Cancel(context.Background(), pgproto3.CancelRequest{ProcessID: processID, SecretKey: secretKey}))
+		require.Equal(t, &pgproto3.CancelRequest{ProcessID: 4242, SecretKey: 777}, <-received)
+	})
+
+	t.Run("unregister", func(t *testing.T) {
+		keys.Unregister(processID)
+		err := keys.Cancel(context.Background(), pgproto3.CancelRequest{ProcessID: processID, SecretKey: secretKey})
+		require.ErrorIs(t, err, ErrUnknownCancelKey)
+	})
+}
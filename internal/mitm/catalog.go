@@ -0,0 +1,170 @@
+package mitm
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+
+	"ssh-db-proxy/internal/sql"
+)
+
+const (
+	catalogTimeout         = 5 * time.Second
+	catalogApplicationName = "ssh-db-proxy catalog"
+
+	tableColumnsQuery = `SELECT c.oid, a.attnum, c.relname, a.attname
+FROM pg_catalog.pg_attribute a JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+WHERE c.relname = ANY($1::pg_catalog.name[]) AND a.attnum > 0`
+)
+
+type catalogKey struct {
+	tableOID uint32
+	attnum   uint16
+}
+
+type catalogColumn struct {
+	table  string
+	column string
+}
+
+// catalog resolves table OIDs and attribute numbers of RowDescription fields
+// to names. The columns of the tables a query refers to are fetched before the
+// query is forwarded, over a separate connection of the same role opened on
+// first use, and cached for the session. Result sets are only resolved from the
+// cache, so reading from the server never waits for the catalog.
+type catalog struct {
+	// connMu guards the connection and the fetched tables, mu guards the
+	// cache, so lookups do not wait for a fetch.
+	connMu sync.Mutex
+	config *pgconn.Config
+	conn   *pgconn.PgConn
+	tables map[string]bool
+
+	mu      sync.Mutex
+	columns map[catalogKey]catalogColumn
+}
+
+func newCatalog(config *pgconn.Config) *catalog {
+	config = config.Copy()
+	config.RuntimeParams = map[string]string{"application_name": catalogApplicationName}
+	return &catalog{config: config, tables: make(map[string]bool), columns: make(map[catalogKey]catalogColumn)}
+}
+
+// prefetch caches the columns of all relations with the given names in any
+// schema. Names fetched before are skipped.
+func (c *catalog) prefetch(tables []string) error {
+	if c == nil {
+		return nil
+	}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	var names []string
+	for _, table := range tables {
+		if !c.tables[table] {
+			names = append(names, table)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), catalogTimeout)
+	defer cancel()
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := pgconn.ConnectConfig(ctx, c.config)
+		if err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+		c.conn = conn
+	}
+	result := c.conn.ExecParams(ctx, tableColumnsQuery, [][]byte{textArray(names)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return fmt.Errorf("query table columns: %w", result.Err)
+	}
+	columns := make(map[catalogKey]catalogColumn, len(result.Rows))
+	for _, row := range result.Rows {
+		if len(row) != 4 {
+			return fmt.Errorf("unexpected table columns row of %d values", len(row))
+		}
+		tableOID, err := strconv.ParseUint(string(row[0]), 10, 32)
+		if err != nil {
+			return fmt.Errorf("parse table OID: %w", err)
+		}
+		attnum, err := strconv.ParseUint(string(row[1]), 10, 16)
+		if err != nil {
+			return fmt.Errorf("parse attribute number: %w", err)
+		}
+		columns[catalogKey{uint32(tableOID), uint16(attnum)}] = catalogColumn{table: string(row[2]), column: string(row[3])}
+	}
+	c.mu.Lock()
+	maps.Copy(c.columns, columns)
+	c.mu.Unlock()
+	for _, name := range names {
+		c.tables[name] = true
+	}
+	return nil
+}
+
+// column returns the cached name of a column.
+func (c *catalog) column(tableOID uint32, attnum uint16) (catalogColumn, bool) {
+	if c == nil {
+		return catalogColumn{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	column, ok := c.columns[catalogKey{tableOID, attnum}]
+	return column, ok
+}
+
+// statementTables returns the tables the statements refer to.
+func statementTables(statements []sql.QueryStatement) []string {
+	var tables []string
+	for _, statement := range statements {
+		if statement.Table != "" && !slices.Contains(tables, statement.Table) {
+			tables = append(tables, statement.Table)
+		}
+	}
+	return tables
+}
+
+// textArray encodes values as a text array literal.
+func textArray(values []string) []byte {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('"')
+		for _, r := range value {
+			if r == '"' || r == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return []byte(b.String())
+}
+
+func (c *catalog) close() {
+	if c == nil {
+		return
+	}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), catalogTimeout)
+		defer cancel()
+		c.conn.Close(ctx)
+		c.conn = nil
+	}
+}
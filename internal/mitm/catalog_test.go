@@ -0,0 +1,37 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/sql"
+)
+
+func TestCatalog(t *testing.T) {
+	t.Run("prefetch skips fetched tables", func(t *testing.T) {
+		// The catalog has no connection config, so it would fail if it tried
+		// to query the server.
+		c := &catalog{tables: map[string]bool{"users": true}, columns: map[catalogKey]catalogColumn{}}
+		require.NoError(t, c.prefetch([]string{"users"}))
+		require.NoError(t, c.prefetch(nil))
+
+		var missing *catalog
+		require.NoError(t, missing.prefetch([]string{"users"}))
+		_, ok := missing.column(1, 1)
+		require.False(t, ok)
+	})
+
+	t.Run("statement tables", func(t *testing.T) {
+		require.Equal(t, []string{"users", "orders"}, statementTables([]sql.QueryStatement{
+			{Type: sql.Select, Table: "users", Column: "id"},
+			{Type: sql.Select, Table: "users", Column: "email"},
+			{Type: sql.Select, Column: "now"},
+			{Type: sql.Join, Table: "orders"},
+		}))
+	})
+
+	t.Run("text array", func(t *testing.T) {
+		require.Equal(t, `{"users","we\"ird\\name"}`, string(textArray([]string{"users", `we"ird\name`})))
+	})
+}
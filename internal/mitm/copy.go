@@ -0,0 +1,153 @@
+package mitm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/metadata"
+	"ssh-db-proxy/internal/sql"
+)
+
+const (
+	CopyDirectionIn  = "in"
+	CopyDirectionOut = "out"
+)
+
+// copyOperation accumulates the traffic of a COPY sub-protocol exchange until
+// the server completes or fails it.
+type copyOperation struct {
+	direction string
+	query     string
+	bytes     int64
+	started   time.Time
+}
+
+// copyQuery is the last query containing a COPY statement. Its text and
+// statements are attached to the audit event of the COPY operation.
+type copyQuery struct {
+	query      string
+	statements []sql.QueryStatement
+}
+
+func (m *MITM) rememberCopyQuery(query string, statements []sql.QueryStatement) {
+	if !slices.ContainsFunc(statements, func(statement sql.QueryStatement) bool {
+		return statement.Type == sql.CopyIn || statement.Type == sql.CopyOut
+	}) {
+		return
+	}
+	m.copyMu.Lock()
+	m.lastCopyQuery = copyQuery{query: query, statements: statements}
+	m.copyMu.Unlock()
+}
+
+// onClientCopyMessage accounts COPY IN data sent by the client.
+func (m *MITM) onClientCopyMessage(msg pgproto3.FrontendMessage) {
+	m.copyMu.Lock()
+	defer m.copyMu.Unlock()
+	if m.copy == nil || m.copy.direction != CopyDirectionIn {
+		return
+	}
+	switch msg := msg.(type) {
+	case *pgproto3.CopyData:
+		m.copy.bytes += int64(len(msg.Data))
+	case *pgproto3.CopyFail:
+		m.logger.Infow("client failed COPY", "message", msg.Message)
+	}
+}
+
+// onCopyMessage follows the COPY sub-protocol in the backend stream.
+func (m *MITM) onCopyMessage(msgType byte, length int, body []byte) {
+	switch msgType {
+	case copyInResponseMessage:
+		m.startCopy(CopyDirectionIn)
+	case copyOutResponseMessage:
+		m.startCopy(CopyDirectionOut)
+	case copyDataMessage:
+		m.copyMu.Lock()
+		if m.copy != nil && m.copy.direction == CopyDirectionOut {
+			m.copy.bytes += int64(length)
+		}
+		m.copyMu.Unlock()
+	case commandCompleteMessage:
+		if !m.copyActive() {
+			return
+		}
+		var msg pgproto3.CommandComplete
+		if err := msg.Decode(body); err != nil {
+			m.logger.Errorf("decode command complete: %s", err)
+			return
+		}
+		m.finishCopy(copyRows(msg.CommandTag), nil)
+	case errorResponseMessage:
+		if !m.copyActive() {
+			return
+		}
+		var msg pgproto3.ErrorResponse
+		if err := msg.Decode(body); err != nil {
+			m.logger.Errorf("decode error response: %s", err)
+			return
+		}
+		m.finishCopy(0, errors.New(msg.Severity+": "+msg.Message+" ("+msg.Code+")"))
+	}
+}
+
+func (m *MITM) copyActive() bool {
+	m.copyMu.Lock()
+	defer m.copyMu.Unlock()
+	return m.copy != nil
+}
+
+func (m *MITM) startCopy(direction string) {
+	m.copyMu.Lock()
+	defer m.copyMu.Unlock()
+	m.copy = &copyOperation{
+		direction: direction,
+		query:     m.lastCopyQuery.query,
+		started:   time.Now(),
+	}
+}
+
+func (m *MITM) finishCopy(rows int64, copyErr error) {
+	m.copyMu.Lock()
+	operation := m.copy
+	m.copy = nil
+	statements := m.lastCopyQuery.statements
+	m.copyMu.Unlock()
+	if operation == nil {
+		return
+	}
+
+	data := m.metadata.Copy()
+	data.Query = operation.query
+	for _, statement := range statements {
+		data.QueryStatements = append(data.QueryStatements, metadata.QueryStatement{
+			StatementType: sql.StringByStatementType[statement.Type],
+			Table:         statement.Table,
+			Column:        statement.Column,
+		})
+	}
+	duration := time.Since(operation.started)
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-copy-event"), func(ctx context.Context) {
+		m.notifier.OnCopy(operation.direction, rows, operation.bytes, duration, copyErr, data)
+	})
+}
+
+// copyRows returns the row count of a "COPY n" command tag.
+func copyRows(commandTag []byte) int64 {
+	rows, ok := bytes.CutPrefix(commandTag, []byte("COPY "))
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(string(rows), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
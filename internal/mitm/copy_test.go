@@ -0,0 +1,59 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendScannerCopy(t *testing.T) {
+	var stream []byte
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.CopyOutResponse{OverallFormat: 0, ColumnFormatCodes: []uint16{0, 0}},
+		&pgproto3.CopyData{Data: []byte("1\talice\n")},
+		&pgproto3.CopyData{Data: []byte("2\tbob\n")},
+		&pgproto3.CopyDone{},
+		&pgproto3.CommandComplete{CommandTag: []byte("COPY 2")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		var err error
+		stream, err = msg.Encode(stream)
+		require.NoError(t, err)
+	}
+
+	for _, chunkSize := range []int{1, 2, 3, 7, len(stream)} {
+		var (
+			types      []byte
+			copyBytes  int
+			commandTag string
+		)
+		scanner := backendScanner{onMessage: func(msgType byte, length int, body []byte) {
+			types = append(types, msgType)
+			switch msgType {
+			case copyDataMessage:
+				require.Nil(t, body)
+				copyBytes += length
+			case commandCompleteMessage:
+				var msg pgproto3.CommandComplete
+				require.NoError(t, msg.Decode(body))
+				commandTag = string(msg.CommandTag)
+			}
+		}}
+		for b := stream; len(b) > 0; {
+			n := min(chunkSize, len(b))
+			scanner.Scan(b[:n])
+			b = b[n:]
+		}
+		require.Equal(t, []byte("HddcCZ"), types, "chunk size %d", chunkSize)
+		require.Equal(t, len("1\talice\n2\tbob\n"), copyBytes)
+		require.Equal(t, "COPY 2", commandTag)
+		require.True(t, scanner.AtBoundary())
+	}
+}
+
+func TestCopyRows(t *testing.T) {
+	require.Equal(t, int64(42), copyRows([]byte("COPY 42")))
+	require.Equal(t, int64(0), copyRows([]byte("INSERT 0 1")))
+	require.Equal(t, int64(0), copyRows([]byte("COPY")))
+}
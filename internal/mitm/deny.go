@@ -0,0 +1,89 @@
+package mitm
+
+import (
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	insufficientPrivilegeCode = "42501"
+	syntaxErrorCode           = "42601"
+	invalidCursorNameCode     = "34000"
+
+	permissionDeniedMessage = "Query is not permitted by administrator"
+
+	// deniedQuery and deniedPortal replace denied queries and portals. The
+	// server rejects them with syntaxErrorCode and invalidCursorNameCode.
+	deniedQuery  = "ssh-db-proxy: query is not permitted"
+	deniedPortal = "ssh-db-proxy: portal is not permitted"
+)
+
+// deny replaces a denied message with one the server is bound to reject. The
+// server then reports the error with the real transaction status, aborting an
+// open transaction block, and skips the rest of an extended protocol batch up
+// to Sync exactly as for any other error. The rejection is rewritten into the
+// denial on its way back to the client.
+func (m *MITM) deny(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	switch msg := msg.(type) {
+	case *pgproto3.Query:
+		m.lastRequest.deny(syntaxErrorCode)
+		return &pgproto3.Query{String: deniedQuery}
+	case *pgproto3.Execute:
+		m.lastRequest.deny(invalidCursorNameCode)
+		return &pgproto3.Execute{Portal: deniedPortal}
+	case *pgproto3.Parse:
+		r := m.newRequest(msg.Query, true)
+		r.deny(syntaxErrorCode)
+		m.requests.push(r)
+		return &pgproto3.Parse{Name: msg.Name, Query: deniedQuery}
+	default:
+		return msg
+	}
+}
+
+// deny marks the request as denied. The server rejects its replacement with
+// code, which is reported to the client as the denial of the request.
+func (r *request) deny(code string) {
+	r.deniedCode = code
+	if r.denial == nil {
+		r.denial = permissionDenied("ERROR")
+	}
+}
+
+// rewriteDenial turns the server's rejection of a denied message into the
+// permission error. Other errors, such as the one of an already aborted
+// transaction, are forwarded as is.
+func (m *MITM) rewriteDenial(body []byte) []byte {
+	m.requests.mu.Lock()
+	var (
+		deniedCode string
+		denial     *pgproto3.ErrorResponse
+	)
+	if r := m.requests.head(); r != nil {
+		deniedCode, denial = r.deniedCode, r.denial
+	}
+	m.requests.mu.Unlock()
+
+	var msg pgproto3.ErrorResponse
+	if err := msg.Decode(body); err != nil {
+		m.logger.Errorf("decode error response: %s", err)
+		return rawMessage(errorResponseMessage, body)
+	}
+	if msg.Code != deniedCode || denial == nil {
+		return rawMessage(errorResponseMessage, body)
+	}
+	out, err := denial.Encode(nil)
+	if err != nil {
+		m.logger.Errorf("encode error response: %s", err)
+		return rawMessage(errorResponseMessage, body)
+	}
+	return out
+}
+
+func permissionDenied(severity string) *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{
+		Severity:            severity,
+		SeverityUnlocalized: severity,
+		Code:                insufficientPrivilegeCode,
+		Message:             permissionDeniedMessage,
+	}
+}
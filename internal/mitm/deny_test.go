@@ -0,0 +1,87 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeny(t *testing.T) {
+	// respond feeds the server responses through the scanner and returns what
+	// the client receives.
+	respond := func(t *testing.T, m *MITM, msgs ...pgproto3.BackendMessage) []pgproto3.BackendMessage {
+		stream := encodeBackend(t, msgs...)
+		_, received := decodeBackend(t, scanBackend(m, stream, len(stream)))
+		return received
+	}
+	denied := permissionDenied("ERROR")
+
+	t.Run("simple query in transaction", func(t *testing.T) {
+		m := newTestMITM(t)
+		m.lastRequest = m.newRequest("DELETE FROM orders", false)
+		msg := m.deny(&pgproto3.Query{String: "DELETE FROM orders"})
+		require.Equal(t, &pgproto3.Query{String: deniedQuery}, msg)
+		m.requests.push(m.lastRequest)
+		r := m.lastRequest
+
+		received := respond(t, m,
+			&pgproto3.ErrorResponse{Severity: "ERROR", Code: syntaxErrorCode, Message: `syntax error at or near "ssh"`},
+			&pgproto3.ReadyForQuery{TxStatus: 'E'},
+		)
+		require.Equal(t, []pgproto3.BackendMessage{denied, &pgproto3.ReadyForQuery{TxStatus: 'E'}}, received)
+		require.Equal(t, insufficientPrivilegeCode, r.errorCode)
+		require.Equal(t, permissionDeniedMessage, r.errorText)
+	})
+
+	t.Run("aborted transaction", func(t *testing.T) {
+		m := newTestMITM(t)
+		m.lastRequest = m.newRequest("DELETE FROM orders", false)
+		m.deny(&pgproto3.Query{String: "DELETE FROM orders"})
+		m.requests.push(m.lastRequest)
+
+		aborted := &pgproto3.ErrorResponse{Severity: "ERROR", Code: "25P02", Message: "current transaction is aborted"}
+		received := respond(t, m, aborted, &pgproto3.ReadyForQuery{TxStatus: 'E'})
+		require.Equal(t, []pgproto3.BackendMessage{aborted, &pgproto3.ReadyForQuery{TxStatus: 'E'}}, received)
+	})
+
+	t.Run("extended query", func(t *testing.T) {
+		m := newTestMITM(t)
+		m.lastRequest = m.newRequest("DELETE FROM orders", true)
+		msg := m.deny(&pgproto3.Execute{})
+		require.Equal(t, &pgproto3.Execute{Portal: deniedPortal}, msg)
+		m.requests.push(m.lastRequest)
+		skipped := m.newRequest("SELECT 1", true)
+		m.requests.push(skipped)
+		m.requests.push(&request{sync: true})
+
+		received := respond(t, m,
+			&pgproto3.ParseComplete{},
+			&pgproto3.BindComplete{},
+			&pgproto3.ErrorResponse{Severity: "ERROR", Code: invalidCursorNameCode, Message: `portal "ssh-db-proxy: portal is not permitted" does not exist`},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+		require.Equal(t, []pgproto3.BackendMessage{
+			&pgproto3.ParseComplete{},
+			&pgproto3.BindComplete{},
+			denied,
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		}, received)
+		require.Equal(t, skippedAfterError, skipped.errorText)
+		require.Empty(t, m.requests.requests)
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		m := newTestMITM(t)
+		msg := m.deny(&pgproto3.Parse{Name: "s1", Query: "DELETE FROM orders"})
+		require.Equal(t, &pgproto3.Parse{Name: "s1", Query: deniedQuery}, msg)
+		m.requests.push(&request{sync: true})
+
+		received := respond(t, m,
+			&pgproto3.ErrorResponse{Severity: "ERROR", Code: syntaxErrorCode, Message: `syntax error at or near "ssh"`},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+		require.Equal(t, []pgproto3.BackendMessage{denied, &pgproto3.ReadyForQuery{TxStatus: 'I'}}, received)
+		require.Empty(t, m.requests.requests)
+	})
+}
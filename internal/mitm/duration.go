@@ -0,0 +1,82 @@
+package mitm
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const queryCanceledCode = "57014"
+
+// watchDuration starts the timer of a request with a duration limit. The
+// request runs from the moment it is forwarded until it completes.
+func (m *MITM) watchDuration(r *request) {
+	if r == nil || r.durationLimit.Max <= 0 {
+		return
+	}
+	m.requests.mu.Lock()
+	r.timer = time.AfterFunc(r.durationLimit.Max, func() {
+		m.onQueryTimeout(r)
+	})
+	m.requests.mu.Unlock()
+}
+
+func (m *MITM) stopDurationTimer(r *request) {
+	m.requests.mu.Lock()
+	timer := r.timer
+	r.timer = nil
+	m.requests.mu.Unlock()
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// onQueryTimeout cancels a request that is still running when its duration
+// limit expires. The server answers the cancel with query_canceled, which is
+// reported to the client as the duration limit error the same way as a
+// denial. A cancel racing with the end of the query may hit the next one, as
+// with cancels sent by clients.
+func (m *MITM) onQueryTimeout(r *request) {
+	m.requests.mu.Lock()
+	if r.deniedCode != "" || !slices.Contains(m.requests.requests, r) {
+		m.requests.mu.Unlock()
+		return
+	}
+	r.deniedCode = queryCanceledCode
+	r.denial = &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                queryCanceledCode,
+		Message:             fmt.Sprintf("canceling statement due to query duration limit of %s", r.durationLimit.Max),
+	}
+	elapsed := time.Since(r.started)
+	m.requests.mu.Unlock()
+
+	m.logger.Infow("cancelling query over duration limit", "query-id", r.data.QueryID, "limit", r.durationLimit.Max)
+	cancelErr := m.upstreamCancelTarget().cancel(context.Background())
+	if cancelErr != nil {
+		m.logger.Errorf("cancel query: %s", cancelErr)
+	}
+	limit, data := r.durationLimit, r.data
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-query-timeout-event"), func(ctx context.Context) {
+		m.notifier.OnQueryTimeout(limit.Max, elapsed, limit.Disconnect, cancelErr, data)
+	})
+	if limit.Disconnect {
+		m.Terminate(ErrQueryDurationExceeded)
+	}
+}
+
+func (m *MITM) upstreamCancelTarget() cancelTarget {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target := cancelTarget{database: m.database}
+	if m.frontend != nil {
+		target.upstreamProcessID = m.frontend.ProcessID
+		target.upstreamSecretKey = m.frontend.SecretKey
+	}
+	return target
+}
@@ -0,0 +1,85 @@
+package mitm
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/upstream"
+)
+
+func TestQueryDuration(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), ".s.PGSQL.5432")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan *pgproto3.CancelRequest, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			msg, err := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn).ReceiveStartupMessage()
+			if cancel, ok := msg.(*pgproto3.CancelRequest); ok && err == nil {
+				received <- cancel
+			}
+			conn.Close()
+		}
+	}()
+
+	m := newTestMITM(t)
+	m.database = &upstream.Database{Name: "local", Socket: socket}
+	m.frontend = &Frontend{ProcessID: 4242, SecretKey: 777}
+	respond := func(msgs ...pgproto3.BackendMessage) (string, []pgproto3.BackendMessage) {
+		stream := encodeBackend(t, msgs...)
+		return decodeBackend(t, scanBackend(m, stream, len(stream)))
+	}
+
+	t.Run("completed in time", func(t *testing.T) {
+		r := m.newRequest("SELECT 1", false)
+		r.durationLimit = abac.DurationLimit{Max: 20 * time.Millisecond}
+		m.requests.push(r)
+		m.watchDuration(r)
+		respond(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+		select {
+		case <-received:
+			t.Fatal("completed query was cancelled")
+		case <-time.After(50 * time.Millisecond):
+		}
+		require.Empty(t, r.errorCode)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		r := m.newRequest("SELECT pg_sleep(60)", false)
+		r.durationLimit = abac.DurationLimit{Max: 10 * time.Millisecond}
+		m.requests.push(r)
+		m.watchDuration(r)
+
+		select {
+		case cancel := <-received:
+			require.Equal(t, &pgproto3.CancelRequest{ProcessID: 4242, SecretKey: 777}, cancel)
+		case <-time.After(5 * time.Second):
+			t.Fatal("query was not cancelled")
+		}
+
+		types, msgs := respond(
+			&pgproto3.ErrorResponse{Severity: "ERROR", Code: queryCanceledCode, Message: "canceling statement due to user request"},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+		require.Equal(t, "EZ", types)
+		msg := msgs[0].(*pgproto3.ErrorResponse)
+		require.Equal(t, queryCanceledCode, msg.Code)
+		require.Equal(t, "canceling statement due to query duration limit of 10ms", msg.Message)
+		require.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[1])
+		require.Equal(t, msg.Message, r.errorText)
+		require.Empty(t, m.requests.requests)
+	})
+}
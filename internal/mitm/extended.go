@@ -0,0 +1,286 @@
+package mitm
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/metadata"
+)
+
+const (
+	textFormat   = 0
+	binaryFormat = 1
+
+	// Object types of Close and Describe.
+	statementObject = 'S'
+	portalObject    = 'P'
+
+	maxParameterLength = 1024
+)
+
+// Type OIDs of parameters decoded from the binary format and of masked columns.
+const (
+	boolOID    = 16
+	nameOID    = 19
+	int8OID    = 20
+	int2OID    = 21
+	int4OID    = 23
+	textOID    = 25
+	oidOID     = 26
+	jsonOID    = 114
+	float4OID  = 700
+	float8OID  = 701
+	bpcharOID  = 1042
+	varcharOID = 1043
+	numericOID = 1700
+	uuidOID    = 2950
+	jsonbOID   = 3802
+)
+
+type preparedStatement struct {
+	query         string
+	parameterOIDs []uint32
+	// rowFiltered is set if row filters were applied when the statement was
+	// prepared; rewritten is its text sent to the server if it was changed.
+	rowFiltered bool
+	rewritten   string
+	columns     *resultColumns
+}
+
+type portal struct {
+	statementName string
+	statement     preparedStatement
+	parameters    []metadata.Parameter
+	resultFormats []int16
+	columns       *resultColumns
+	// rowLimit is shared by the Executes of the portal so that fetching it in
+	// batches does not reset the limit.
+	rowLimit *rowLimit
+}
+
+// resultColumns are the result columns of a statement or portal returned for
+// a Describe of the client.
+type resultColumns struct {
+	// described is set by the goroutine reading from the client when the
+	// client sends the Describe.
+	described bool
+	// fields and received are set by the goroutine reading from the server
+	// under the lock of the request queue.
+	fields   []pgproto3.FieldDescription
+	received bool
+}
+
+// described reports whether the client described the portal or its statement,
+// so that the columns of its rows are known by the time they arrive.
+func (p portal) described() bool {
+	return p.columns != nil && p.columns.described || p.statement.columns != nil && p.statement.columns.described
+}
+
+// resultFields returns the columns of the rows of an Execute of the portal. The
+// columns of a described statement have the formats requested by Bind.
+func resultFields(portalColumns, statementColumns *resultColumns, resultFormats []int16) []pgproto3.FieldDescription {
+	if portalColumns != nil && portalColumns.received {
+		return portalColumns.fields
+	}
+	if statementColumns == nil || !statementColumns.received {
+		return nil
+	}
+	fields := slices.Clone(statementColumns.fields)
+	for i := range fields {
+		fields[i].Format = formatCode(resultFormats, i)
+	}
+	return fields
+}
+
+// extendedQueries tracks prepared statements and portals of the extended query
+// protocol so that Execute can be tied to its query and parameters. It is only
+// used by the goroutine reading from the client.
+type extendedQueries struct {
+	statements map[string]preparedStatement
+	portals    map[string]portal
+}
+
+func newExtendedQueries() extendedQueries {
+	return extendedQueries{
+		statements: make(map[string]preparedStatement),
+		portals:    make(map[string]portal),
+	}
+}
+
+func (e *extendedQueries) parse(msg *pgproto3.Parse) {
+	e.statements[msg.Name] = preparedStatement{query: msg.Query, parameterOIDs: msg.ParameterOIDs, columns: &resultColumns{}}
+}
+
+// bind tracks the portal of a tracked statement. Portals of other statements,
+// such as ones prepared with SQL PREPARE, are forgotten, so their Execute is
+// not tied to a query.
+func (e *extendedQueries) bind(msg *pgproto3.Bind) {
+	statement, ok := e.statements[msg.PreparedStatement]
+	if !ok {
+		delete(e.portals, msg.DestinationPortal)
+		return
+	}
+	parameters := make([]metadata.Parameter, len(msg.Parameters))
+	for i, value := range msg.Parameters {
+		var oid uint32
+		if i < len(statement.parameterOIDs) {
+			oid = statement.parameterOIDs[i]
+		}
+		parameters[i] = decodeParameter(oid, formatCode(msg.ParameterFormatCodes, i), value)
+	}
+	e.portals[msg.DestinationPortal] = portal{
+		statementName: msg.PreparedStatement,
+		statement:     statement,
+		parameters:    parameters,
+		resultFormats: msg.ResultFormatCodes,
+		columns:       &resultColumns{},
+	}
+}
+
+// describe marks the statement or portal as described and returns its columns
+// to be set from the response, or nil if it is not tracked.
+func (e *extendedQueries) describe(msg *pgproto3.Describe) *resultColumns {
+	var columns *resultColumns
+	switch msg.ObjectType {
+	case statementObject:
+		if statement, ok := e.statements[msg.Name]; ok {
+			columns = statement.columns
+		}
+	case portalObject:
+		if p, ok := e.portals[msg.Name]; ok {
+			columns = p.columns
+		}
+	}
+	if columns != nil {
+		columns.described = true
+	}
+	return columns
+}
+
+func (e *extendedQueries) close(msg *pgproto3.Close) {
+	switch msg.ObjectType {
+	case statementObject:
+		delete(e.statements, msg.Name)
+	case portalObject:
+		delete(e.portals, msg.Name)
+	}
+}
+
+func (e *extendedQueries) portal(name string) (portal, bool) {
+	p, ok := e.portals[name]
+	return p, ok
+}
+
+func (e *extendedQueries) setRowFiltered(name, rewritten string, changed bool) {
+	if statement, ok := e.statements[name]; ok {
+		statement.rowFiltered = true
+		if changed {
+			statement.rewritten = rewritten
+		}
+		e.statements[name] = statement
+	}
+}
+
+func (e *extendedQueries) setRowLimit(name string, limit *rowLimit) {
+	if p, ok := e.portals[name]; ok {
+		p.rowLimit = limit
+		e.portals[name] = p
+	}
+}
+
+// formatCode returns the format of the i-th parameter or result column: no
+// codes mean text for all of them, a single code applies to all of them.
+func formatCode(formatCodes []int16, i int) int16 {
+	switch {
+	case len(formatCodes) == 0:
+		return textFormat
+	case len(formatCodes) == 1:
+		return formatCodes[0]
+	case i < len(formatCodes):
+		return formatCodes[i]
+	default:
+		return textFormat
+	}
+}
+
+// decodeParameter renders a bind parameter for audit. Text parameters are kept
+// as is, binary ones are decoded for common types and hex-encoded otherwise.
+func decodeParameter(oid uint32, format int16, value []byte) metadata.Parameter {
+	parameter := metadata.Parameter{OID: oid, Format: "text"}
+	if format == binaryFormat {
+		parameter.Format = "binary"
+	}
+	if value == nil {
+		return parameter
+	}
+
+	var decoded string
+	if format == binaryFormat {
+		decoded = decodeBinary(oid, value)
+	} else {
+		decoded = string(value)
+	}
+	if len(decoded) > maxParameterLength {
+		decoded = decoded[:maxParameterLength]
+		for !utf8.ValidString(decoded) {
+			decoded = decoded[:len(decoded)-1]
+		}
+		parameter.Truncated = true
+	}
+	parameter.Value = &decoded
+	return parameter
+}
+
+func decodeBinary(oid uint32, value []byte) string {
+	switch oid {
+	case boolOID:
+		if len(value) == 1 {
+			return strconv.FormatBool(value[0] != 0)
+		}
+	case int2OID:
+		if len(value) == 2 {
+			return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10)
+		}
+	case int4OID:
+		if len(value) == 4 {
+			return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10)
+		}
+	case oidOID:
+		if len(value) == 4 {
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+		}
+	case int8OID:
+		if len(value) == 8 {
+			return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10)
+		}
+	case float4OID:
+		if len(value) == 4 {
+			return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'g', -1, 32)
+		}
+	case float8OID:
+		if len(value) == 8 {
+			return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64)
+		}
+	case textOID, varcharOID, bpcharOID, nameOID, jsonOID:
+		if utf8.Valid(value) {
+			return string(value)
+		}
+	case jsonbOID:
+		// Binary jsonb is a version byte followed by the text.
+		if len(value) > 0 && value[0] == 1 && utf8.Valid(value[1:]) {
+			return string(value[1:])
+		}
+	case uuidOID:
+		if id, err := uuid.FromBytes(value); err == nil {
+			return id.String()
+		}
+	}
+	return `\x` + hex.EncodeToString(value)
+}
@@ -0,0 +1,127 @@
+package mitm
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/metadata"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestExtendedQueries(t *testing.T) {
+	e := newExtendedQueries()
+	e.parse(&pgproto3.Parse{Name: "get_user", Query: "select * from users where id = $1 and name = $2", ParameterOIDs: []uint32{int8OID}})
+
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, 42)
+	e.bind(&pgproto3.Bind{
+		PreparedStatement:    "get_user",
+		ParameterFormatCodes: []int16{binaryFormat, textFormat},
+		Parameters:           [][]byte{id, []byte("alice")},
+	})
+
+	p, ok := e.portal("")
+	require.True(t, ok)
+	require.Equal(t, "get_user", p.statementName)
+	require.Equal(t, "select * from users where id = $1 and name = $2", p.statement.query)
+	require.Equal(t, []metadata.Parameter{
+		{OID: int8OID, Format: "binary", Value: stringPtr("42")},
+		{OID: 0, Format: "text", Value: stringPtr("alice")},
+	}, p.parameters)
+
+	t.Run("unnamed statement is replaced", func(t *testing.T) {
+		e.parse(&pgproto3.Parse{Query: "select 1"})
+		e.bind(&pgproto3.Bind{DestinationPortal: "cursor"})
+		e.parse(&pgproto3.Parse{Query: "select 2"})
+		p, ok := e.portal("cursor")
+		require.True(t, ok)
+		require.Equal(t, "select 1", p.statement.query)
+		e.bind(&pgproto3.Bind{DestinationPortal: "cursor"})
+		p, _ = e.portal("cursor")
+		require.Equal(t, "select 2", p.statement.query)
+	})
+
+	t.Run("statement prepared with SQL", func(t *testing.T) {
+		e.bind(&pgproto3.Bind{DestinationPortal: "cursor", PreparedStatement: "prepared_with_sql"})
+		_, ok := e.portal("cursor")
+		require.False(t, ok)
+		e.bind(&pgproto3.Bind{DestinationPortal: "cursor"})
+	})
+
+	t.Run("close", func(t *testing.T) {
+		e.close(&pgproto3.Close{ObjectType: portalObject, Name: "cursor"})
+		_, ok := e.portal("cursor")
+		require.False(t, ok)
+		e.close(&pgproto3.Close{ObjectType: statementObject, Name: "get_user"})
+		require.NotContains(t, e.statements, "get_user")
+	})
+}
+
+func TestExtendedQueryPolicy(t *testing.T) {
+	rules, err := abac.New(map[string]*abac.Rule{
+		"no-salaries": {
+			Conditions: []abac.Condition{&abac.QueryCondition{TableRegexps: []string{"^salaries$"}, ColumnRegexps: []string{".*"}, Strict: true}},
+			Actions:    abac.NotPermit,
+		},
+	})
+	require.NoError(t, err)
+	m := newTestMITM(t)
+	m.abac = rules
+
+	require.ErrorIs(t, m.handleMessage(&pgproto3.Parse{Name: "s1", Query: "SELECT * FROM salaries"}), ErrUserPermissionDenied)
+	require.NotContains(t, m.extended.statements, "s1")
+	require.NoError(t, m.handleMessage(&pgproto3.Bind{PreparedStatement: "s1"}))
+	require.ErrorIs(t, m.handleMessage(&pgproto3.Execute{}), ErrUserPermissionDenied)
+
+	require.NoError(t, m.handleMessage(&pgproto3.Parse{Query: "SELECT * FROM products"}))
+	require.ErrorIs(t, m.handleMessage(&pgproto3.Parse{Query: "SELECT * FROM salaries"}), ErrUserPermissionDenied)
+	require.NotContains(t, m.extended.statements, "")
+
+	require.NoError(t, m.handleMessage(&pgproto3.Parse{Name: "s2", Query: "SELECT * FROM products"}))
+	require.NoError(t, m.handleMessage(&pgproto3.Bind{PreparedStatement: "s2"}))
+	require.NoError(t, m.handleMessage(&pgproto3.Execute{}))
+
+	require.ErrorIs(t, m.handleMessage(&pgproto3.Execute{Portal: "unknown"}), ErrUserPermissionDenied)
+	require.NoError(t, m.handleMessage(&pgproto3.Bind{PreparedStatement: "prepared_with_sql"}))
+	require.ErrorIs(t, m.handleMessage(&pgproto3.Execute{}), ErrUserPermissionDenied)
+}
+
+func TestDecodeParameter(t *testing.T) {
+	float8 := make([]byte, 8)
+	binary.BigEndian.PutUint64(float8, math.Float64bits(1.5))
+	int4 := make([]byte, 4)
+	binary.BigEndian.PutUint32(int4, uint32(0xffffffff))
+
+	for _, tc := range []struct {
+		oid    uint32
+		format int16
+		value  []byte
+		want   *string
+	}{
+		{oid: textOID, format: textFormat, value: []byte("hello"), want: stringPtr("hello")},
+		{oid: int4OID, format: textFormat, value: nil, want: nil},
+		{oid: int4OID, format: binaryFormat, value: int4, want: stringPtr("-1")},
+		{oid: float8OID, format: binaryFormat, value: float8, want: stringPtr("1.5")},
+		{oid: boolOID, format: binaryFormat, value: []byte{1}, want: stringPtr("true")},
+		{oid: uuidOID, format: binaryFormat, value: make([]byte, 16), want: stringPtr("00000000-0000-0000-0000-000000000000")},
+		{oid: jsonbOID, format: binaryFormat, value: []byte("\x01{\"a\":1}"), want: stringPtr(`{"a":1}`)},
+		{oid: 0, format: binaryFormat, value: []byte{0xde, 0xad}, want: stringPtr(`\xdead`)},
+		{oid: int8OID, format: binaryFormat, value: []byte{1}, want: stringPtr(`\x01`)},
+	} {
+		require.Equal(t, tc.want, decodeParameter(tc.oid, tc.format, tc.value).Value, "oid %d", tc.oid)
+	}
+
+	long := decodeParameter(textOID, textFormat, []byte(strings.Repeat("я", maxParameterLength)))
+	require.True(t, long.Truncated)
+	require.LessOrEqual(t, len(*long.Value), maxParameterLength)
+	require.True(t, strings.HasPrefix(strings.Repeat("я", maxParameterLength), *long.Value))
+}
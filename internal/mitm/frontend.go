@@ -2,6 +2,7 @@ package mitm
 
 import (
 	"net"
+	"sync"
 
 	"github.com/jackc/pgproto3/v2"
 )
@@ -12,6 +13,16 @@ type Frontend struct {
 	ProcessID         uint32
 	SecretKey         uint32
 	ParameterStatuses map[string]string
+
+	sendMu sync.Mutex
+}
+
+// Send sends a message to the server. Messages of the goroutine forwarding
+// client messages and of Terminate are not interleaved.
+func (f *Frontend) Send(msg pgproto3.FrontendMessage) error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	return f.Frontend.Send(msg)
 }
 
 type Backend struct {
@@ -0,0 +1,92 @@
+package mitm
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"ssh-db-proxy/internal/config"
+	"ssh-db-proxy/internal/notifier"
+)
+
+// newTestMITM returns a MITM with an in-memory notifier and the backend
+// scanner wired as in a proxied session.
+func newTestMITM(t *testing.T) *MITM {
+	auditor, err := notifier.New(config.NotifierConfig{Enabled: true, Capacity: 16}, nil)
+	require.NoError(t, err)
+	m := &MITM{notifier: auditor, logger: zap.NewNop().Sugar(), extended: newExtendedQueries()}
+	m.scanner.onMessage = m.onBackendMessage
+	m.scanner.intercept = m.interceptBackendMessage
+	m.scanner.rewrite = m.rewriteBackendMessage
+	return m
+}
+
+// encodeBackend encodes the server messages into one stream.
+func encodeBackend(t *testing.T, msgs ...pgproto3.BackendMessage) []byte {
+	var stream []byte
+	for _, msg := range msgs {
+		var err error
+		stream, err = msg.Encode(stream)
+		require.NoError(t, err)
+	}
+	return stream
+}
+
+// scanBackend feeds the stream through the scanner of m in chunks of
+// chunkSize bytes and returns what the client receives.
+func scanBackend(m *MITM, stream []byte, chunkSize int) []byte {
+	var out []byte
+	for len(stream) > 0 {
+		n := min(chunkSize, len(stream))
+		out = append(out, m.scanner.Scan(stream[:n])...)
+		stream = stream[n:]
+	}
+	return out
+}
+
+// decodeBackend splits the stream received by the client into messages and
+// returns them with their types.
+func decodeBackend(t *testing.T, out []byte) (string, []pgproto3.BackendMessage) {
+	var (
+		types []byte
+		msgs  []pgproto3.BackendMessage
+	)
+	for len(out) > 0 {
+		require.GreaterOrEqual(t, len(out), messageHeaderSize)
+		length := 1 + int(binary.BigEndian.Uint32(out[1:]))
+		require.GreaterOrEqual(t, len(out), length)
+		var msg pgproto3.BackendMessage
+		switch out[0] {
+		case rowDescriptionMessage:
+			msg = &pgproto3.RowDescription{}
+		case dataRowMessage:
+			msg = &pgproto3.DataRow{}
+		case commandCompleteMessage:
+			msg = &pgproto3.CommandComplete{}
+		case readyForQueryMessage:
+			msg = &pgproto3.ReadyForQuery{}
+		case errorResponseMessage:
+			msg = &pgproto3.ErrorResponse{}
+		case 'N':
+			msg = &pgproto3.NoticeResponse{}
+		case '1':
+			msg = &pgproto3.ParseComplete{}
+		case '2':
+			msg = &pgproto3.BindComplete{}
+		case 'n':
+			msg = &pgproto3.NoData{}
+		case 't':
+			msg = &pgproto3.ParameterDescription{}
+		default:
+			t.Fatalf("unexpected message %q", out[0])
+		}
+		require.NoError(t, msg.Decode(out[messageHeaderSize:length]))
+		types = append(types, out[0])
+		msgs = append(msgs, msg)
+		out = out[length:]
+	}
+	return string(types), msgs
+}
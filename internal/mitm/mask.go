@@ -0,0 +1,296 @@
+package mitm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/metadata"
+)
+
+const (
+	rowDescriptionMessage = 'T'
+
+	maskRedacted      = "********"
+	maskVisibleSuffix = 4
+	maskHashLength    = 16
+)
+
+// maskKey keys hashes of masked values so that they cannot be reversed by
+// hashing guesses. Hashes are stable until db-proxy restarts.
+var maskKey = newMaskKey()
+
+func newMaskKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// maskedField is the masking of a result column. An empty style leaves the
+// column as is.
+type maskedField struct {
+	style  string
+	oid    uint32
+	format int16
+}
+
+// describeMaskedFields resolves the columns of a result set and selects the
+// ones masked for the current request.
+func (m *MITM) describeMaskedFields(body []byte) []byte {
+	m.requests.mu.Lock()
+	r := m.requests.head()
+	var masks []abac.ColumnMask
+	if r != nil {
+		masks = r.masks
+	}
+	m.requests.mu.Unlock()
+	if len(masks) == 0 {
+		return rawMessage(rowDescriptionMessage, body)
+	}
+
+	var msg pgproto3.RowDescription
+	if err := msg.Decode(body); err != nil {
+		m.logger.Errorf("decode row description: %s", err)
+		m.setMaskedFields(nil)
+		return rawMessage(rowDescriptionMessage, body)
+	}
+	fields, masked := m.maskedFields(msg.Fields, masks)
+	data := m.setMaskedFields(fields)
+	m.notifyMasked(masked, data)
+	return rawMessage(rowDescriptionMessage, body)
+}
+
+// maskedFields selects the masked columns of a result set. Computed columns,
+// which may be derived from masked ones, and columns missing from the catalog
+// cache are fully masked.
+func (m *MITM) maskedFields(descriptions []pgproto3.FieldDescription, masks []abac.ColumnMask) ([]maskedField, []metadata.MaskedColumn) {
+	fields := make([]maskedField, 0, len(descriptions))
+	var masked []metadata.MaskedColumn
+	for _, field := range descriptions {
+		f := maskedField{oid: field.DataTypeOID, format: field.Format}
+		fields = append(fields, f)
+		if field.TableOID == 0 {
+			fields[len(fields)-1].style = abac.MaskFull
+			masked = append(masked, metadata.MaskedColumn{Column: string(field.Name), Style: abac.MaskFull})
+			continue
+		}
+		column, ok := m.catalog.column(field.TableOID, field.TableAttributeNumber)
+		if !ok {
+			m.logger.Errorf("resolve column %s: column %d of relation %d is not in the catalog", field.Name, field.TableAttributeNumber, field.TableOID)
+			fields[len(fields)-1].style = abac.MaskFull
+			masked = append(masked, metadata.MaskedColumn{Column: string(field.Name), Style: abac.MaskFull})
+			continue
+		}
+		for _, mask := range masks {
+			if mask.Matches(column.table, column.column) {
+				fields[len(fields)-1].style = mask.Style
+				masked = append(masked, metadata.MaskedColumn{
+					Table:  column.table,
+					Column: column.column,
+					Style:  mask.Style,
+					Rule:   mask.Rule,
+				})
+				break
+			}
+		}
+	}
+	return fields, masked
+}
+
+func (m *MITM) notifyMasked(masked []metadata.MaskedColumn, data metadata.Metadata) {
+	if len(masked) == 0 {
+		return
+	}
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-mask-event"), func(ctx context.Context) {
+		m.notifier.OnMask(masked, data)
+	})
+}
+
+// setMaskedFields sets the masking of the current result set and returns the
+// metadata of its request.
+func (m *MITM) setMaskedFields(fields []maskedField) metadata.Metadata {
+	m.requests.mu.Lock()
+	defer m.requests.mu.Unlock()
+	r := m.requests.head()
+	if r == nil {
+		return metadata.Metadata{}
+	}
+	r.maskedFields = fields
+	return r.data
+}
+
+// maskDataRow masks the values of a row. The columns of an Execute are resolved
+// at its first row from the Describe of its portal or statement. If the columns
+// of the result set are unknown, all values are replaced with NULL.
+func (m *MITM) maskDataRow(body []byte) []byte {
+	m.requests.mu.Lock()
+	var fields []maskedField
+	if r := m.requests.head(); r != nil {
+		if r.extended && r.maskedFields == nil {
+			var masked []metadata.MaskedColumn
+			r.maskedFields, masked = m.maskedFields(resultFields(r.portalColumns, r.statementColumns, r.resultFormats), r.masks)
+			m.notifyMasked(masked, r.data)
+		}
+		fields = r.maskedFields
+	}
+	m.requests.mu.Unlock()
+
+	var msg pgproto3.DataRow
+	if err := msg.Decode(body); err != nil {
+		m.logger.Errorf("decode data row: %s", err)
+		return nil
+	}
+	for i, value := range msg.Values {
+		if i >= len(fields) {
+			msg.Values[i] = nil
+			continue
+		}
+		if fields[i].style != "" {
+			msg.Values[i] = maskValue(fields[i], value)
+		}
+	}
+	out, err := msg.Encode(nil)
+	if err != nil {
+		m.logger.Errorf("encode data row: %s", err)
+		return nil
+	}
+	return out
+}
+
+// maskValue masks a value of a column. Styles that cannot keep a value valid
+// for its type replace it with NULL.
+func maskValue(field maskedField, value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	textual := isTextType(field.oid)
+	if field.format != textFormat && !textual {
+		return nil
+	}
+	switch {
+	case field.style == abac.MaskFormat && textual:
+		return preserveFormat(value, len(value), true)
+	case field.style == abac.MaskFormat && isNumericType(field.oid):
+		return preserveNumber(field.oid, value)
+	case !textual:
+		return nil
+	case field.style == abac.MaskFull:
+		return []byte(maskRedacted)
+	case field.style == abac.MaskPartial:
+		return maskPartial(value)
+	case field.style == abac.MaskHash:
+		sum := keyedHash(value, 0)
+		return []byte(hex.EncodeToString(sum[:maskHashLength]))
+	default:
+		return nil
+	}
+}
+
+// maskPartial keeps the last maskVisibleSuffix characters of a value.
+func maskPartial(value []byte) []byte {
+	runes := []rune(string(value))
+	visible := max(len(runes)-maskVisibleSuffix, 0)
+	return []byte(strings.Repeat("*", visible) + string(runes[visible:]))
+}
+
+// preserveFormat replaces the digits and, if letters is set, the ASCII letters
+// of the first n bytes of the value with ones derived from the keyed hash of
+// the value, keeping the length, letter case and punctuation. Equal values are
+// masked equally.
+func preserveFormat(value []byte, n int, letters bool) []byte {
+	out := make([]byte, 0, len(value))
+	var (
+		stream []byte
+		block  uint32
+	)
+	for rest := value[:n]; len(rest) > 0; {
+		r, size := utf8.DecodeRune(rest)
+		if len(stream) == 0 {
+			sum := keyedHash(value, block)
+			stream = sum[:]
+			block++
+		}
+		b := stream[0]
+		switch {
+		case '0' <= r && r <= '9':
+			out = append(out, '0'+b%10)
+			stream = stream[1:]
+		case letters && 'a' <= r && r <= 'z':
+			out = append(out, 'a'+b%26)
+			stream = stream[1:]
+		case letters && 'A' <= r && r <= 'Z':
+			out = append(out, 'A'+b%26)
+			stream = stream[1:]
+		default:
+			out = append(out, rest[:size]...)
+		}
+		rest = rest[size:]
+	}
+	return append(out, value[n:]...)
+}
+
+// preserveNumber masks the digits of a number in the text format. Letters, as
+// in NaN and Infinity, and the exponent are kept, so the value stays valid, and
+// integers are reduced to the range of their type.
+func preserveNumber(oid uint32, value []byte) []byte {
+	n := len(value)
+	if i := bytes.IndexAny(value, "eE"); i >= 0 {
+		n = i
+	}
+	out := preserveFormat(value, n, false)
+	bits, ok := integerBits[oid]
+	if !ok {
+		return out
+	}
+	if _, err := strconv.ParseInt(string(out), 10, bits); err == nil {
+		return out
+	}
+	number, ok := new(big.Int).SetString(string(out), 10)
+	if !ok {
+		return nil
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits-1))
+	negative := number.Sign() < 0
+	number.Mod(number.Abs(number), limit)
+	if negative {
+		number.Neg(number)
+	}
+	return []byte(number.String())
+}
+
+func keyedHash(value []byte, block uint32) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, maskKey)
+	var counter [4]byte
+	binary.BigEndian.PutUint32(counter[:], block)
+	mac.Write(counter[:])
+	mac.Write(value)
+	var sum [sha256.Size]byte
+	mac.Sum(sum[:0])
+	return sum
+}
+
+func isTextType(oid uint32) bool {
+	return slices.Contains([]uint32{textOID, varcharOID, bpcharOID, nameOID}, oid)
+}
+
+// integerBits are the sizes of the integer types.
+var integerBits = map[uint32]int{int2OID: 16, int4OID: 32, int8OID: 64}
+
+func isNumericType(oid uint32) bool {
+	return slices.Contains([]uint32{int2OID, int4OID, int8OID, float4OID, float8OID, numericOID}, oid)
+}
@@ -0,0 +1,211 @@
+package mitm
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/abac"
+)
+
+func TestMaskValue(t *testing.T) {
+	text := func(style string) maskedField { return maskedField{style: style, oid: textOID} }
+
+	t.Run("full", func(t *testing.T) {
+		require.Equal(t, []byte(maskRedacted), maskValue(text(abac.MaskFull), []byte("alice@example.com")))
+		require.Nil(t, maskValue(maskedField{style: abac.MaskFull, oid: int4OID}, []byte("42")))
+		require.Nil(t, maskValue(text(abac.MaskFull), nil))
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		require.Equal(t, []byte("************1111"), maskValue(text(abac.MaskPartial), []byte("4111111111111111")))
+		require.Equal(t, []byte("****лана"), maskValue(text(abac.MaskPartial), []byte("Светлана")))
+		require.Equal(t, []byte("abc"), maskValue(text(abac.MaskPartial), []byte("abc")))
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		hashed := maskValue(text(abac.MaskHash), []byte("alice"))
+		require.Len(t, hashed, 2*maskHashLength)
+		require.Equal(t, hashed, maskValue(text(abac.MaskHash), []byte("alice")))
+		require.NotEqual(t, hashed, maskValue(text(abac.MaskHash), []byte("bob")))
+	})
+
+	t.Run("format", func(t *testing.T) {
+		masked := maskValue(text(abac.MaskFormat), []byte("+1 (555) 010-99 Ab"))
+		require.Regexp(t, `^\+\d \(\d{3}\) \d{3}-\d{2} [A-Z][a-z]$`, string(masked))
+		require.Equal(t, masked, maskValue(text(abac.MaskFormat), []byte("+1 (555) 010-99 Ab")))
+
+		number := maskValue(maskedField{style: abac.MaskFormat, oid: numericOID}, []byte("-1234.50"))
+		require.Regexp(t, `^-\d{4}\.\d{2}$`, string(number))
+		require.Nil(t, maskValue(maskedField{style: abac.MaskFormat, oid: int4OID, format: binaryFormat}, []byte{0, 0, 0, 42}))
+
+		float := func(value string) string {
+			return string(maskValue(maskedField{style: abac.MaskFormat, oid: float8OID}, []byte(value)))
+		}
+		require.Equal(t, "NaN", float("NaN"))
+		require.Equal(t, "-Infinity", float("-Infinity"))
+		require.Regexp(t, `^\d\.\d{2}e\+10$`, float("1.25e+10"))
+
+		for oid, bits := range integerBits {
+			for _, value := range []string{"32767", "-32768", "99999", "-99999", "2147483647", "9223372036854775807", "-9223372036854775808"} {
+				masked := maskValue(maskedField{style: abac.MaskFormat, oid: oid}, []byte(value))
+				_, err := strconv.ParseInt(string(masked), 10, bits)
+				require.NoError(t, err, "%s in %d bits", value, bits)
+			}
+		}
+	})
+}
+
+func TestMaskDataRows(t *testing.T) {
+	const usersOID = 16384
+	rules := map[string]*abac.Rule{
+		"pii": {
+			Conditions: []abac.Condition{&abac.QueryCondition{TableRegexps: []string{"^users$"}, ColumnRegexps: []string{"^email$"}}},
+			Actions:    abac.Mask,
+			Mask:       abac.MaskFull,
+		},
+	}
+	rulesABAC, err := abac.New(rules)
+	require.NoError(t, err)
+
+	stream := encodeBackend(t,
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+			{Name: []byte("id"), TableOID: usersOID, TableAttributeNumber: 1, DataTypeOID: int4OID},
+			{Name: []byte("email"), TableOID: usersOID, TableAttributeNumber: 2, DataTypeOID: textOID},
+			{Name: []byte("upper"), DataTypeOID: textOID},
+			{Name: []byte("added"), TableOID: usersOID, TableAttributeNumber: 3, DataTypeOID: textOID},
+		}},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte("alice@example.com"), []byte("ALICE"), []byte("x")}},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+
+	for _, chunkSize := range []int{1, 5, len(stream)} {
+		m := newTestMITM(t)
+		// The catalog has no connection: a column missing from the cache is
+		// masked without querying the server.
+		m.catalog = &catalog{columns: map[catalogKey]catalogColumn{
+			{usersOID, 1}: {table: "users", column: "id"},
+			{usersOID, 2}: {table: "users", column: "email"},
+		}}
+		m.requests.push(&request{masks: rulesABAC.Masks([]string{"pii"})})
+
+		_, msgs := decodeBackend(t, scanBackend(m, stream, chunkSize))
+		var rows [][][]byte
+		for _, msg := range msgs {
+			if msg, ok := msg.(*pgproto3.DataRow); ok {
+				rows = append(rows, msg.Values)
+			}
+		}
+		require.Equal(t, [][][]byte{{[]byte("1"), []byte(maskRedacted), []byte(maskRedacted), []byte(maskRedacted)}}, rows, "chunk size %d", chunkSize)
+	}
+}
+
+func TestMaskExecute(t *testing.T) {
+	const usersOID = 16384
+	rulesABAC, err := abac.New(map[string]*abac.Rule{
+		"pii": {
+			Conditions: []abac.Condition{&abac.QueryCondition{TableRegexps: []string{"^users$"}, ColumnRegexps: []string{"^email$"}, Strict: true}},
+			Actions:    abac.Mask,
+			Mask:       abac.MaskFull,
+		},
+	})
+	require.NoError(t, err)
+	newMITM := func(t *testing.T) *MITM {
+		m := newTestMITM(t)
+		m.abac = rulesABAC
+		m.catalog = &catalog{tables: map[string]bool{"users": true}, columns: map[catalogKey]catalogColumn{
+			{usersOID, 1}: {table: "users", column: "id"},
+			{usersOID, 2}: {table: "users", column: "email"},
+		}}
+		return m
+	}
+	// send handles a client message and queues it as proxyClientToServer does.
+	send := func(t *testing.T, m *MITM, msg pgproto3.FrontendMessage) error {
+		err := m.handleMessage(msg)
+		if err != nil {
+			return err
+		}
+		switch msg.(type) {
+		case *pgproto3.Execute, *pgproto3.Describe:
+			m.requests.push(m.lastRequest)
+		case *pgproto3.Sync:
+			m.requests.push(&request{sync: true})
+		}
+		return nil
+	}
+	description := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+		{Name: []byte("id"), TableOID: usersOID, TableAttributeNumber: 1, DataTypeOID: int4OID},
+		{Name: []byte("email"), TableOID: usersOID, TableAttributeNumber: 2, DataTypeOID: textOID},
+	}}
+	row := &pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte("alice@example.com")}}
+	rows := func(msgs []pgproto3.BackendMessage) [][][]byte {
+		var rows [][][]byte
+		for _, msg := range msgs {
+			if msg, ok := msg.(*pgproto3.DataRow); ok {
+				rows = append(rows, msg.Values)
+			}
+		}
+		return rows
+	}
+	masked := [][][]byte{{[]byte("1"), []byte(maskRedacted)}}
+
+	t.Run("statement described before bind", func(t *testing.T) {
+		m := newMITM(t)
+		require.NoError(t, send(t, m, &pgproto3.Parse{Name: "s1", Query: "SELECT id, email FROM users"}))
+		require.NoError(t, send(t, m, &pgproto3.Describe{ObjectType: statementObject, Name: "s1"}))
+		require.NoError(t, send(t, m, &pgproto3.Sync{}))
+		types, _ := decodeBackend(t, scanBackend(m, encodeBackend(t,
+			&pgproto3.ParseComplete{},
+			&pgproto3.ParameterDescription{},
+			description,
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		), 3))
+		require.Equal(t, "1tTZ", types)
+
+		require.NoError(t, send(t, m, &pgproto3.Bind{PreparedStatement: "s1", ResultFormatCodes: []int16{textFormat}}))
+		require.NoError(t, send(t, m, &pgproto3.Execute{}))
+		require.NoError(t, send(t, m, &pgproto3.Sync{}))
+		_, msgs := decodeBackend(t, scanBackend(m, encodeBackend(t,
+			&pgproto3.BindComplete{},
+			row,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		), 3))
+		require.Equal(t, masked, rows(msgs))
+		require.Empty(t, m.requests.requests)
+	})
+
+	t.Run("portal described", func(t *testing.T) {
+		m := newMITM(t)
+		require.NoError(t, send(t, m, &pgproto3.Parse{Query: "SELECT id, email FROM users"}))
+		require.NoError(t, send(t, m, &pgproto3.Bind{}))
+		require.NoError(t, send(t, m, &pgproto3.Describe{ObjectType: portalObject}))
+		require.NoError(t, send(t, m, &pgproto3.Execute{}))
+		require.NoError(t, send(t, m, &pgproto3.Sync{}))
+		types, msgs := decodeBackend(t, scanBackend(m, encodeBackend(t,
+			&pgproto3.ParseComplete{},
+			&pgproto3.BindComplete{},
+			description,
+			row,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		), 5))
+		require.Equal(t, "12TDCZ", types)
+		require.Equal(t, masked, rows(msgs))
+		require.Empty(t, m.requests.requests)
+	})
+
+	t.Run("not described", func(t *testing.T) {
+		m := newMITM(t)
+		require.NoError(t, send(t, m, &pgproto3.Parse{Name: "s1", Query: "SELECT id, email FROM users"}))
+		require.NoError(t, send(t, m, &pgproto3.Bind{PreparedStatement: "s1"}))
+		require.ErrorIs(t, send(t, m, &pgproto3.Execute{}), ErrUserPermissionDenied)
+
+		require.NoError(t, send(t, m, &pgproto3.Parse{Name: "s2", Query: "SELECT id FROM orders"}))
+		require.NoError(t, send(t, m, &pgproto3.Bind{PreparedStatement: "s2"}))
+		require.NoError(t, send(t, m, &pgproto3.Execute{}))
+	})
+}
@@ -3,7 +3,6 @@ package mitm
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -11,7 +10,9 @@ import (
 	"runtime/pprof"
 	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgproto3/v2"
@@ -22,12 +23,15 @@ import (
 	"ssh-db-proxy/internal/certissuer"
 	"ssh-db-proxy/internal/metadata"
 	"ssh-db-proxy/internal/notifier"
+	"ssh-db-proxy/internal/rolemap"
 	"ssh-db-proxy/internal/sql"
+	"ssh-db-proxy/internal/upstream"
 )
 
 const (
 	txStatusIdle = 'I'
 	notUseSSL    = 'N'
+	warningCode  = "01000"
 
 	bufferSize = 512 * 1024 // 512kb
 )
@@ -37,21 +41,26 @@ var (
 	ErrDisconnectUser       = errors.New("disconnect user")
 	ErrCancelledRequest     = errors.New("cancelled request")
 	ErrTerminateMessage     = errors.New("terminate message")
+	ErrMFARequired          = errors.New("MFA required")
 )
 
 type MITM struct {
 	metadata metadata.Metadata
 
-	users []string
+	grants     rolemap.Grants
+	attributes map[string]string
+	readOnly   bool
 
 	backend  *Backend
 	frontend *Frontend
 
-	serverHost string
-	serverPort uint32
+	database *upstream.Database
+
+	cancelKeys      *CancelKeys
+	clientProcessID uint32
 
 	certIssuer *certissuer.CertIssuer
-	caCertPool *x509.CertPool
+	clientTLS  ClientTLS
 
 	notifier *notifier.Notifier
 	abac     *abac.ABAC
@@ -59,39 +68,86 @@ type MITM struct {
 	logger *zap.SugaredLogger
 
 	isHalfClosed atomic.Bool
+
+	timeouts        Timeouts
+	scanner         backendScanner
+	txStatus        atomic.Uint32
+	pendingRequests atomic.Int64
+	idleSince       atomic.Int64
+	lastActivity    atomic.Int64
+
+	// mu guards terminated, frontend and the metadata fields set while the
+	// session is established, which Terminate reads from another goroutine.
+	mu         sync.Mutex
+	terminated error
+
+	clientMu       sync.Mutex
+	pendingNotices []pgproto3.BackendMessage
+
+	extended    extendedQueries
+	requests    requestQueue
+	lastRequest *request
+	dropRow     bool
+	catalog     *catalog
+
+	namedQueries map[sql.NamedQuery][]sql.QueryStatement
+
+	copyMu        sync.Mutex
+	copy          *copyOperation
+	lastCopyQuery copyQuery
 }
 
-func NewMITM(metadata metadata.Metadata, users []string, conn net.Conn, targetHost string, targetPort uint32, certIssuer *certissuer.CertIssuer, caCertPool *x509.CertPool, notifier *notifier.Notifier, abac *abac.ABAC, logger *zap.SugaredLogger) (*MITM, error) {
+func NewMITM(metadata metadata.Metadata, grants rolemap.Grants, attributes map[string]string, conn net.Conn, database *upstream.Database, cancelKeys *CancelKeys, certIssuer *certissuer.CertIssuer, clientTLS ClientTLS, notifier *notifier.Notifier, abac *abac.ABAC, timeouts Timeouts, logger *zap.SugaredLogger) (*MITM, error) {
 	if logger == nil {
 		logger = zap.NewNop().Sugar()
 	}
+	metadata.UpstreamAuth = database.Auth
 	m := &MITM{
 		metadata:   metadata,
-		users:      users,
+		grants:     grants,
+		attributes: attributes,
 		backend:    &Backend{Conn: conn},
-		serverHost: targetHost,
-		serverPort: targetPort,
+		database:   database,
+		cancelKeys: cancelKeys,
 		certIssuer: certIssuer,
-		caCertPool: caCertPool,
+		clientTLS:  clientTLS,
 		notifier:   notifier,
 		abac:       abac,
+		timeouts:   timeouts,
 		logger:     logger,
+		extended:   newExtendedQueries(),
 	}
 	m.backend.Backend = pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	m.scanner.onReadyForQuery = m.onReadyForQuery
+	m.scanner.onMessage = m.onBackendMessage
+	m.scanner.intercept = m.interceptBackendMessage
+	m.scanner.rewrite = m.rewriteBackendMessage
+	m.txStatus.Store(txStatusIdle)
+	m.idleSince.Store(time.Now().UnixNano())
+	m.touch()
 	return m, nil
 }
 
 func (m *MITM) Proxy(ctx context.Context) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go pprof.Do(watchCtx, pprof.Labels("name", "mitm-timeouts"), func(ctx context.Context) {
+		m.watchTimeouts(ctx)
+	})
+
 	parameters, err := m.receiveStartupMessage()
 	if err != nil {
-		if errors.Is(err, ErrCancelledRequest) {
+		if errors.Is(err, ErrCancelledRequest) || m.isTerminated() {
 			return nil
 		}
 		return fmt.Errorf("receive startup message: %w", err)
 	}
 	if err := m.connectToDatabase(ctx, parameters); err != nil {
+		if m.isTerminated() {
+			return nil
+		}
 		if errors.Is(err, ErrUserPermissionDenied) || errors.Is(err, ErrDisconnectUser) {
-			if err := m.backend.Send(&pgproto3.ErrorResponse{Code: "403", Message: "Permission Denied"}); err != nil {
+			if err := m.backend.Send(permissionDenied("FATAL")); err != nil {
 				return fmt.Errorf("send permission denied message: %w", err)
 			}
 			if errors.Is(err, ErrDisconnectUser) {
@@ -99,8 +155,18 @@ func (m *MITM) Proxy(ctx context.Context) error {
 			}
 			return nil
 		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if err := m.sendToClient(&pgproto3.ErrorResponse{Severity: pgErr.Severity, Code: pgErr.Code, Message: pgErr.Message}); err != nil {
+				return fmt.Errorf("send database error: %w", err)
+			}
+		}
 		return fmt.Errorf("connect to database: %w", err)
 	}
+	defer func() {
+		m.cancelKeys.Unregister(m.clientProcessID)
+		m.catalog.close()
+	}()
 	if err := m.prepareClient(); err != nil {
 		return fmt.Errorf("prepare client: %w", err)
 	}
@@ -125,6 +191,10 @@ func (m *MITM) Proxy(ctx context.Context) error {
 		return nil
 	})
 	err = wg.Wait()
+	m.failPendingRequests()
+	if m.isTerminated() {
+		return nil
+	}
 	if err != nil && !errors.Is(err, io.EOF) {
 		m.logger.Error(err)
 	}
@@ -135,20 +205,66 @@ func (m *MITM) Proxy(ctx context.Context) error {
 }
 
 func (m *MITM) prepareClient() error {
-	if err := m.backend.Send(&pgproto3.AuthenticationOk{}); err != nil {
+	if err := m.sendToClient(&pgproto3.AuthenticationOk{}); err != nil {
 		return fmt.Errorf("sending auth ok message: %w", err)
 	}
-	if err := m.backend.Send(&pgproto3.BackendKeyData{ProcessID: m.frontend.ProcessID, SecretKey: m.frontend.SecretKey}); err != nil {
+	processID, secretKey, err := m.cancelKeys.Register(m.database, m.frontend.ProcessID, m.frontend.SecretKey)
+	if err != nil {
+		return err
+	}
+	m.clientProcessID = processID
+	if err := m.sendToClient(&pgproto3.BackendKeyData{ProcessID: processID, SecretKey: secretKey}); err != nil {
 		return fmt.Errorf("sending backend key data: %w", err)
 	}
 	for name, value := range m.frontend.ParameterStatuses {
-		if err := m.backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value}); err != nil {
+		if err := m.sendToClient(&pgproto3.ParameterStatus{Name: name, Value: value}); err != nil {
 			return fmt.Errorf("sending parameter status %s: %w", name, err)
 		}
 	}
-	if err := m.backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatusIdle}); err != nil {
+	if err := m.sendToClient(&pgproto3.ReadyForQuery{TxStatus: txStatusIdle}); err != nil {
 		return fmt.Errorf("sending ready for query: %w", err)
 	}
+	m.idleSince.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Notice sends the client a NoticeResponse. If the server is in the middle of
+// a message, the notice is delayed until the message is forwarded.
+func (m *MITM) Notice(message string) {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	m.pendingNotices = append(m.pendingNotices, &pgproto3.NoticeResponse{
+		Severity: "WARNING",
+		Code:     warningCode,
+		Message:  message,
+	})
+	if !m.scanner.AtBoundary() {
+		return
+	}
+	if err := m.flushNotices(); err != nil {
+		m.logger.Errorf("send notice: %s", err)
+	}
+}
+
+func (m *MITM) flushNotices() error {
+	notices := m.pendingNotices
+	m.pendingNotices = nil
+	for _, notice := range notices {
+		if err := m.backend.Send(notice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MITM) sendToClient(msgs ...pgproto3.BackendMessage) error {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	for _, msg := range msgs {
+		if err := m.backend.Send(msg); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -173,9 +289,25 @@ func (m *MITM) receiveStartupMessage() (map[string]string, error) {
 			go pprof.Do(context.Background(), pprof.Labels("name", "on-ssl-request-event"), func(ctx context.Context) {
 				m.notifier.OnSSLRequest(msgV, m.metadata)
 			})
-			if _, err := m.backend.Write([]byte{notUseSSL}); err != nil {
+			if m.metadata.ClientTLS != nil {
+				return nil, fmt.Errorf("unexpected SSL request over TLS")
+			}
+			tlsConfig, certificate, err := m.clientTLSConfig()
+			if err != nil {
+				m.logger.Errorf("client TLS config: %s", err)
+			}
+			if tlsConfig == nil {
+				if _, err := m.backend.Write([]byte{notUseSSL}); err != nil {
+					return nil, fmt.Errorf("write SSL request: %w", err)
+				}
+				continue
+			}
+			if _, err := m.backend.Write([]byte{useSSL}); err != nil {
 				return nil, fmt.Errorf("write SSL request: %w", err)
 			}
+			if err := m.startClientTLS(tlsConfig, certificate); err != nil {
+				return nil, err
+			}
 		case *pgproto3.GSSEncRequest:
 			msgV := *msg
 			go pprof.Do(context.Background(), pprof.Labels("name", "on-gss-enc-request-event"), func(ctx context.Context) {
@@ -186,8 +318,12 @@ func (m *MITM) receiveStartupMessage() (map[string]string, error) {
 			}
 		case *pgproto3.CancelRequest:
 			msgV := *msg
+			cancelErr := m.cancelKeys.Cancel(context.Background(), msgV)
+			if cancelErr != nil {
+				m.logger.Infow("cancel request not forwarded", "err", cancelErr)
+			}
 			go pprof.Do(context.Background(), pprof.Labels("name", "on-cancel-request-event"), func(ctx context.Context) {
-				m.notifier.OnCancelRequest(msgV, m.metadata)
+				m.notifier.OnCancelRequest(msgV, cancelErr, m.metadata)
 			})
 			return nil, ErrCancelledRequest
 		default:
@@ -206,11 +342,13 @@ func (m *MITM) proxyClientToServer() error {
 		msg, err := m.backend.Receive()
 		if err != nil {
 			m.isHalfClosed.Store(true)
-			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || m.isTerminated() {
 				return nil
 			}
 			return fmt.Errorf("receive from client: %w", err)
 		}
+		m.touch()
+		m.idleSince.Store(time.Now().UnixNano())
 		if err = m.handleMessage(msg); err != nil {
 			if errors.Is(err, ErrTerminateMessage) {
 				if err := m.frontend.Send(&pgproto3.Terminate{}); err != nil {
@@ -219,25 +357,32 @@ func (m *MITM) proxyClientToServer() error {
 				return nil
 			}
 			if errors.Is(err, ErrUserPermissionDenied) {
-				if err := m.backend.Send(&pgproto3.ErrorResponse{Code: "403", Message: "Query is not permitted by administrator"}); err != nil {
-					return err
-				}
-				if err := m.backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatusIdle}); err != nil {
-					return err
-				}
-				continue
+				msg = m.deny(msg)
 			}
 			if errors.Is(err, ErrDisconnectUser) {
 				m.isHalfClosed.Store(true)
 				if err := m.frontend.Send(&pgproto3.Terminate{}); err != nil {
 					return err
 				}
-				if err := m.backend.Send(&pgproto3.ErrorResponse{Code: "403", Message: "Query is not permitted by administrator"}); err != nil {
+				if err := m.sendToClient(permissionDenied("FATAL")); err != nil {
 					return err
 				}
 				return ErrDisconnectUser
 			}
 		}
+		switch msg.(type) {
+		case *pgproto3.Query, *pgproto3.Sync:
+			m.pendingRequests.Add(1)
+		}
+		switch msg.(type) {
+		case *pgproto3.Query, *pgproto3.Execute:
+			m.requests.push(m.lastRequest)
+			m.watchDuration(m.lastRequest)
+		case *pgproto3.Describe:
+			m.requests.push(m.lastRequest)
+		case *pgproto3.Sync:
+			m.requests.push(&request{sync: true})
+		}
 		if err := m.frontend.Send(msg); err != nil {
 			return fmt.Errorf("send to server: %w", err)
 		}
@@ -259,7 +404,19 @@ func (m *MITM) proxyServerToClient() error {
 			}
 			return fmt.Errorf("receive from server: %w", err)
 		}
-		if _, err := m.backend.Write(b[:n]); err != nil {
+		m.touch()
+		m.clientMu.Lock()
+		if out := m.scanner.Scan(b[:n]); len(out) > 0 {
+			_, err = m.backend.Write(out)
+		}
+		if err == nil && len(m.pendingNotices) > 0 && m.scanner.AtBoundary() {
+			err = m.flushNotices()
+		}
+		m.clientMu.Unlock()
+		if err != nil {
+			if m.isTerminated() {
+				return nil
+			}
 			return fmt.Errorf("send to client: %w", err)
 		}
 	}
@@ -269,21 +426,43 @@ func (m *MITM) handleMessage(msg pgproto3.FrontendMessage) error {
 	switch msg := msg.(type) {
 	case *pgproto3.Query:
 		msgV := *msg
+		m.lastRequest = m.newRequest(msgV.String, false)
+		data := m.lastRequest.data
 		go pprof.Do(context.Background(), pprof.Labels("name", "on-query-message-event"), func(ctx context.Context) {
-			m.notifier.OnQueryMessage(msgV, m.metadata)
+			m.notifier.OnQueryMessage(msgV, data)
 		})
-		return m.onQuery(msgV.String)
+		if err := m.onQuery(m.lastRequest); err != nil {
+			return err
+		}
+		if rewritten := m.lastRequest.data.RewrittenQuery; rewritten != "" {
+			msg.String = rewritten
+		}
+		return nil
 	case *pgproto3.Parse:
 		msgV := *msg
 		go pprof.Do(context.Background(), pprof.Labels("name", "on-parse-message-event"), func(ctx context.Context) {
 			m.notifier.OnParseMessage(msgV, m.metadata)
 		})
-		return m.onQuery(msgV.Query)
+		rowFiltered, err := m.onParse(msg)
+		if err != nil {
+			if msg.Name == "" {
+				// The server drops the unnamed statement before parsing the
+				// new one, so it is gone even though the denied Parse fails.
+				m.extended.close(&pgproto3.Close{ObjectType: statementObject})
+			}
+			return err
+		}
+		m.extended.parse(&msgV)
+		if rowFiltered {
+			m.extended.setRowFiltered(msg.Name, msg.Query, msg.Query != msgV.Query)
+		}
+		return nil
 	case *pgproto3.Bind:
 		msgV := *msg
-		go pprof.Do(context.Background(), pprof.Labels("name", "on-parse-message-event"), func(ctx context.Context) {
+		go pprof.Do(context.Background(), pprof.Labels("name", "on-bind-message-event"), func(ctx context.Context) {
 			m.notifier.OnBindMessage(msgV, m.metadata)
 		})
+		m.extended.bind(msg)
 		return nil
 	case *pgproto3.Sync:
 		msgV := *msg
@@ -293,15 +472,41 @@ func (m *MITM) handleMessage(msg pgproto3.FrontendMessage) error {
 		return nil
 	case *pgproto3.Execute:
 		msgV := *msg
+		p, ok := m.extended.portal(msg.Portal)
+		m.lastRequest = m.newRequest(p.statement.query, true)
+		m.lastRequest.data.RewrittenQuery = p.statement.rewritten
+		m.lastRequest.rowFiltered = p.statement.rowFiltered
+		data := m.lastRequest.data
 		go pprof.Do(context.Background(), pprof.Labels("name", "on-execute-message-event"), func(ctx context.Context) {
-			m.notifier.OnExecuteMessage(msgV, m.metadata)
+			m.notifier.OnExecuteMessage(msgV, p.statementName, p.parameters, data)
 		})
+		if !ok {
+			// The portal was not bound by a tracked statement, so it cannot be
+			// checked.
+			return fmt.Errorf("%w: unknown portal %q", ErrUserPermissionDenied, msg.Portal)
+		}
+		m.lastRequest.rowLimit = p.rowLimit
+		m.lastRequest.portalColumns = p.columns
+		m.lastRequest.statementColumns = p.statement.columns
+		m.lastRequest.resultFormats = p.resultFormats
+		m.lastRequest.columnsDescribed = p.described()
+		if err := m.onQuery(m.lastRequest); err != nil {
+			return err
+		}
+		m.extended.setRowLimit(msg.Portal, m.lastRequest.rowLimit)
+		return nil
+	case *pgproto3.Close:
+		m.extended.close(msg)
 		return nil
 	case *pgproto3.Describe:
 		msgV := *msg
 		go pprof.Do(context.Background(), pprof.Labels("name", "on-describe-message-event"), func(ctx context.Context) {
 			m.notifier.OnDescribeMessage(msgV, m.metadata)
 		})
+		m.lastRequest = &request{extended: true, describe: true, describes: m.extended.describe(msg)}
+		return nil
+	case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+		m.onClientCopyMessage(msg)
 		return nil
 	case *pgproto3.Terminate:
 		msgV := *msg
@@ -314,34 +519,99 @@ func (m *MITM) handleMessage(msg pgproto3.FrontendMessage) error {
 	}
 }
 
-func (m *MITM) onQuery(query string) error {
-	queryStatements, err := sql.ExtractQueryStatements(query)
+func (m *MITM) onQuery(r *request) error {
+	if err := m.checkReadOnly(r); err != nil {
+		return err
+	}
+	query := r.data.Query
+	queryStatements, err := m.queryStatements(query)
 	if err != nil {
 		m.logger.Errorf("extract query statements: %s", err)
 		return nil
 	}
-	stateID := m.abac.NewStateFrom(m.metadata.StateID, nil)
-	defer m.abac.DeleteState(stateID)
-
-	actions, rules, err := m.abac.Observe(stateID, abac.QueryStatementsEvent(queryStatements))
+	m.rememberCopyQuery(query, queryStatements)
+	actions, rules, err := m.observeQuery(queryStatements)
 	if err != nil {
 		m.logger.Errorf("observe query statements: %s", err)
 	}
-	var data metadata.Metadata
-	if actions > 0 {
-		data = m.metadata.Copy()
-		for _, statement := range queryStatements {
-			data.QueryStatements = append(data.QueryStatements, metadata.QueryStatement{
-				StatementType: sql.StringByStatementType[statement.Type],
-				Table:         statement.Table,
-				Column:        statement.Column,
-			})
-		}
-		data.Query = query
-	}
+	data := m.queryMetadata(actions, query, queryStatements)
+	data.QueryID = r.data.QueryID
 	if actions&abac.Notify > 0 {
 		m.notifier.OnNotify("query statements observed", rules, data)
 	}
+	if err := m.enforceQueryPolicy(actions, rules, data); err != nil {
+		return err
+	}
+	if actions&abac.FilterRows > 0 {
+		if r.extended && !r.rowFiltered {
+			if actions&abac.Notify > 0 {
+				m.notifier.OnNotify("statement prepared without row filters was not permitted", rules, data)
+			}
+			return ErrUserPermissionDenied
+		}
+		if !r.extended {
+			if err := m.rewriteQuery(r, rules); err != nil {
+				if actions&abac.Notify > 0 {
+					m.notifier.OnNotify("query could not be filtered and was not permitted", rules, data)
+				}
+				return err
+			}
+		}
+	}
+	if actions&abac.Mask > 0 {
+		r.masks = m.abac.Masks(rules)
+		if len(r.masks) > 0 && slices.ContainsFunc(queryStatements, func(statement sql.QueryStatement) bool {
+			return statement.Type == sql.CopyOut
+		}) {
+			if actions&abac.Notify > 0 {
+				m.notifier.OnNotify("COPY TO was not permitted because of masked columns", rules, data)
+			}
+			return ErrUserPermissionDenied
+		}
+		if len(r.masks) > 0 && r.extended && !r.columnsDescribed {
+			if actions&abac.Notify > 0 {
+				m.notifier.OnNotify("portal without described columns was not permitted because of masked columns", rules, data)
+			}
+			return ErrUserPermissionDenied
+		}
+		if len(r.masks) > 0 {
+			if err := m.catalog.prefetch(statementTables(queryStatements)); err != nil {
+				m.logger.Errorf("prefetch catalog: %s", err)
+			}
+		}
+	}
+	if actions&abac.MaxDuration > 0 {
+		r.durationLimit = m.abac.MaxDuration(rules)
+	}
+	if actions&abac.MaxRows > 0 && r.rowLimit == nil {
+		if maxRows := m.abac.MaxRows(rules); maxRows > 0 {
+			r.rowLimit = &rowLimit{max: maxRows}
+		}
+	}
+	return nil
+}
+
+// queryMetadata returns the metadata of notifications about the query if any
+// action matched it.
+func (m *MITM) queryMetadata(actions abac.Action, query string, statements []sql.QueryStatement) metadata.Metadata {
+	if actions == 0 {
+		return metadata.Metadata{}
+	}
+	data := m.metadata.Copy()
+	for _, statement := range statements {
+		data.QueryStatements = append(data.QueryStatements, metadata.QueryStatement{
+			StatementType: sql.StringByStatementType[statement.Type],
+			Table:         statement.Table,
+			Column:        statement.Column,
+		})
+	}
+	data.Query = query
+	return data
+}
+
+// enforceQueryPolicy disconnects the user or denies the query if the matched
+// actions say so.
+func (m *MITM) enforceQueryPolicy(actions abac.Action, rules []string, data metadata.Metadata) error {
 	if actions&abac.Disconnect > 0 {
 		if err := m.frontend.Send(&pgproto3.Terminate{}); err != nil {
 			return err
@@ -357,9 +627,21 @@ func (m *MITM) onQuery(query string) error {
 		}
 		return ErrUserPermissionDenied
 	}
+	if actions&abac.RequireMFA > 0 && !m.metadata.MFA {
+		if actions&abac.Notify > 0 {
+			m.notifier.OnNotify("query was not permitted without MFA", rules, data)
+		}
+		return fmt.Errorf("%w: %w", ErrUserPermissionDenied, ErrMFARequired)
+	}
 	return nil
 }
 
+func (m *MITM) observeQuery(statements []sql.QueryStatement) (abac.Action, []string, error) {
+	stateID := m.abac.NewStateFrom(m.metadata.StateID, nil)
+	defer m.abac.DeleteState(stateID)
+	return m.abac.Observe(stateID, abac.QueryStatementsEvent(statements))
+}
+
 func (m *MITM) connectToDatabase(ctx context.Context, frontendParameters map[string]string) error {
 	if frontendParameters == nil {
 		return fmt.Errorf("missing frontend parameters")
@@ -375,7 +657,7 @@ func (m *MITM) connectToDatabase(ctx context.Context, frontendParameters map[str
 	}
 
 	var authError error
-	if !slices.Contains(m.users, user) {
+	if !m.grants.Allows(m.database.Name, user) {
 		authError = fmt.Errorf("%w: forbidden username", ErrUserPermissionDenied)
 	}
 	go pprof.Do(context.Background(), pprof.Labels("name", "on-database-auth"), func(ctx context.Context) {
@@ -389,29 +671,26 @@ func (m *MITM) connectToDatabase(ctx context.Context, frontendParameters map[str
 		return err
 	}
 
-	cert, err := m.certIssuer.Issue(user)
+	config, err := m.databaseConfig(user)
 	if err != nil {
-		return fmt.Errorf("issue certificate: %w", err)
+		return err
 	}
-
-	config, err := pgconn.ParseConfig(fmt.Sprintf("postgres://%s:%d?sslmode=verify-full", m.serverHost, m.serverPort))
-	if err != nil {
+	if err := m.setPassword(config, user); err != nil {
 		return err
 	}
 
 	config.User = user
 	config.Database = database
 	config.RuntimeParams = frontendParameters
+	if m.readOnly {
+		config.RuntimeParams = readOnlyRuntimeParams(frontendParameters)
+	}
+	m.catalog = newCatalog(config)
 
+	m.mu.Lock()
 	m.metadata.DatabaseName = database
 	m.metadata.DatabaseUsername = user
-
-	config.TLSConfig = &tls.Config{
-		ServerName:   m.serverHost,
-		RootCAs:      m.caCertPool,
-		ClientCAs:    m.caCertPool,
-		Certificates: []tls.Certificate{cert},
-	}
+	m.mu.Unlock()
 
 	conn, err := pgconn.ConnectConfig(ctx, config)
 	if err != nil {
@@ -423,6 +702,12 @@ func (m *MITM) connectToDatabase(ctx context.Context, frontendParameters map[str
 		return err
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.terminated != nil {
+		hijackedConn.Conn.Close()
+		return m.terminated
+	}
 	m.frontend = &Frontend{
 		Conn:              hijackedConn.Conn,
 		Frontend:          pgproto3.NewFrontend(pgproto3.NewChunkReader(hijackedConn.Conn), hijackedConn.Conn),
@@ -433,6 +718,45 @@ func (m *MITM) connectToDatabase(ctx context.Context, frontendParameters map[str
 	return nil
 }
 
+// databaseConfig returns the connection config of the upstream database. TCP
+// connections use TLS, with a certificate issued for the user in certificate
+// auth mode. Unix socket connections without a password rely on the
+// authentication configured for local connections.
+func (m *MITM) databaseConfig(user string) (*pgconn.Config, error) {
+	if m.database.Socket != "" {
+		config, err := pgconn.ParseConfig("sslmode=disable")
+		if err != nil {
+			return nil, err
+		}
+		socket := m.database.Socket
+		config.Host = socket
+		config.Fallbacks = nil
+		config.DialFunc = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return config, nil
+	}
+
+	config, err := pgconn.ParseConfig(fmt.Sprintf("postgres://%s:%d?sslmode=verify-full", m.database.Host, m.database.Port))
+	if err != nil {
+		return nil, err
+	}
+	config.TLSConfig = &tls.Config{
+		ServerName: m.database.Host,
+		RootCAs:    m.database.CACertPool,
+		ClientCAs:  m.database.CACertPool,
+	}
+	if m.database.Auth == upstream.AuthCertificate {
+		cert, err := m.certIssuer.Issue(user)
+		if err != nil {
+			return nil, fmt.Errorf("issue certificate: %w", err)
+		}
+		config.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 func (m *MITM) observeConnection(user, database string) error {
 	actions, rules, err := m.abac.Observe(
 		m.metadata.StateID,
@@ -440,6 +764,12 @@ func (m *MITM) observeConnection(user, database string) error {
 		abac.DatabaseUsernameEvent(user),
 	)
 	if err == nil {
+		if actions&abac.ReadOnly > 0 {
+			m.readOnly = true
+			m.mu.Lock()
+			m.metadata.ReadOnly = true
+			m.mu.Unlock()
+		}
 		if actions&abac.Notify > 0 {
 			m.notifier.OnNotify(fmt.Sprintf("user %s connecting to %s", user, database), rules, m.metadata)
 		}
@@ -457,6 +787,13 @@ func (m *MITM) observeConnection(user, database string) error {
 			}
 			return fmt.Errorf("%w: forbidden username by administrator", ErrUserPermissionDenied)
 		}
+		if actions&abac.RequireMFA > 0 && !m.metadata.MFA {
+			if actions&abac.Notify > 0 {
+				m.notifier.OnNotify(fmt.Sprintf("user %s was not permitted to connect to %s without MFA",
+					user, database), rules, m.metadata)
+			}
+			return fmt.Errorf("%w: %w", ErrUserPermissionDenied, ErrMFARequired)
+		}
 	} else {
 		m.logger.Errorw("failed to observe", "state-id", m.metadata.StateID, "err", err)
 	}
@@ -0,0 +1,31 @@
+package mitm
+
+import (
+	"maps"
+
+	"ssh-db-proxy/internal/sql"
+)
+
+// queryStatements extracts the statements of the query together with those of
+// the cursors and prepared statements it runs with FETCH, MOVE and EXECUTE, so
+// that rules apply to them as to the queries they were declared with. The
+// cursors and prepared statements the query declares are remembered for the
+// rest of the session.
+func (m *MITM) queryStatements(query string) ([]sql.QueryStatement, error) {
+	statements, err := sql.ExtractQueryStatements(query)
+	if err != nil {
+		return nil, err
+	}
+	declared, used, err := sql.ExtractNamedQueries(query)
+	if err != nil {
+		return nil, err
+	}
+	if m.namedQueries == nil {
+		m.namedQueries = make(map[sql.NamedQuery][]sql.QueryStatement)
+	}
+	maps.Copy(m.namedQueries, declared)
+	for _, name := range used {
+		statements = append(statements, m.namedQueries[name]...)
+	}
+	return statements, nil
+}
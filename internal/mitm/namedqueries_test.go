@@ -0,0 +1,37 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/abac"
+)
+
+func TestNamedQueries(t *testing.T) {
+	rules, err := abac.New(map[string]*abac.Rule{
+		"limit": {
+			Conditions: []abac.Condition{&abac.QueryCondition{TableRegexps: []string{"^users$"}, ColumnRegexps: []string{".*"}, Strict: true}},
+			Actions:    abac.MaxRows,
+			MaxRows:    10,
+		},
+	})
+	require.NoError(t, err)
+	m := newTestMITM(t)
+	m.abac = rules
+
+	for _, query := range []string{
+		"BEGIN; DECLARE c CURSOR FOR SELECT * FROM users; FETCH ALL c",
+		"FETCH 5 FROM c",
+		"PREPARE p AS SELECT * FROM users",
+		"EXECUTE p",
+		"EXPLAIN ANALYZE EXECUTE p",
+	} {
+		require.NoError(t, m.handleMessage(&pgproto3.Query{String: query}))
+		require.Equal(t, &rowLimit{max: 10}, m.lastRequest.rowLimit, query)
+	}
+
+	require.NoError(t, m.handleMessage(&pgproto3.Query{String: "FETCH ALL other"}))
+	require.Nil(t, m.lastRequest.rowLimit)
+}
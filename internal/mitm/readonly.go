@@ -0,0 +1,60 @@
+package mitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/pprof"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/sql"
+)
+
+const (
+	readOnlyTransactionCode = "25006"
+	readOnlyMessage         = "Query is not permitted in a read-only session"
+
+	defaultTransactionReadOnly = "default_transaction_read_only"
+)
+
+var ErrReadOnlySession = errors.New("read-only session")
+
+// readOnlyRuntimeParams returns the startup parameters of a read-only session.
+// Read-only settings of the client are dropped, whatever their case, so that
+// they cannot override the one of the proxy.
+func readOnlyRuntimeParams(params map[string]string) map[string]string {
+	result := make(map[string]string, len(params)+1)
+	for name, value := range params {
+		if !sql.IsReadOnlyParameter(name) {
+			result[name] = value
+		}
+	}
+	result[defaultTransactionReadOnly] = "on"
+	return result
+}
+
+// checkReadOnly denies write statements and attempts to turn off read-only
+// transactions in a read-only session. The client gets the read-only error
+// instead of the generic denial.
+func (m *MITM) checkReadOnly(r *request) error {
+	if !m.readOnly {
+		return nil
+	}
+	err := sql.CheckReadOnly(r.data.Query)
+	if err == nil {
+		return nil
+	}
+	r.denial = &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                readOnlyTransactionCode,
+		Message:             readOnlyMessage,
+		Detail:              err.Error(),
+	}
+	data := r.data
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-read-only-violation-event"), func(ctx context.Context) {
+		m.notifier.OnReadOnlyViolation(err, data)
+	})
+	return fmt.Errorf("%w: %w: %w", ErrUserPermissionDenied, ErrReadOnlySession, err)
+}
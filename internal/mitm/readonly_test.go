@@ -0,0 +1,56 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/sql"
+)
+
+func TestReadOnlyRuntimeParams(t *testing.T) {
+	params := map[string]string{
+		"user":                          "alice",
+		"application_name":              "psql",
+		"Default_Transaction_Read_Only": "off",
+		"transaction_read_only":         "off",
+	}
+	require.Equal(t, map[string]string{
+		"user":                          "alice",
+		"application_name":              "psql",
+		"default_transaction_read_only": "on",
+	}, readOnlyRuntimeParams(params))
+	require.Len(t, params, 4)
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	m := newTestMITM(t)
+	m.readOnly = true
+
+	require.NoError(t, m.checkReadOnly(m.newRequest("SELECT * FROM orders", false)))
+
+	m.lastRequest = m.newRequest("UPDATE orders SET total = 0", false)
+	err := m.checkReadOnly(m.lastRequest)
+	require.ErrorIs(t, err, ErrUserPermissionDenied)
+	require.ErrorIs(t, err, ErrReadOnlySession)
+	require.ErrorIs(t, err, sql.ErrWriteStatement)
+
+	r := m.lastRequest
+	require.Equal(t, &pgproto3.Query{String: deniedQuery}, m.deny(&pgproto3.Query{String: r.data.Query}))
+	m.requests.push(r)
+	stream := encodeBackend(t,
+		&pgproto3.ErrorResponse{Severity: "ERROR", Code: syntaxErrorCode, Message: "syntax error"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	types, msgs := decodeBackend(t, scanBackend(m, stream, len(stream)))
+	require.Equal(t, "EZ", types)
+	denial := msgs[0].(*pgproto3.ErrorResponse)
+	require.Equal(t, readOnlyTransactionCode, denial.Code)
+	require.Equal(t, readOnlyMessage, denial.Message)
+	require.Contains(t, denial.Detail, "UpdateStmt")
+	require.Equal(t, readOnlyTransactionCode, r.errorCode)
+
+	m.readOnly = false
+	require.NoError(t, m.checkReadOnly(m.newRequest("UPDATE orders SET total = 0", false)))
+}
@@ -0,0 +1,294 @@
+package mitm
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/metadata"
+)
+
+const (
+	dataRowMessage            = 'D'
+	emptyQueryResponseMessage = 'I'
+	noDataMessage             = 'n'
+	portalSuspendedMessage    = 's'
+
+	skippedAfterError = "not executed because of an earlier error"
+	closedBeforeEnd   = "connection closed before completion"
+)
+
+// request is a Query, Execute, Describe or Sync forwarded to the server whose
+// results have not been received yet.
+type request struct {
+	sync     bool
+	extended bool
+	// describe is set for a Describe, whose response sets the columns of the
+	// described statement or portal if it is tracked.
+	describe  bool
+	describes *resultColumns
+	data      metadata.Metadata
+	started   time.Time
+
+	commandTags []string
+	rows        int64
+	bytes       int64
+	errorCode   string
+	errorText   string
+
+	deniedCode  string
+	denial      *pgproto3.ErrorResponse
+	rowFiltered bool
+	rowLimit    *rowLimit
+	masks       []abac.ColumnMask
+	// maskedFields is nil until the columns of the result are resolved. Rows
+	// of an Execute are masked using the columns of its portal or statement.
+	maskedFields     []maskedField
+	columnsDescribed bool
+	portalColumns    *resultColumns
+	statementColumns *resultColumns
+	resultFormats    []int16
+	durationLimit    abac.DurationLimit
+	timer            *time.Timer
+}
+
+// requestQueue matches backend responses to forwarded requests. Requests are
+// added by the goroutine reading from the client and completed by the one
+// reading from the server.
+type requestQueue struct {
+	mu       sync.Mutex
+	requests []*request
+}
+
+func (q *requestQueue) push(r *request) {
+	r.started = time.Now()
+	q.mu.Lock()
+	q.requests = append(q.requests, r)
+	q.mu.Unlock()
+}
+
+// head returns the oldest request that is not a Sync.
+func (q *requestQueue) head() *request {
+	if len(q.requests) == 0 || q.requests[0].sync {
+		return nil
+	}
+	return q.requests[0]
+}
+
+func (q *requestQueue) pop() {
+	q.requests[0] = nil
+	q.requests = q.requests[1:]
+}
+
+// newRequest prepares the request of a query about to be forwarded. Its ID is
+// attached to the query events so that they can be linked with the result.
+func (m *MITM) newRequest(query string, extended bool) *request {
+	r := &request{
+		extended: extended,
+		data:     m.metadata.Copy(),
+	}
+	r.data.Query = query
+	r.data.QueryID = uuid.New().String()
+	return r
+}
+
+func (m *MITM) onBackendMessage(msgType byte, length int, body []byte) {
+	m.onCopyMessage(msgType, length, body)
+	m.onResultMessage(msgType, length, body)
+}
+
+// interceptBackendMessage selects the messages of the current request that are
+// rewritten: rows over its row limit, the CommandComplete of a truncated result
+// set, result sets with masked columns and the rejection of a denied message.
+func (m *MITM) interceptBackendMessage(msgType byte) bool {
+	m.requests.mu.Lock()
+	defer m.requests.mu.Unlock()
+	r := m.requests.head()
+	if r == nil {
+		return false
+	}
+	switch msgType {
+	case rowDescriptionMessage:
+		return len(r.masks) > 0
+	case dataRowMessage:
+		m.dropRow = r.rowLimit.drop()
+		return m.dropRow || len(r.masks) > 0
+	case commandCompleteMessage:
+		return r.rowLimit.complete()
+	case errorResponseMessage:
+		return r.deniedCode != ""
+	default:
+		return false
+	}
+}
+
+func (m *MITM) rewriteBackendMessage(msgType byte, body []byte) []byte {
+	switch msgType {
+	case rowDescriptionMessage:
+		return m.describeMaskedFields(body)
+	case dataRowMessage:
+		if m.dropRow {
+			return nil
+		}
+		return m.maskDataRow(body)
+	case commandCompleteMessage:
+		return m.truncateResult(body)
+	case errorResponseMessage:
+		return m.rewriteDenial(body)
+	default:
+		return rawMessage(msgType, body)
+	}
+}
+
+// onResultMessage reports the requests completed by a backend message.
+func (m *MITM) onResultMessage(msgType byte, length int, body []byte) {
+	completed, err := m.requests.onMessage(msgType, length, body)
+	if err != nil {
+		m.logger.Errorf("account backend message %q: %s", msgType, err)
+	}
+	for _, r := range completed {
+		m.onQueryCompleted(r)
+	}
+}
+
+// onMessage accounts a backend message to the oldest pending request and
+// returns the requests it completes. Extended protocol requests complete with
+// their own result, simple queries and everything skipped after an error
+// complete at ReadyForQuery.
+func (q *requestQueue) onMessage(msgType byte, length int, body []byte) ([]*request, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var completed []*request
+	switch msgType {
+	case rowDescriptionMessage, noDataMessage:
+		r := q.head()
+		if r == nil || !r.describe {
+			break
+		}
+		if r.describes != nil {
+			if msgType == rowDescriptionMessage {
+				var msg pgproto3.RowDescription
+				if err := msg.Decode(body); err != nil {
+					return nil, err
+				}
+				for i := range msg.Fields {
+					msg.Fields[i].Name = slices.Clone(msg.Fields[i].Name)
+				}
+				r.describes.fields = msg.Fields
+			}
+			r.describes.received = true
+		}
+		q.pop()
+	case dataRowMessage:
+		if r := q.head(); r != nil {
+			r.bytes += int64(length)
+		}
+	case commandCompleteMessage:
+		r := q.head()
+		if r == nil {
+			break
+		}
+		var msg pgproto3.CommandComplete
+		if err := msg.Decode(body); err != nil {
+			return nil, err
+		}
+		r.commandTags = append(r.commandTags, string(msg.CommandTag))
+		r.rows += commandTagRows(msg.CommandTag)
+		if r.extended {
+			completed = append(completed, r)
+			q.pop()
+		}
+	case emptyQueryResponseMessage, portalSuspendedMessage:
+		if r := q.head(); r != nil && r.extended {
+			completed = append(completed, r)
+			q.pop()
+		}
+	case errorResponseMessage:
+		r := q.head()
+		if r == nil {
+			break
+		}
+		var msg pgproto3.ErrorResponse
+		if err := msg.Decode(body); err != nil {
+			return nil, err
+		}
+		r.errorCode = msg.Code
+		r.errorText = msg.Message
+		if r.deniedCode != "" && msg.Code == r.deniedCode && r.denial != nil {
+			r.errorCode, r.errorText = r.denial.Code, r.denial.Message
+		}
+		if r.extended {
+			if !r.describe {
+				completed = append(completed, r)
+			}
+			q.pop()
+		}
+	case readyForQueryMessage:
+		for len(q.requests) > 0 {
+			r := q.requests[0]
+			q.pop()
+			if r.sync {
+				break
+			}
+			if r.extended {
+				r.errorText = skippedAfterError
+			}
+			if !r.describe {
+				completed = append(completed, r)
+			}
+			if !r.extended {
+				break
+			}
+		}
+	}
+	return completed, nil
+}
+
+// failPendingRequests reports requests left without a result when the
+// connection is closed.
+func (m *MITM) failPendingRequests() {
+	m.requests.mu.Lock()
+	requests := m.requests.requests
+	m.requests.requests = nil
+	m.requests.mu.Unlock()
+	for _, r := range requests {
+		if r.sync || r.describe {
+			continue
+		}
+		if r.errorCode == "" {
+			r.errorText = closedBeforeEnd
+		}
+		m.onQueryCompleted(r)
+	}
+}
+
+func (m *MITM) onQueryCompleted(r *request) {
+	m.stopDurationTimer(r)
+	latency := time.Since(r.started)
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-query-completed-event"), func(ctx context.Context) {
+		m.notifier.OnQueryCompleted(r.commandTags, r.rows, r.bytes, r.errorCode, r.errorText, latency, r.data)
+	})
+}
+
+// commandTagRows returns the row count of a command tag such as "SELECT 5" or
+// "INSERT 0 3". Tags without a count yield zero.
+func commandTagRows(commandTag []byte) int64 {
+	i := bytes.LastIndexByte(commandTag, ' ')
+	if i < 0 {
+		return 0
+	}
+	rows, err := strconv.ParseInt(string(commandTag[i+1:]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rows
+}
@@ -0,0 +1,107 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestQueue(t *testing.T) {
+	feed := func(t *testing.T, q *requestQueue, msgs ...pgproto3.BackendMessage) []*request {
+		var (
+			stream    []byte
+			completed []*request
+		)
+		for _, msg := range msgs {
+			var err error
+			stream, err = msg.Encode(stream)
+			require.NoError(t, err)
+		}
+		scanner := backendScanner{onMessage: func(msgType byte, length int, body []byte) {
+			if msgType == dataRowMessage {
+				body = nil
+			}
+			done, err := q.onMessage(msgType, length, body)
+			require.NoError(t, err)
+			completed = append(completed, done...)
+		}}
+		scanner.Scan(stream)
+		return completed
+	}
+	row := &pgproto3.DataRow{Values: [][]byte{[]byte("42")}}
+
+	t.Run("simple query", func(t *testing.T) {
+		var q requestQueue
+		query := &request{}
+		q.push(query)
+		completed := feed(t, &q,
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id")}}},
+			row, row,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+			&pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 3")},
+		)
+		require.Empty(t, completed)
+
+		completed = feed(t, &q, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+		require.Equal(t, []*request{query}, completed)
+		require.Equal(t, []string{"SELECT 2", "INSERT 0 3"}, query.commandTags)
+		require.Equal(t, int64(5), query.rows)
+		require.Equal(t, int64(2*len(row.Values[0])+2*6), query.bytes)
+		require.Empty(t, query.errorCode)
+		require.Empty(t, q.requests)
+	})
+
+	t.Run("extended query", func(t *testing.T) {
+		var q requestQueue
+		first, second := &request{extended: true}, &request{extended: true}
+		q.push(first)
+		q.push(second)
+		q.push(&request{sync: true})
+
+		completed := feed(t, &q,
+			&pgproto3.ParseComplete{},
+			&pgproto3.BindComplete{},
+			row,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		)
+		require.Equal(t, []*request{first}, completed)
+		require.Equal(t, int64(1), first.rows)
+
+		completed = feed(t, &q,
+			&pgproto3.BindComplete{},
+			&pgproto3.EmptyQueryResponse{},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+		require.Equal(t, []*request{second}, completed)
+		require.Empty(t, second.commandTags)
+		require.Empty(t, q.requests)
+	})
+
+	t.Run("error skips the rest of the batch", func(t *testing.T) {
+		var q requestQueue
+		failed, skipped, next := &request{extended: true}, &request{extended: true}, &request{}
+		q.push(failed)
+		q.push(skipped)
+		q.push(&request{sync: true})
+		q.push(next)
+
+		completed := feed(t, &q,
+			&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: `relation "missing" does not exist`},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+		require.Equal(t, []*request{failed, skipped}, completed)
+		require.Equal(t, "42P01", failed.errorCode)
+		require.Equal(t, `relation "missing" does not exist`, failed.errorText)
+		require.Empty(t, skipped.errorCode)
+		require.Equal(t, skippedAfterError, skipped.errorText)
+		require.Equal(t, []*request{next}, q.requests)
+	})
+}
+
+func TestCommandTagRows(t *testing.T) {
+	require.Equal(t, int64(5), commandTagRows([]byte("SELECT 5")))
+	require.Equal(t, int64(3), commandTagRows([]byte("INSERT 0 3")))
+	require.Equal(t, int64(0), commandTagRows([]byte("BEGIN")))
+	require.Equal(t, int64(0), commandTagRows([]byte("CREATE TABLE")))
+}
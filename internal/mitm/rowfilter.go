@@ -0,0 +1,94 @@
+package mitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/pprof"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/abac"
+	"ssh-db-proxy/internal/metadata"
+	"ssh-db-proxy/internal/sql"
+)
+
+var ErrMissingAttribute = errors.New("missing session attribute")
+
+// attribute returns a session attribute a row filter compares with.
+func (m *MITM) attribute(name string) (string, bool) {
+	if name == abac.AttributeDatabaseUsername {
+		return m.metadata.DatabaseUsername, m.metadata.DatabaseUsername != ""
+	}
+	value, ok := m.attributes[name]
+	return value, ok
+}
+
+// filterRows rewrites the query with the row filters of the matched rules.
+func (m *MITM) filterRows(query string, rules []string) (string, bool, error) {
+	var filters []sql.RowFilter
+	for _, filter := range m.abac.RowFilters(rules) {
+		value, ok := m.attribute(filter.Attribute)
+		if !ok {
+			return "", false, fmt.Errorf("%w: %s required by rule %s", ErrMissingAttribute, filter.Attribute, filter.Rule)
+		}
+		filters = append(filters, sql.RowFilter{Match: filter.Matches, Column: filter.Column, Value: value})
+	}
+	return sql.AddRowFilters(query, filters)
+}
+
+// rewriteQuery applies row filters to the query of r and records the
+// rewritten query in its metadata. Queries that cannot be filtered are denied.
+func (m *MITM) rewriteQuery(r *request, rules []string) error {
+	rewritten, changed, err := m.filterRows(r.data.Query, rules)
+	if err != nil {
+		m.logger.Errorf("filter rows: %s", err)
+		return fmt.Errorf("%w: %w", ErrUserPermissionDenied, err)
+	}
+	if changed {
+		r.data.RewrittenQuery = rewritten
+		m.onQueryRewritten(rules, r.data)
+	}
+	return nil
+}
+
+// onParse checks a statement being prepared like a query and applies row
+// filters to it. Its text is replaced before it is forwarded to the server, so
+// Execute runs the rewritten statement. It reports whether row filters were
+// applied.
+func (m *MITM) onParse(msg *pgproto3.Parse) (bool, error) {
+	statements, err := m.queryStatements(msg.Query)
+	if err != nil {
+		m.logger.Errorf("extract query statements: %s", err)
+		return false, nil
+	}
+	actions, rules, err := m.observeQuery(statements)
+	if err != nil {
+		m.logger.Errorf("observe query statements: %s", err)
+	}
+	if err := m.enforceQueryPolicy(actions, rules, m.queryMetadata(actions, msg.Query, statements)); err != nil {
+		return false, err
+	}
+	if actions&abac.FilterRows == 0 {
+		return false, nil
+	}
+	rewritten, changed, err := m.filterRows(msg.Query, rules)
+	if err != nil {
+		m.logger.Errorf("filter rows: %s", err)
+		return false, fmt.Errorf("%w: %w", ErrUserPermissionDenied, err)
+	}
+	if changed {
+		data := m.metadata.Copy()
+		data.Query = msg.Query
+		data.RewrittenQuery = rewritten
+		m.onQueryRewritten(rules, data)
+		msg.Query = rewritten
+	}
+	return true, nil
+}
+
+func (m *MITM) onQueryRewritten(rules []string, data metadata.Metadata) {
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-query-rewritten-event"), func(ctx context.Context) {
+		m.notifier.OnQueryRewritten(data.Query, data.RewrittenQuery, rules, data)
+	})
+}
@@ -0,0 +1,75 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/abac"
+)
+
+func TestRowFilter(t *testing.T) {
+	rules, err := abac.New(map[string]*abac.Rule{
+		"tenant": {
+			Conditions: []abac.Condition{&abac.QueryCondition{TableRegexps: []string{"^orders$"}, ColumnRegexps: []string{".*"}, Strict: true}},
+			Actions:    abac.FilterRows,
+			RowFilter:  &abac.TableRowFilter{Column: "tenant_id", Attribute: "extension:tenant@example.com"},
+		},
+	})
+	require.NoError(t, err)
+	newMITM := func(attributes map[string]string) *MITM {
+		m := newTestMITM(t)
+		m.attributes = attributes
+		m.abac = rules
+		return m
+	}
+
+	t.Run("simple query", func(t *testing.T) {
+		m := newMITM(map[string]string{"extension:tenant@example.com": "acme"})
+		msg := &pgproto3.Query{String: "SELECT * FROM orders"}
+		require.NoError(t, m.handleMessage(msg))
+		require.Equal(t, "SELECT * FROM (SELECT * FROM orders WHERE tenant_id = 'acme') orders", msg.String)
+		require.Equal(t, msg.String, m.lastRequest.data.RewrittenQuery)
+		require.Equal(t, "SELECT * FROM orders", m.lastRequest.data.Query)
+
+		msg = &pgproto3.Query{String: "SELECT * FROM products"}
+		require.NoError(t, m.handleMessage(msg))
+		require.Equal(t, "SELECT * FROM products", msg.String)
+		require.Empty(t, m.lastRequest.data.RewrittenQuery)
+	})
+
+	t.Run("cursor", func(t *testing.T) {
+		m := newMITM(map[string]string{"extension:tenant@example.com": "acme"})
+		msg := &pgproto3.Query{String: "BEGIN; DECLARE c CURSOR FOR SELECT * FROM orders; FETCH ALL c"}
+		require.NoError(t, m.handleMessage(msg))
+		require.Equal(t, "BEGIN; DECLARE c CURSOR FOR SELECT * FROM (SELECT * FROM orders WHERE tenant_id = 'acme') orders; FETCH ALL c", msg.String)
+	})
+
+	t.Run("missing attribute", func(t *testing.T) {
+		m := newMITM(nil)
+		msg := &pgproto3.Query{String: "DELETE FROM orders"}
+		err := m.handleMessage(msg)
+		require.ErrorIs(t, err, ErrUserPermissionDenied)
+		require.ErrorIs(t, err, ErrMissingAttribute)
+		require.Equal(t, "DELETE FROM orders", msg.String)
+	})
+
+	t.Run("extended query", func(t *testing.T) {
+		m := newMITM(map[string]string{"extension:tenant@example.com": "acme"})
+		parse := &pgproto3.Parse{Name: "s1", Query: "UPDATE orders SET total = $1 WHERE id = $2"}
+		require.NoError(t, m.handleMessage(parse))
+		require.Equal(t, "UPDATE orders SET total = $1 WHERE id = $2 AND orders.tenant_id = 'acme'", parse.Query)
+		require.NoError(t, m.handleMessage(&pgproto3.Bind{PreparedStatement: "s1", Parameters: [][]byte{[]byte("0"), []byte("1")}}))
+		require.NoError(t, m.handleMessage(&pgproto3.Execute{}))
+		require.Equal(t, "UPDATE orders SET total = $1 WHERE id = $2", m.lastRequest.data.Query)
+		require.Equal(t, parse.Query, m.lastRequest.data.RewrittenQuery)
+	})
+
+	t.Run("statement prepared before the rule", func(t *testing.T) {
+		m := newMITM(map[string]string{"extension:tenant@example.com": "acme"})
+		m.extended.parse(&pgproto3.Parse{Name: "s1", Query: "SELECT * FROM orders"})
+		require.NoError(t, m.handleMessage(&pgproto3.Bind{PreparedStatement: "s1"}))
+		require.ErrorIs(t, m.handleMessage(&pgproto3.Execute{}), ErrUserPermissionDenied)
+	})
+}
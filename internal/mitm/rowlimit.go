@@ -0,0 +1,107 @@
+package mitm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime/pprof"
+	"strconv"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// rowLimit caps the number of rows forwarded to the client for each result set
+// of a request. Rows over the limit are read from the server and dropped so
+// that the session stays in sync.
+type rowLimit struct {
+	max     int64
+	sent    int64
+	dropped int64
+}
+
+// drop counts a row of the current result set and reports whether it is over
+// the limit.
+func (l *rowLimit) drop() bool {
+	if l == nil {
+		return false
+	}
+	if l.sent < l.max {
+		l.sent++
+		return false
+	}
+	l.dropped++
+	return true
+}
+
+// complete ends the current result set and reports whether its rows were
+// dropped. The counters of a truncated result set are reset by truncateResult
+// once the command tag is rewritten.
+func (l *rowLimit) complete() bool {
+	if l == nil {
+		return false
+	}
+	if l.dropped == 0 {
+		l.sent = 0
+		return false
+	}
+	return true
+}
+
+// truncateResult replaces the CommandComplete of a truncated result set with
+// a notice and a command tag carrying the number of rows actually sent.
+func (m *MITM) truncateResult(body []byte) []byte {
+	m.requests.mu.Lock()
+	r := m.requests.head()
+	if r == nil || r.rowLimit == nil {
+		m.requests.mu.Unlock()
+		return rawMessage(commandCompleteMessage, body)
+	}
+	l := r.rowLimit
+	limit, sent, rows := l.max, l.sent, l.sent+l.dropped
+	l.sent, l.dropped = 0, 0
+	data := r.data
+	m.requests.mu.Unlock()
+
+	var msg pgproto3.CommandComplete
+	if err := msg.Decode(body); err != nil {
+		m.logger.Errorf("decode command complete: %s", err)
+		return rawMessage(commandCompleteMessage, body)
+	}
+	out, err := (&pgproto3.NoticeResponse{
+		Severity: "WARNING",
+		Code:     warningCode,
+		Message:  fmt.Sprintf("result was truncated to %d rows by administrator", limit),
+	}).Encode(nil)
+	if err != nil {
+		m.logger.Errorf("encode notice: %s", err)
+		return rawMessage(commandCompleteMessage, body)
+	}
+	out, err = (&pgproto3.CommandComplete{CommandTag: truncateCommandTag(msg.CommandTag, sent)}).Encode(out)
+	if err != nil {
+		m.logger.Errorf("encode command complete: %s", err)
+		return rawMessage(commandCompleteMessage, body)
+	}
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-row-limit-event"), func(ctx context.Context) {
+		m.notifier.OnRowLimit(limit, rows, data)
+	})
+	return out
+}
+
+// rawMessage encodes an intercepted message back as is.
+func rawMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, messageHeaderSize, messageHeaderSize+len(body))
+	msg[0] = msgType
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// truncateCommandTag replaces the row count of a command tag such as
+// "SELECT 5" with rows.
+func truncateCommandTag(commandTag []byte, rows int64) []byte {
+	i := bytes.LastIndexByte(commandTag, ' ')
+	if i < 0 {
+		return commandTag
+	}
+	return strconv.AppendInt(bytes.Clone(commandTag[:i+1]), rows, 10)
+}
@@ -0,0 +1,58 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRowLimit(t *testing.T) {
+	row := &pgproto3.DataRow{Values: [][]byte{[]byte("42")}}
+	stream := encodeBackend(t,
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id")}}},
+		row, row, row, row, row,
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 5")},
+		row,
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+
+	for _, chunkSize := range []int{1, 3, 7, len(stream)} {
+		m := newTestMITM(t)
+		m.requests.push(&request{rowLimit: &rowLimit{max: 2}})
+
+		types, msgs := decodeBackend(t, scanBackend(m, stream, chunkSize))
+		require.Equal(t, "TDDNCDCZ", types, "chunk size %d", chunkSize)
+		var tags []string
+		for _, msg := range msgs {
+			if msg, ok := msg.(*pgproto3.CommandComplete); ok {
+				tags = append(tags, string(msg.CommandTag))
+			}
+		}
+		require.Equal(t, []string{"SELECT 2", "SELECT 1"}, tags)
+		require.Empty(t, m.requests.requests)
+	}
+
+	t.Run("result sets under the limit", func(t *testing.T) {
+		description := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("id")}}}
+		stream := encodeBackend(t,
+			description, row, row,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+			description, row, row,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+		m := newTestMITM(t)
+		m.requests.push(&request{rowLimit: &rowLimit{max: 3}})
+
+		types, _ := decodeBackend(t, scanBackend(m, stream, len(stream)))
+		require.Equal(t, "TDDCTDDCZ", types)
+	})
+}
+
+func TestTruncateCommandTag(t *testing.T) {
+	require.Equal(t, []byte("SELECT 10"), truncateCommandTag([]byte("SELECT 1000"), 10))
+	require.Equal(t, []byte("FETCH 3"), truncateCommandTag([]byte("FETCH 7"), 3))
+	require.Equal(t, []byte("SHOW"), truncateCommandTag([]byte("SHOW"), 3))
+}
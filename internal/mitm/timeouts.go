@@ -0,0 +1,269 @@
+package mitm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime/pprof"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	timeoutsCheckPeriod   = time.Second
+	terminateWriteTimeout = 5 * time.Second
+
+	readyForQueryMessage   = 'Z'
+	commandCompleteMessage = 'C'
+	errorResponseMessage   = 'E'
+	copyInResponseMessage  = 'G'
+	copyOutResponseMessage = 'H'
+	copyDataMessage        = 'd'
+	messageHeaderSize      = 5
+)
+
+var (
+	ErrIdleTimeout              = errors.New("idle timeout")
+	ErrIdleInTransactionTimeout = errors.New("idle-in-transaction timeout")
+	ErrSessionLifetimeExceeded  = errors.New("maximum session lifetime exceeded")
+	ErrKeepaliveTimeout         = errors.New("keepalive timeout")
+	ErrCertificateExpired       = errors.New("SSH certificate expired")
+	ErrQueryDurationExceeded    = errors.New("maximum query duration exceeded")
+)
+
+// SQLSTATE codes a real server uses for the same kind of termination.
+var terminationCodes = map[error]string{
+	ErrIdleTimeout:              "57P05",
+	ErrIdleInTransactionTimeout: "25P03",
+	ErrQueryDurationExceeded:    queryCanceledCode,
+}
+
+const defaultTerminationCode = "57P01"
+
+type Timeouts struct {
+	Idle              time.Duration
+	IdleInTransaction time.Duration
+}
+
+// collectedMessages are the backend messages whose body backendScanner passes
+// to onMessage.
+var collectedMessages = map[byte]bool{
+	rowDescriptionMessage:  true,
+	commandCompleteMessage: true,
+	errorResponseMessage:   true,
+}
+
+// backendScanner follows message boundaries of the raw backend stream and
+// reports every ReadyForQuery transaction status.
+type backendScanner struct {
+	header          [messageHeaderSize]byte
+	headerLen       int
+	remaining       int
+	length          int
+	body            []byte
+	out             []byte
+	intercepted     bool
+	onReadyForQuery func(txStatus byte)
+	// onMessage is called after every message with its type and body length.
+	// The body is only passed for collectedMessages and intercepted messages
+	// and is reused afterwards.
+	onMessage func(msgType byte, length int, body []byte)
+	// intercept is called at the start of every message. Intercepted messages
+	// are not forwarded as is but replaced with the result of rewrite, which
+	// is called before onMessage.
+	intercept func(msgType byte) bool
+	rewrite   func(msgType byte, body []byte) []byte
+}
+
+// Scan follows the messages in b and returns the bytes to forward to the
+// client. It returns b itself unless a message is intercepted.
+func (s *backendScanner) Scan(b []byte) []byte {
+	var (
+		out      []byte
+		filtered bool
+		start    int
+	)
+	if s.intercepted {
+		out, filtered = s.out[:0], true
+	}
+	i := 0
+	done := func() {
+		if s.intercepted {
+			out = append(out, s.rewrite(s.header[0], s.body)...)
+			start = i
+		}
+		s.finish()
+		s.intercepted = false
+	}
+	for i < len(b) {
+		if s.headerLen == 0 && s.intercept != nil && s.intercept(b[i]) {
+			s.intercepted = true
+			if !filtered {
+				out, filtered = s.out[:0], true
+			}
+			out = append(out, b[start:i]...)
+		}
+		if s.headerLen < messageHeaderSize {
+			n := copy(s.header[s.headerLen:], b[i:])
+			s.headerLen += n
+			i += n
+			if s.headerLen < messageHeaderSize {
+				break
+			}
+			s.remaining = int(binary.BigEndian.Uint32(s.header[1:])) - 4
+			s.length = s.remaining
+			s.body = s.body[:0]
+			if s.remaining <= 0 {
+				done()
+				continue
+			}
+		}
+		n := min(s.remaining, len(b)-i)
+		if s.header[0] == readyForQueryMessage && s.remaining == 1 && n == 1 && s.onReadyForQuery != nil {
+			s.onReadyForQuery(b[i])
+		}
+		if collectedMessages[s.header[0]] || s.intercepted {
+			s.body = append(s.body, b[i:i+n]...)
+		}
+		s.remaining -= n
+		i += n
+		if s.remaining <= 0 {
+			done()
+		}
+	}
+	if !filtered {
+		return b
+	}
+	if !s.intercepted {
+		out = append(out, b[start:]...)
+	}
+	s.out = out
+	return out
+}
+
+func (s *backendScanner) finish() {
+	s.headerLen = 0
+	if s.onMessage == nil {
+		return
+	}
+	var body []byte
+	if collectedMessages[s.header[0]] || s.intercepted {
+		body = s.body
+	}
+	s.onMessage(s.header[0], s.length, body)
+}
+
+// AtBoundary reports whether everything scanned so far ends on a message boundary.
+func (s *backendScanner) AtBoundary() bool {
+	return s.headerLen == 0
+}
+
+// LastActivity returns the time of the last message in either direction. A
+// session waiting for the server to answer is considered active.
+func (m *MITM) LastActivity() time.Time {
+	if m.pendingRequests.Load() > 0 {
+		return time.Now()
+	}
+	return time.Unix(0, m.lastActivity.Load())
+}
+
+func (m *MITM) touch() {
+	m.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (m *MITM) onReadyForQuery(txStatus byte) {
+	m.txStatus.Store(uint32(txStatus))
+	if m.pendingRequests.Add(-1) < 0 {
+		m.pendingRequests.Store(0)
+	}
+	m.idleSince.Store(time.Now().UnixNano())
+}
+
+func (m *MITM) watchTimeouts(ctx context.Context) {
+	if m.timeouts.Idle <= 0 && m.timeouts.IdleInTransaction <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeoutsCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if m.pendingRequests.Load() > 0 {
+				continue
+			}
+			idle := now.Sub(time.Unix(0, m.idleSince.Load()))
+			limit, reason := m.timeouts.Idle, ErrIdleTimeout
+			if byte(m.txStatus.Load()) != txStatusIdle && m.timeouts.IdleInTransaction > 0 &&
+				(limit <= 0 || m.timeouts.IdleInTransaction < limit) {
+				limit, reason = m.timeouts.IdleInTransaction, ErrIdleInTransactionTimeout
+			}
+			if limit > 0 && idle >= limit {
+				m.Terminate(reason)
+				return
+			}
+		}
+	}
+}
+
+// Terminate sends the client a FATAL ErrorResponse with the reason and closes
+// both sides of the session. Only the first call has an effect.
+func (m *MITM) Terminate(reason error) {
+	m.mu.Lock()
+	if m.terminated != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.terminated = reason
+	frontend := m.frontend
+	data := m.metadata.Copy()
+	m.mu.Unlock()
+
+	m.isHalfClosed.Store(true)
+	m.logger.Infow("terminating session", "reason", reason)
+
+	code, ok := terminationCodes[reason]
+	if !ok {
+		code = defaultTerminationCode
+	}
+	if err := m.backend.SetWriteDeadline(time.Now().Add(terminateWriteTimeout)); err != nil {
+		m.logger.Errorf("set write deadline: %s", err)
+	}
+	// The error is only sent between backend messages; in the middle of one
+	// it would corrupt the stream, so the client only sees the connection close.
+	m.clientMu.Lock()
+	if m.scanner.AtBoundary() {
+		if err := m.backend.Send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     code,
+			Message:  "terminating connection due to " + reason.Error(),
+		}); err != nil {
+			m.logger.Errorf("send termination error: %s", err)
+		}
+	}
+	m.clientMu.Unlock()
+	if frontend != nil {
+		// A forwarded message blocked on a stalled server would hold up the
+		// Terminate behind it.
+		if err := frontend.SetWriteDeadline(time.Now().Add(terminateWriteTimeout)); err != nil {
+			m.logger.Errorf("set server write deadline: %s", err)
+		}
+		if err := frontend.Send(&pgproto3.Terminate{}); err != nil {
+			m.logger.Errorf("send terminate to server: %s", err)
+		}
+		frontend.Close()
+	}
+	m.backend.Close()
+
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-session-terminated-event"), func(ctx context.Context) {
+		m.notifier.OnSessionTerminated(reason, data)
+	})
+}
+
+func (m *MITM) isTerminated() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.terminated != nil
+}
@@ -0,0 +1,69 @@
+package mitm
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendScanner(t *testing.T) {
+	var stream []byte
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("Z"), nil}},
+		&pgproto3.EmptyQueryResponse{},
+		&pgproto3.ReadyForQuery{TxStatus: 'E'},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		var err error
+		stream, err = msg.Encode(stream)
+		require.NoError(t, err)
+	}
+
+	for _, chunkSize := range []int{1, 2, 3, 7, len(stream)} {
+		var statuses []byte
+		scanner := backendScanner{onReadyForQuery: func(txStatus byte) {
+			statuses = append(statuses, txStatus)
+		}}
+		for b := stream; len(b) > 0; {
+			n := min(chunkSize, len(b))
+			scanner.Scan(b[:n])
+			b = b[n:]
+		}
+		require.Equal(t, []byte("TEI"), statuses, "chunk size %d", chunkSize)
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	// terminate terminates a session after the scanner forwarded stream and
+	// returns what the client receives.
+	terminate := func(t *testing.T, stream []byte) []byte {
+		m := newTestMITM(t)
+		server, client := net.Pipe()
+		m.backend = &Backend{Conn: server, Backend: pgproto3.NewBackend(pgproto3.NewChunkReader(server), server)}
+		m.scanner.Scan(stream)
+
+		received := make(chan []byte)
+		go func() {
+			b, _ := io.ReadAll(client)
+			received <- b
+		}()
+		m.Terminate(ErrIdleTimeout)
+		return <-received
+	}
+	row := encodeBackend(t, &pgproto3.DataRow{Values: [][]byte{[]byte("42")}})
+
+	t.Run("between messages", func(t *testing.T) {
+		types, msgs := decodeBackend(t, terminate(t, row))
+		require.Equal(t, "E", types)
+		require.Equal(t, "FATAL", msgs[0].(*pgproto3.ErrorResponse).Severity)
+	})
+
+	t.Run("in the middle of a message", func(t *testing.T) {
+		require.Empty(t, terminate(t, row[:len(row)-1]))
+	})
+}
@@ -0,0 +1,97 @@
+package mitm
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"runtime/pprof"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"ssh-db-proxy/internal/metadata"
+)
+
+const (
+	clientTLSHandshakeTimeout = 10 * time.Second
+
+	tlsCertificateDatabase = "database"
+	tlsCertificateIssued   = "issued"
+)
+
+// ClientTLS configures TLS between the PostgreSQL client and the proxy for
+// databases without their own certificate. ServerNames are added to the names
+// of issued certificates.
+type ClientTLS struct {
+	Enabled     bool
+	ServerNames []string
+}
+
+// clientTLSConfig returns nil if the client may not use TLS for the database.
+func (m *MITM) clientTLSConfig() (*tls.Config, string, error) {
+	if m.database.TLSCertificate != nil {
+		return &tls.Config{
+			Certificates: []tls.Certificate{*m.database.TLSCertificate},
+			MinVersion:   tls.VersionTLS12,
+		}, tlsCertificateDatabase, nil
+	}
+	if !m.clientTLS.Enabled {
+		return nil, "", nil
+	}
+	cert, err := m.certIssuer.IssueServer(m.database.Name, m.serverNames())
+	if err != nil {
+		return nil, "", fmt.Errorf("issue server certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, tlsCertificateIssued, nil
+}
+
+// serverNames returns the names clients may use to reach the database through
+// the tunnel.
+func (m *MITM) serverNames() []string {
+	names := []string{m.database.Name, "localhost", "127.0.0.1", "::1"}
+	if m.database.Alias != "" {
+		names = append(names, m.database.Alias)
+	}
+	if m.database.Host != "" {
+		names = append(names, m.database.Host)
+	}
+	names = append(names, m.clientTLS.ServerNames...)
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// startClientTLS performs the TLS handshake with the client and switches the
+// client side of the MITM to the TLS connection.
+func (m *MITM) startClientTLS(config *tls.Config, certificate string) error {
+	tlsConn := tls.Server(m.backend.Conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), clientTLSHandshakeTimeout)
+	defer cancel()
+	err := tlsConn.HandshakeContext(ctx)
+	if err == nil {
+		state := tlsConn.ConnectionState()
+		m.mu.Lock()
+		m.metadata.ClientTLS = &metadata.TLS{
+			Version:            tls.VersionName(state.Version),
+			CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+			ServerName:         state.ServerName,
+			NegotiatedProtocol: state.NegotiatedProtocol,
+			Certificate:        certificate,
+		}
+		m.mu.Unlock()
+		m.backend.Conn = tlsConn
+		m.backend.Backend = pgproto3.NewBackend(pgproto3.NewChunkReader(tlsConn), tlsConn)
+		err = m.backend.SetAuthType(pgproto3.AuthTypeMD5Password)
+	}
+	data := m.metadata.Copy()
+	go pprof.Do(context.Background(), pprof.Labels("name", "on-client-tls-event"), func(ctx context.Context) {
+		m.notifier.OnClientTLS(err, data)
+	})
+	if err != nil {
+		return fmt.Errorf("client TLS handshake: %w", err)
+	}
+	return nil
+}
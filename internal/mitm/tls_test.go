@@ -0,0 +1,36 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/upstream"
+)
+
+func TestClientTLSConfig(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		m := &MITM{database: &upstream.Database{Name: "orders", Host: "orders.db.internal", Port: 5432}}
+		config, _, err := m.clientTLSConfig()
+		require.NoError(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("database certificate", func(t *testing.T) {
+		cert := &tls.Certificate{Certificate: [][]byte{[]byte("cert")}}
+		m := &MITM{database: &upstream.Database{Name: "orders", Socket: "/run/postgresql/.s.PGSQL.5432", TLSCertificate: cert}}
+		config, certificate, err := m.clientTLSConfig()
+		require.NoError(t, err)
+		require.Equal(t, tlsCertificateDatabase, certificate)
+		require.Equal(t, []tls.Certificate{*cert}, config.Certificates)
+	})
+
+	t.Run("server names", func(t *testing.T) {
+		m := &MITM{
+			database:  &upstream.Database{Name: "orders", Host: "orders.db.internal", Port: 5432, Alias: "orders"},
+			clientTLS: ClientTLS{Enabled: true, ServerNames: []string{"db-proxy.example.com", "localhost"}},
+		}
+		require.Equal(t, []string{"127.0.0.1", "::1", "db-proxy.example.com", "localhost", "orders", "orders.db.internal"}, m.serverNames())
+	})
+}
@@ -16,7 +16,10 @@ import (
 	"golang.org/x/crypto/ssh"
 
 	"ssh-db-proxy/internal/config"
+	"ssh-db-proxy/internal/lockout"
 	"ssh-db-proxy/internal/metadata"
+	"ssh-db-proxy/internal/rolemap"
+	wrapssh "ssh-db-proxy/internal/ssh"
 )
 
 const defaultCount = 100
@@ -30,6 +33,7 @@ type abacEvent struct {
 
 type Notifier struct {
 	server *http.Server
+	mux    *http.ServeMux
 	ch     chan any
 	logger *zap.SugaredLogger
 }
@@ -71,15 +75,26 @@ func New(config config.NotifierConfig, logger *zap.SugaredLogger) (*Notifier, er
 	}
 	n := &Notifier{
 		server: server,
+		mux:    http.NewServeMux(),
 		ch:     make(chan any, config.Capacity),
 		logger: logger,
 	}
 
-	server.Handler = n
+	n.mux.Handle("/", n)
+	server.Handler = n.mux
 
 	return n, nil
 }
 
+// Handle serves an additional API on the notifier listener, protected by the
+// same TLS client authentication as the events.
+func (n *Notifier) Handle(pattern string, handler http.Handler) {
+	if n == nil {
+		return
+	}
+	n.mux.Handle(pattern, handler)
+}
+
 func (n *Notifier) Serve() error {
 	if n == nil {
 		return nil
@@ -155,24 +170,104 @@ func (n *Notifier) OnNotify(message string, matchedRules []string, data metadata
 	})
 }
 
-func (n *Notifier) OnAuthCertificate(cert *ssh.Certificate) {
+func (n *Notifier) OnAuthCertificate(cert *ssh.Certificate, remoteAddress, clientVersion, reason string, authErr error) {
+	var errString string
+	if authErr != nil {
+		errString = authErr.Error()
+	}
 	n.writeEvent("auth-certificate", struct {
-		KeyID       string    `json:"key_id"`
-		ValidAfter  time.Time `json:"valid_after"`
-		ValidBefore time.Time `json:"valid_before"`
+		AuthMethod      string            `json:"auth_method"`
+		KeyID           string            `json:"key_id"`
+		Serial          uint64            `json:"serial"`
+		Principals      []string          `json:"principals"`
+		CAFingerprint   string            `json:"ca_fingerprint"`
+		Extensions      map[string]string `json:"extensions"`
+		CriticalOptions map[string]string `json:"critical_options"`
+		ValidAfter      time.Time         `json:"valid_after"`
+		ValidBefore     time.Time         `json:"valid_before"`
+		RemoteAddress   string            `json:"remote_address"`
+		ClientVersion   string            `json:"client_version"`
+		Success         bool              `json:"success"`
+		Reason          string            `json:"reason,omitempty"`
+		Error           string            `json:"error,omitempty"`
+	}{
+		AuthMethod:      wrapssh.AuthMethodCertificate,
+		KeyID:           cert.KeyId,
+		Serial:          cert.Serial,
+		Principals:      cert.ValidPrincipals,
+		CAFingerprint:   ssh.FingerprintSHA256(cert.SignatureKey),
+		Extensions:      cert.Extensions,
+		CriticalOptions: cert.CriticalOptions,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore:     time.Unix(int64(cert.ValidBefore), 0),
+		RemoteAddress:   remoteAddress,
+		ClientVersion:   clientVersion,
+		Success:         authErr == nil,
+		Reason:          reason,
+		Error:           errString,
+	})
+}
+
+func (n *Notifier) OnAuthPublicKey(key ssh.PublicKey, comment, remoteAddress, clientVersion, reason string, authErr error) {
+	var errString string
+	if authErr != nil {
+		errString = authErr.Error()
+	}
+	n.writeEvent("auth-public-key", struct {
+		AuthMethod    string `json:"auth_method"`
+		Fingerprint   string `json:"fingerprint"`
+		Comment       string `json:"comment,omitempty"`
+		RemoteAddress string `json:"remote_address"`
+		ClientVersion string `json:"client_version"`
+		Success       bool   `json:"success"`
+		Reason        string `json:"reason,omitempty"`
+		Error         string `json:"error,omitempty"`
 	}{
-		KeyID:       cert.KeyId,
-		ValidAfter:  time.Unix(int64(cert.ValidAfter), 0),
-		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+		AuthMethod:    wrapssh.AuthMethodPublicKey,
+		Fingerprint:   ssh.FingerprintSHA256(key),
+		Comment:       comment,
+		RemoteAddress: remoteAddress,
+		ClientVersion: clientVersion,
+		Success:       authErr == nil,
+		Reason:        reason,
+		Error:         errString,
+	})
+}
+
+func (n *Notifier) OnMFA(method, name, remoteAddress string, mfaErr error) {
+	var errString string
+	if mfaErr != nil {
+		errString = mfaErr.Error()
+	}
+	n.writeEvent("mfa", struct {
+		Method        string `json:"method"`
+		Name          string `json:"name"`
+		RemoteAddress string `json:"remote_address"`
+		Success       bool   `json:"success"`
+		Error         string `json:"error,omitempty"`
+	}{
+		Method:        method,
+		Name:          name,
+		RemoteAddress: remoteAddress,
+		Success:       mfaErr == nil,
+		Error:         errString,
 	})
 }
 
-func (n *Notifier) OnDatabaseUsers(users []string, data metadata.Metadata) {
+func (n *Notifier) OnLockout(l lockout.Lockout) {
+	n.writeEvent("lockout", l)
+}
+
+func (n *Notifier) OnDatabaseUsers(users, groups []string, grants rolemap.Grants, data metadata.Metadata) {
 	n.writeEvent("database-users", struct {
 		Users    []string          `json:"users"`
+		Groups   []string          `json:"groups"`
+		Roles    rolemap.Grants    `json:"roles"`
 		Metadata metadata.Metadata `json:"metadata"`
 	}{
 		Users:    users,
+		Groups:   groups,
+		Roles:    grants,
 		Metadata: data,
 	})
 }
@@ -185,6 +280,52 @@ func (n *Notifier) OnDirectTCPIPRequest(data metadata.Metadata) {
 	})
 }
 
+func (n *Notifier) OnDirectTCPIPRejected(host string, port uint32, reason error, data metadata.Metadata) {
+	n.writeEvent("direct-tcpip-rejected", struct {
+		Host     string            `json:"host"`
+		Port     uint32            `json:"port"`
+		Reason   string            `json:"reason"`
+		Metadata metadata.Metadata `json:"metadata"`
+	}{
+		Host:     host,
+		Port:     port,
+		Reason:   reason.Error(),
+		Metadata: data,
+	})
+}
+
+func (n *Notifier) OnDirectStreamLocalRequest(socketPath string, data metadata.Metadata) {
+	n.writeEvent("direct-streamlocal-request", struct {
+		SocketPath string            `json:"socket_path"`
+		Metadata   metadata.Metadata `json:"metadata"`
+	}{
+		SocketPath: socketPath,
+		Metadata:   data,
+	})
+}
+
+func (n *Notifier) OnDirectStreamLocalRejected(socketPath string, reason error, data metadata.Metadata) {
+	n.writeEvent("direct-streamlocal-rejected", struct {
+		SocketPath string            `json:"socket_path"`
+		Reason     string            `json:"reason"`
+		Metadata   metadata.Metadata `json:"metadata"`
+	}{
+		SocketPath: socketPath,
+		Reason:     reason.Error(),
+		Metadata:   data,
+	})
+}
+
+func (n *Notifier) OnSessionRequest(requestType string, data metadata.Metadata) {
+	n.writeEvent("session-request", struct {
+		RequestType string            `json:"request_type"`
+		Metadata    metadata.Metadata `json:"metadata"`
+	}{
+		RequestType: requestType,
+		Metadata:    data,
+	})
+}
+
 func (n *Notifier) OnQueryMessage(msg pgproto3.Query, data metadata.Metadata) {
 	n.writeEvent("query-message", struct {
 		Message  pgproto3.Query    `json:"message"`
@@ -225,13 +366,17 @@ func (n *Notifier) OnSyncMessage(msg pgproto3.Sync, data metadata.Metadata) {
 	})
 }
 
-func (n *Notifier) OnExecuteMessage(msg pgproto3.Execute, data metadata.Metadata) {
+func (n *Notifier) OnExecuteMessage(msg pgproto3.Execute, statementName string, parameters []metadata.Parameter, data metadata.Metadata) {
 	n.writeEvent("query-message", struct {
-		Message  pgproto3.Execute  `json:"message"`
-		Metadata metadata.Metadata `json:"metadata"`
+		Message       pgproto3.Execute     `json:"message"`
+		StatementName string               `json:"statement_name"`
+		Parameters    []metadata.Parameter `json:"parameters"`
+		Metadata      metadata.Metadata    `json:"metadata"`
 	}{
-		Message:  msg,
-		Metadata: data,
+		Message:       msg,
+		StatementName: statementName,
+		Parameters:    parameters,
+		Metadata:      data,
 	})
 }
 
@@ -275,6 +420,22 @@ func (n *Notifier) OnSSLRequest(msg pgproto3.SSLRequest, data metadata.Metadata)
 	})
 }
 
+func (n *Notifier) OnClientTLS(handshakeErr error, data metadata.Metadata) {
+	var errString string
+	if handshakeErr != nil {
+		errString = handshakeErr.Error()
+	}
+	n.writeEvent("client-tls", struct {
+		Success  bool              `json:"success"`
+		Error    string            `json:"error,omitempty"`
+		Metadata metadata.Metadata `json:"metadata"`
+	}{
+		Success:  handshakeErr == nil,
+		Error:    errString,
+		Metadata: data,
+	})
+}
+
 func (n *Notifier) OnGSSEncRequest(msg pgproto3.GSSEncRequest, data metadata.Metadata) {
 	n.writeEvent("query-message", struct {
 		Message  pgproto3.GSSEncRequest `json:"message"`
@@ -285,16 +446,138 @@ func (n *Notifier) OnGSSEncRequest(msg pgproto3.GSSEncRequest, data metadata.Met
 	})
 }
 
-func (n *Notifier) OnCancelRequest(msg pgproto3.CancelRequest, data metadata.Metadata) {
-	n.writeEvent("query-message", struct {
-		Message  pgproto3.CancelRequest `json:"message"`
-		Metadata metadata.Metadata      `json:"metadata"`
+func (n *Notifier) OnCancelRequest(msg pgproto3.CancelRequest, cancelErr error, data metadata.Metadata) {
+	var errString string
+	if cancelErr != nil {
+		errString = cancelErr.Error()
+	}
+	n.writeEvent("cancel-request", struct {
+		Message   pgproto3.CancelRequest `json:"message"`
+		Forwarded bool                   `json:"forwarded"`
+		Error     string                 `json:"error,omitempty"`
+		Metadata  metadata.Metadata      `json:"metadata"`
 	}{
-		Message:  msg,
+		Message:   msg,
+		Forwarded: cancelErr == nil,
+		Error:     errString,
+		Metadata:  data,
+	})
+}
+
+func (n *Notifier) OnQueryCompleted(commandTags []string, rows, bytes int64, sqlState, errorMessage string, latency time.Duration, data metadata.Metadata) {
+	n.writeEvent("query-completed", struct {
+		CommandTags []string          `json:"command_tags"`
+		Rows        int64             `json:"rows"`
+		Bytes       int64             `json:"bytes"`
+		Success     bool              `json:"success"`
+		SQLState    string            `json:"sqlstate,omitempty"`
+		Error       string            `json:"error,omitempty"`
+		LatencyMS   float64           `json:"latency_ms"`
+		Metadata    metadata.Metadata `json:"metadata"`
+	}{
+		CommandTags: commandTags,
+		Rows:        rows,
+		Bytes:       bytes,
+		Success:     sqlState == "" && errorMessage == "",
+		SQLState:    sqlState,
+		Error:       errorMessage,
+		LatencyMS:   float64(latency.Microseconds()) / 1000,
+		Metadata:    data,
+	})
+}
+
+func (n *Notifier) OnQueryRewritten(query, rewrittenQuery string, matchedRules []string, data metadata.Metadata) {
+	n.writeEvent("query-rewritten", struct {
+		Query          string            `json:"query"`
+		RewrittenQuery string            `json:"rewritten_query"`
+		MatchedRules   []string          `json:"matched_rules"`
+		Metadata       metadata.Metadata `json:"metadata"`
+	}{
+		Query:          query,
+		RewrittenQuery: rewrittenQuery,
+		MatchedRules:   matchedRules,
+		Metadata:       data,
+	})
+}
+
+func (n *Notifier) OnMask(columns []metadata.MaskedColumn, data metadata.Metadata) {
+	n.writeEvent("data-masked", struct {
+		Columns  []metadata.MaskedColumn `json:"columns"`
+		Metadata metadata.Metadata       `json:"metadata"`
+	}{
+		Columns:  columns,
+		Metadata: data,
+	})
+}
+
+func (n *Notifier) OnRowLimit(limit, rows int64, data metadata.Metadata) {
+	n.writeEvent("row-limit", struct {
+		Limit    int64             `json:"limit"`
+		Rows     int64             `json:"rows"`
+		Metadata metadata.Metadata `json:"metadata"`
+	}{
+		Limit:    limit,
+		Rows:     rows,
+		Metadata: data,
+	})
+}
+
+func (n *Notifier) OnReadOnlyViolation(reason error, data metadata.Metadata) {
+	n.writeEvent("read-only-violation", struct {
+		Reason   string            `json:"reason"`
+		Metadata metadata.Metadata `json:"metadata"`
+	}{
+		Reason:   reason.Error(),
 		Metadata: data,
 	})
 }
 
+func (n *Notifier) OnQueryTimeout(limit, elapsed time.Duration, disconnect bool, cancelErr error, data metadata.Metadata) {
+	var errString string
+	if cancelErr != nil {
+		errString = cancelErr.Error()
+	}
+	n.writeEvent("query-timeout", struct {
+		LimitMS    int64             `json:"limit_ms"`
+		ElapsedMS  int64             `json:"elapsed_ms"`
+		Cancelled  bool              `json:"cancelled"`
+		Disconnect bool              `json:"disconnect"`
+		Error      string            `json:"error,omitempty"`
+		Metadata   metadata.Metadata `json:"metadata"`
+	}{
+		LimitMS:    limit.Milliseconds(),
+		ElapsedMS:  elapsed.Milliseconds(),
+		Cancelled:  cancelErr == nil,
+		Disconnect: disconnect,
+		Error:      errString,
+		Metadata:   data,
+	})
+}
+
+func (n *Notifier) OnCopy(direction string, rows, bytes int64, duration time.Duration, copyErr error, data metadata.Metadata) {
+	var errString string
+	if copyErr != nil {
+		errString = copyErr.Error()
+	}
+	n.writeEvent("copy", struct {
+		Direction  string            `json:"direction"`
+		Rows       int64             `json:"rows"`
+		Bytes      int64             `json:"bytes"`
+		DurationMS int64             `json:"duration_ms"`
+		Success    bool              `json:"success"`
+		Error      string            `json:"error,omitempty"`
+		Metadata   metadata.Metadata `json:"metadata"`
+	}{
+		Direction:  direction,
+		Rows:       rows,
+		Bytes:      bytes,
+		DurationMS: duration.Milliseconds(),
+		Success:    copyErr == nil,
+		Error:      errString,
+		Metadata:   data,
+	})
+}
+
 func (n *Notifier) OnDatabaseAuth(authErr error, data metadata.Metadata) {
 	n.writeEvent("database-auth", struct {
 		AuthenticationError error             `json:"authentication_error"`
@@ -305,12 +588,28 @@ func (n *Notifier) OnDatabaseAuth(authErr error, data metadata.Metadata) {
 	})
 }
 
-func (n *Notifier) OnConnectionClosed(err error, data metadata.Metadata) {
+func (n *Notifier) OnConnectionClosed(err, reason error, data metadata.Metadata) {
+	var reasonString string
+	if reason != nil {
+		reasonString = reason.Error()
+	}
 	n.writeEvent("connection-closed", struct {
 		Error    error             `json:"error"`
+		Reason   string            `json:"reason,omitempty"`
 		Metadata metadata.Metadata `json:"metadata"`
 	}{
 		Error:    err,
+		Reason:   reasonString,
+		Metadata: data,
+	})
+}
+
+func (n *Notifier) OnSessionTerminated(reason error, data metadata.Metadata) {
+	n.writeEvent("session-terminated", struct {
+		Reason   string            `json:"reason"`
+		Metadata metadata.Metadata `json:"metadata"`
+	}{
+		Reason:   reason.Error(),
 		Metadata: data,
 	})
 }
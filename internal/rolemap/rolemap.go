@@ -0,0 +1,142 @@
+package rolemap
+
+import (
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"ssh-db-proxy/internal/config"
+)
+
+// Grant allows logging in as any role matching Roles to any database
+// matching Databases. No databases mean every database.
+type Grant struct {
+	Databases []string `json:"databases,omitempty"`
+	Roles     []string `json:"roles"`
+}
+
+type Grants []Grant
+
+// Allows reports whether logging in as role to database is granted.
+func (g Grants) Allows(database, role string) bool {
+	for _, grant := range g {
+		if len(grant.Databases) > 0 && !matchesAny(grant.Databases, database) {
+			continue
+		}
+		if matchesAny(grant.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles returns the role patterns granted on database.
+func (g Grants) Roles(database string) []string {
+	var roles []string
+	for _, grant := range g {
+		if len(grant.Databases) > 0 && !matchesAny(grant.Databases, database) {
+			continue
+		}
+		for _, role := range grant.Roles {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// Literal returns the only role name the pattern matches. It returns false if
+// the pattern matches more than one name.
+func Literal(pattern string) (string, bool) {
+	var (
+		b       strings.Builder
+		escaped bool
+	)
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case r == '*' || r == '?' || r == '[':
+			return "", false
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), true
+}
+
+// Mapper maps SSH principals and groups to PostgreSQL roles.
+type Mapper struct {
+	mu      sync.RWMutex
+	mapping config.RoleMapping
+}
+
+func New(mapping config.RoleMapping) *Mapper {
+	return &Mapper{mapping: mapping}
+}
+
+func (m *Mapper) Update(mapping config.RoleMapping) {
+	m.mu.Lock()
+	m.mapping = mapping
+	m.mu.Unlock()
+}
+
+// GroupsExtension returns the name of the certificate extension carrying
+// comma-separated groups of the user.
+func (m *Mapper) GroupsExtension() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mapping.GroupsExtension
+}
+
+// Resolve returns the roles the principals and groups are granted. Without
+// configured rules every principal is granted the role with the same name.
+func (m *Mapper) Resolve(principals, groups []string) Grants {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.mapping.Rules) == 0 {
+		roles := make([]string, 0, len(principals))
+		for _, principal := range principals {
+			roles = append(roles, escape(principal))
+		}
+		return Grants{{Roles: roles}}
+	}
+
+	var grants Grants
+	for _, rule := range m.mapping.Rules {
+		if !anyMatches(rule.Principals, principals) && !anyMatches(rule.Groups, groups) {
+			continue
+		}
+		grants = append(grants, Grant{Databases: rule.Databases, Roles: rule.Roles})
+	}
+	return grants
+}
+
+func anyMatches(patterns, values []string) bool {
+	for _, value := range values {
+		if matchesAny(patterns, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+func escape(s string) string {
+	return globEscaper.Replace(s)
+}
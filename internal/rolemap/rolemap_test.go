@@ -0,0 +1,64 @@
+package rolemap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/config"
+)
+
+func TestMapper(t *testing.T) {
+	t.Run("verbatim", func(t *testing.T) {
+		mapper := New(config.RoleMapping{})
+		grants := mapper.Resolve([]string{"alice", "app*"}, nil)
+		require.True(t, grants.Allows("orders", "alice"))
+		require.True(t, grants.Allows("orders", "app*"))
+		require.False(t, grants.Allows("orders", "application"))
+		require.False(t, grants.Allows("orders", "postgres"))
+		require.Equal(t, []string{"alice", `app\*`}, grants.Roles("orders"))
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		mapper := New(config.RoleMapping{
+			GroupsExtension: "groups@example.com",
+			Rules: []config.RoleMappingRule{
+				{Principals: []string{"alice"}, Roles: []string{"analyst"}},
+				{Groups: []string{"dba"}, Roles: []string{"postgres", "app_*"}, Databases: []string{"orders"}},
+			},
+		})
+		require.Equal(t, "groups@example.com", mapper.GroupsExtension())
+
+		grants := mapper.Resolve([]string{"alice"}, []string{"dba"})
+		require.Equal(t, Grants{
+			{Roles: []string{"analyst"}},
+			{Databases: []string{"orders"}, Roles: []string{"postgres", "app_*"}},
+		}, grants)
+		require.True(t, grants.Allows("billing", "analyst"))
+		require.True(t, grants.Allows("orders", "app_reader"))
+		require.False(t, grants.Allows("billing", "postgres"))
+		require.False(t, grants.Allows("orders", "alice"))
+		require.Equal(t, []string{"analyst", "postgres", "app_*"}, grants.Roles("orders"))
+		require.Equal(t, []string{"analyst"}, grants.Roles("billing"))
+
+		grants = mapper.Resolve([]string{"bob"}, []string{"developers"})
+		require.Empty(t, grants)
+		require.False(t, grants.Allows("orders", "bob"))
+
+		mapper.Update(config.RoleMapping{})
+		require.True(t, mapper.Resolve([]string{"bob"}, nil).Allows("orders", "bob"))
+	})
+}
+
+func TestLiteral(t *testing.T) {
+	role, ok := Literal(`app\*`)
+	require.True(t, ok)
+	require.Equal(t, "app*", role)
+
+	role, ok = Literal("analyst")
+	require.True(t, ok)
+	require.Equal(t, "analyst", role)
+
+	_, ok = Literal("app_*")
+	require.False(t, ok)
+}
@@ -18,22 +18,28 @@ const (
 	Update
 	Insert
 	Delete
+	CopyIn
+	CopyOut
 )
 
 var (
 	StatementTypeByString = map[string]StatementType{
-		"select": Select,
-		"join":   Join,
-		"update": Update,
-		"insert": Insert,
-		"delete": Delete,
+		"select":   Select,
+		"join":     Join,
+		"update":   Update,
+		"insert":   Insert,
+		"delete":   Delete,
+		"copy_in":  CopyIn,
+		"copy_out": CopyOut,
 	}
 	StringByStatementType = map[StatementType]string{
-		Select: "select",
-		Join:   "join",
-		Update: "update",
-		Insert: "insert",
-		Delete: "delete",
+		Select:  "select",
+		Join:    "join",
+		Update:  "update",
+		Insert:  "insert",
+		Delete:  "delete",
+		CopyIn:  "copy_in",
+		CopyOut: "copy_out",
 	}
 )
 
@@ -56,13 +62,59 @@ func ExtractQueryStatements(query string) ([]QueryStatement, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse query: %w", err)
 	}
+	return extractStatements(sliceMap(root.Stmts, func(item *pg_query.RawStmt) *pg_query.Node { return item.Stmt })), nil
+}
+
+// NamedQuery is a cursor or a prepared statement declared with SQL.
+type NamedQuery struct {
+	Cursor bool
+	Name   string
+}
+
+// ExtractNamedQueries returns the cursors and prepared statements declared by
+// the query with the statements of their queries, and the ones the query runs
+// with FETCH, MOVE and EXECUTE.
+func ExtractNamedQueries(query string) (map[NamedQuery][]QueryStatement, []NamedQuery, error) {
+	root, err := pg_query.Parse(query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse query: %w", err)
+	}
+	var (
+		declared = make(map[NamedQuery][]QueryStatement)
+		used     []NamedQuery
+	)
+	for _, raw := range root.Stmts {
+		node := raw.Stmt
+		if explain := node.GetExplainStmt(); explain != nil {
+			node = explain.Query
+		}
+		switch stmt := node.GetNode().(type) {
+		case *pg_query.Node_DeclareCursorStmt:
+			name := NamedQuery{Cursor: true, Name: stmt.DeclareCursorStmt.Portalname}
+			declared[name] = extractStatements([]*pg_query.Node{stmt.DeclareCursorStmt.Query})
+		case *pg_query.Node_PrepareStmt:
+			name := NamedQuery{Name: stmt.PrepareStmt.Name}
+			declared[name] = extractStatements([]*pg_query.Node{stmt.PrepareStmt.Query})
+		case *pg_query.Node_FetchStmt:
+			used = append(used, NamedQuery{Cursor: true, Name: stmt.FetchStmt.Portalname})
+		case *pg_query.Node_ExecuteStmt:
+			used = append(used, NamedQuery{Name: stmt.ExecuteStmt.Name})
+		case *pg_query.Node_CreateTableAsStmt:
+			if execute := stmt.CreateTableAsStmt.Query.GetExecuteStmt(); execute != nil {
+				used = append(used, NamedQuery{Name: execute.Name})
+			}
+		}
+	}
+	return declared, used, nil
+}
 
+func extractStatements(nodes []*pg_query.Node) []QueryStatement {
 	var (
 		tableAliases  = make(map[string]string)
 		columnAliases = make(map[string]struct{})
 		ctes          = make(map[string]struct{})
 		tables        = make(map[string]struct{})
-		statements    = make([]state, 0, len(root.Stmts))
+		statements    = make([]state, 0, len(nodes))
 		operations    = make(map[QueryStatement]struct{})
 	)
 
@@ -104,7 +156,7 @@ func ExtractQueryStatements(query string) ([]QueryStatement, error) {
 		return
 	}
 
-	statements = append(statements, sliceMap(root.Stmts, func(item *pg_query.RawStmt) state { return state{NoOp, "", item.Stmt} })...)
+	statements = append(statements, sliceMap(nodes, func(item *pg_query.Node) state { return state{NoOp, "", item} })...)
 	for len(statements) > 0 {
 		var statement state
 		if len(statements) > 0 {
@@ -223,6 +275,31 @@ func ExtractQueryStatements(query string) ([]QueryStatement, error) {
 					statements = append(statements, sliceMap(stmt.InsertStmt.OnConflictClause.Infer.IndexElems, func(item *pg_query.Node) state { return state{Select, currentTable, item} })...)
 				}
 			}
+		case *pg_query.Node_CopyStmt:
+			copyStmt := stmt.CopyStmt
+			typ := CopyOut
+			if copyStmt.IsFrom {
+				typ = CopyIn
+			}
+			if copyStmt.Relation != nil {
+				currentTable := handleRelation(copyStmt.Relation)
+				operations[QueryStatement{Type: typ, Table: currentTable, currentTable: true}] = struct{}{}
+				for _, item := range copyStmt.Attlist {
+					if column, ok := item.Node.(*pg_query.Node_String_); ok && column != nil {
+						operations[QueryStatement{Type: typ, Table: currentTable, Column: column.String_.Sval, currentTable: true}] = struct{}{}
+					}
+				}
+				statements = append(statements, state{Select, currentTable, copyStmt.WhereClause})
+			}
+			if copyStmt.Query != nil {
+				// COPY (query) TO copies out every table the query reads.
+				for _, op := range extractStatements([]*pg_query.Node{copyStmt.Query}) {
+					operations[op] = struct{}{}
+					if op.Table != "" {
+						operations[QueryStatement{Type: CopyOut, Table: op.Table}] = struct{}{}
+					}
+				}
+			}
 		case *pg_query.Node_FuncCall:
 			statements = append(statements, sliceMap(stmt.FuncCall.Args, func(item *pg_query.Node) state { return withNode(statement, item) })...)
 			if stmt.FuncCall.Over != nil {
@@ -255,6 +332,14 @@ func ExtractQueryStatements(query string) ([]QueryStatement, error) {
 		case *pg_query.Node_CommonTableExpr:
 			ctes[stmt.CommonTableExpr.Ctename] = struct{}{}
 			statements = append(statements, withNode(statement, stmt.CommonTableExpr.Ctequery))
+		case *pg_query.Node_DeclareCursorStmt:
+			statements = append(statements, withNode(statement, stmt.DeclareCursorStmt.Query))
+		case *pg_query.Node_ExplainStmt:
+			statements = append(statements, withNode(statement, stmt.ExplainStmt.Query))
+		case *pg_query.Node_PrepareStmt:
+			statements = append(statements, withNode(statement, stmt.PrepareStmt.Query))
+		case *pg_query.Node_CreateTableAsStmt:
+			statements = append(statements, withNode(statement, stmt.CreateTableAsStmt.Query))
 		}
 	}
 	preResult := make(map[QueryStatement]struct{}, len(operations))
@@ -270,7 +355,7 @@ func ExtractQueryStatements(query string) ([]QueryStatement, error) {
 	for op := range preResult {
 		result = append(result, op)
 	}
-	return result, nil
+	return result
 }
 
 func withNode(state state, newNode *pg_query.Node) state {
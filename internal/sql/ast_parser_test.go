@@ -787,3 +787,67 @@ WHERE employee_id IN (
 		})
 	})
 }
+
+func TestCopyStatements(t *testing.T) {
+	t.Run("copy-from-stdin", func(t *testing.T) {
+		ops, err := ExtractQueryStatements("copy users from stdin;")
+		require.NoError(t, err)
+		require.ElementsMatch(t, ops, []QueryStatement{
+			{Type: CopyIn, Table: "users", Column: ""},
+		})
+	})
+	t.Run("copy-columns", func(t *testing.T) {
+		ops, err := ExtractQueryStatements("copy users (id, email) from stdin with (format csv);")
+		require.NoError(t, err)
+		require.ElementsMatch(t, ops, []QueryStatement{
+			{Type: CopyIn, Table: "users", Column: ""},
+			{Type: CopyIn, Table: "users", Column: "id"},
+			{Type: CopyIn, Table: "users", Column: "email"},
+		})
+	})
+	t.Run("copy-to-stdout", func(t *testing.T) {
+		ops, err := ExtractQueryStatements("copy users to stdout;")
+		require.NoError(t, err)
+		require.ElementsMatch(t, ops, []QueryStatement{
+			{Type: CopyOut, Table: "users", Column: ""},
+		})
+	})
+	t.Run("copy-query", func(t *testing.T) {
+		ops, err := ExtractQueryStatements("copy (select u.email from users u where u.id > 10) to stdout;")
+		require.NoError(t, err)
+		require.ElementsMatch(t, ops, []QueryStatement{
+			{Type: Select, Table: "users", Column: "email"},
+			{Type: Select, Table: "users", Column: "id"},
+			{Type: CopyOut, Table: "users", Column: ""},
+		})
+	})
+}
+
+func TestWrappedQueryStatements(t *testing.T) {
+	for _, query := range []string{
+		"declare c cursor for select u.email from users u;",
+		"explain analyze select u.email from users u;",
+		"prepare p as select u.email from users u;",
+		"create table emails as select u.email from users u;",
+	} {
+		ops, err := ExtractQueryStatements(query)
+		require.NoError(t, err)
+		require.ElementsMatch(t, ops, []QueryStatement{
+			{Type: Select, Table: "users", Column: "email"},
+		}, query)
+	}
+}
+
+func TestNamedQueries(t *testing.T) {
+	declared, used, err := ExtractNamedQueries("begin; declare c cursor for select email from users; fetch all c; move c; prepare p as select id from orders; explain execute p; close c;")
+	require.NoError(t, err)
+	require.Equal(t, map[NamedQuery][]QueryStatement{
+		{Cursor: true, Name: "c"}: {{Type: Select, Table: "users", Column: "email"}},
+		{Name: "p"}:               {{Type: Select, Table: "orders", Column: "id"}},
+	}, declared)
+	require.Equal(t, []NamedQuery{{Cursor: true, Name: "c"}, {Cursor: true, Name: "c"}, {Name: "p"}}, used)
+
+	_, used, err = ExtractNamedQueries("create table copied as execute p(1);")
+	require.NoError(t, err)
+	require.Equal(t, []NamedQuery{{Name: "p"}}, used)
+}
@@ -0,0 +1,176 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	ErrWriteStatement   = errors.New("write statement in read-only session")
+	ErrReadOnlyOverride = errors.New("statement overrides read-only session")
+)
+
+// readOnlyParameters are the settings that make transactions read-only.
+var readOnlyParameters = map[string]bool{
+	"default_transaction_read_only": true,
+	"transaction_read_only":         true,
+}
+
+// IsReadOnlyParameter reports whether name is a setting that makes
+// transactions read-only. Setting names are case-insensitive.
+func IsReadOnlyParameter(name string) bool {
+	return readOnlyParameters[strings.ToLower(name)]
+}
+
+// CheckReadOnly returns ErrWriteStatement if the query may modify the
+// database, and ErrReadOnlyOverride if it tries to turn off read-only
+// transactions with SET, RESET, set_config, BEGIN READ WRITE or SET SESSION
+// CHARACTERISTICS. Only statements known to be read-only are allowed, so DDL,
+// DO and CALL are write statements too.
+func CheckReadOnly(query string) error {
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return fmt.Errorf("parse query: %w", err)
+	}
+	var checkErr error
+	for _, stmt := range tree.Stmts {
+		if !readOnlyStatement(stmt.Stmt) {
+			return fmt.Errorf("%w: %s", ErrWriteStatement, statementName(stmt.Stmt))
+		}
+		walkNodes(stmt.ProtoReflect(), func(msg protoreflect.Message) {
+			if checkErr == nil {
+				checkErr = checkReadOnlyNode(msg)
+			}
+		})
+		if checkErr != nil {
+			return checkErr
+		}
+	}
+	return nil
+}
+
+func readOnlyStatement(stmt *pg_query.Node) bool {
+	switch node := stmt.GetNode().(type) {
+	case *pg_query.Node_SelectStmt, *pg_query.Node_ExplainStmt, *pg_query.Node_VariableShowStmt,
+		*pg_query.Node_VariableSetStmt, *pg_query.Node_TransactionStmt, *pg_query.Node_DeclareCursorStmt,
+		*pg_query.Node_FetchStmt, *pg_query.Node_ClosePortalStmt, *pg_query.Node_PrepareStmt,
+		*pg_query.Node_ExecuteStmt, *pg_query.Node_DeallocateStmt, *pg_query.Node_ListenStmt,
+		*pg_query.Node_UnlistenStmt, *pg_query.Node_NotifyStmt, *pg_query.Node_DiscardStmt:
+		return true
+	case *pg_query.Node_CopyStmt:
+		return !node.CopyStmt.IsFrom
+	default:
+		return false
+	}
+}
+
+// checkReadOnlyNode checks the statements nested in read-only ones, such as
+// data-modifying CTEs, SELECT INTO and the statement of EXPLAIN or PREPARE.
+func checkReadOnlyNode(msg protoreflect.Message) error {
+	switch node := msg.Interface().(type) {
+	case *pg_query.InsertStmt, *pg_query.UpdateStmt, *pg_query.DeleteStmt, *pg_query.MergeStmt:
+		return fmt.Errorf("%w: %s", ErrWriteStatement, msg.Descriptor().Name())
+	case *pg_query.SelectStmt:
+		if node.IntoClause != nil {
+			return fmt.Errorf("%w: SELECT INTO", ErrWriteStatement)
+		}
+	case *pg_query.VariableSetStmt:
+		return checkVariableSet(node)
+	case *pg_query.TransactionStmt:
+		if !readOnlyOptions(node.Options) {
+			return fmt.Errorf("%w: read-write transaction", ErrReadOnlyOverride)
+		}
+	case *pg_query.FuncCall:
+		return checkSetConfig(node)
+	}
+	return nil
+}
+
+func checkVariableSet(stmt *pg_query.VariableSetStmt) error {
+	switch stmt.Kind {
+	case pg_query.VariableSetKind_VAR_SET_MULTI:
+		// SET TRANSACTION and SET SESSION CHARACTERISTICS AS TRANSACTION.
+		if !readOnlyOptions(stmt.Args) {
+			return fmt.Errorf("%w: %s READ WRITE", ErrReadOnlyOverride, stmt.Name)
+		}
+	case pg_query.VariableSetKind_VAR_SET_VALUE:
+		if IsReadOnlyParameter(stmt.Name) && !(len(stmt.Args) == 1 && constTrue(stmt.Args[0])) {
+			return fmt.Errorf("%w: SET %s", ErrReadOnlyOverride, stmt.Name)
+		}
+	case pg_query.VariableSetKind_VAR_SET_DEFAULT, pg_query.VariableSetKind_VAR_SET_CURRENT, pg_query.VariableSetKind_VAR_RESET:
+		if IsReadOnlyParameter(stmt.Name) {
+			return fmt.Errorf("%w: RESET %s", ErrReadOnlyOverride, stmt.Name)
+		}
+	}
+	return nil
+}
+
+// readOnlyOptions reports whether the transaction options do not ask for READ
+// WRITE.
+func readOnlyOptions(options []*pg_query.Node) bool {
+	for _, option := range options {
+		elem := option.GetDefElem()
+		if elem != nil && IsReadOnlyParameter(elem.Defname) && !constTrue(elem.Arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSetConfig rejects set_config calls that may change a read-only setting,
+// including calls whose setting name is not a constant.
+func checkSetConfig(call *pg_query.FuncCall) error {
+	if len(call.Funcname) == 0 || call.Funcname[len(call.Funcname)-1].GetString_().GetSval() != "set_config" {
+		return nil
+	}
+	if len(call.Args) > 0 {
+		if name, ok := constString(call.Args[0]); ok && !IsReadOnlyParameter(name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: set_config", ErrReadOnlyOverride)
+}
+
+func constString(node *pg_query.Node) (string, bool) {
+	value := node.GetAConst()
+	if value == nil || value.Isnull {
+		return "", false
+	}
+	switch {
+	case value.GetSval() != nil:
+		return value.GetSval().Sval, true
+	case value.GetIval() != nil:
+		return strconv.Itoa(int(value.GetIval().Ival)), true
+	case value.GetBoolval() != nil:
+		return strconv.FormatBool(value.GetBoolval().Boolval), true
+	default:
+		return "", false
+	}
+}
+
+// constTrue reports whether the node is a constant PostgreSQL reads as true.
+func constTrue(node *pg_query.Node) bool {
+	value, ok := constString(node)
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1", "t", "y":
+		return true
+	default:
+		return false
+	}
+}
+
+func statementName(stmt *pg_query.Node) string {
+	msg := stmt.ProtoReflect()
+	if field := msg.WhichOneof(msg.Descriptor().Oneofs().ByName("node")); field != nil {
+		return string(field.Message().Name())
+	}
+	return "unknown statement"
+}
@@ -0,0 +1,59 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReadOnly(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		err   error
+	}{
+		{query: "SELECT id, total FROM orders WHERE total > 10"},
+		{query: "WITH t AS (SELECT 1) SELECT * FROM t"},
+		{query: "EXPLAIN SELECT * FROM orders"},
+		{query: "SHOW default_transaction_read_only"},
+		{query: "BEGIN; SELECT 1; COMMIT"},
+		{query: "BEGIN ISOLATION LEVEL SERIALIZABLE, READ ONLY"},
+		{query: "SET statement_timeout = '5s'"},
+		{query: "SET default_transaction_read_only = on"},
+		{query: "SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY"},
+		{query: "COPY orders TO STDOUT"},
+		{query: "SELECT set_config('application_name', 'psql', false)"},
+		{query: "DECLARE c CURSOR FOR SELECT * FROM orders; FETCH 10 FROM c"},
+		{query: "INSERT INTO orders (id) VALUES (1)", err: ErrWriteStatement},
+		{query: "SELECT 1; UPDATE orders SET total = 0", err: ErrWriteStatement},
+		{query: "DELETE FROM orders", err: ErrWriteStatement},
+		{query: "WITH d AS (DELETE FROM orders RETURNING id) SELECT * FROM d", err: ErrWriteStatement},
+		{query: "SELECT * INTO backup FROM orders", err: ErrWriteStatement},
+		{query: "EXPLAIN ANALYZE UPDATE orders SET total = 0", err: ErrWriteStatement},
+		{query: "PREPARE p AS DELETE FROM orders", err: ErrWriteStatement},
+		{query: "COPY orders FROM STDIN", err: ErrWriteStatement},
+		{query: "TRUNCATE orders", err: ErrWriteStatement},
+		{query: "CREATE TABLE t (id int)", err: ErrWriteStatement},
+		{query: "DO $$ BEGIN PERFORM 1; END $$", err: ErrWriteStatement},
+		{query: "SET default_transaction_read_only = off", err: ErrReadOnlyOverride},
+		{query: "SET LOCAL transaction_read_only TO false", err: ErrReadOnlyOverride},
+		{query: "RESET default_transaction_read_only", err: ErrReadOnlyOverride},
+		{query: "SET default_transaction_read_only TO DEFAULT", err: ErrReadOnlyOverride},
+		{query: "BEGIN READ WRITE", err: ErrReadOnlyOverride},
+		{query: "START TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ WRITE", err: ErrReadOnlyOverride},
+		{query: "SET TRANSACTION READ WRITE", err: ErrReadOnlyOverride},
+		{query: "SET SESSION CHARACTERISTICS AS TRANSACTION READ WRITE", err: ErrReadOnlyOverride},
+		{query: "SELECT pg_catalog.set_config('default_transaction_read_only', 'off', false)", err: ErrReadOnlyOverride},
+		{query: "SELECT set_config(name, 'off', false) FROM settings", err: ErrReadOnlyOverride},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			err := CheckReadOnly(tt.query)
+			if tt.err == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	require.Error(t, CheckReadOnly("SELEC 1"))
+}
@@ -0,0 +1,302 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ErrFilteredMergeTarget is returned for MERGE into a filtered table, whose
+// rows cannot be restricted by a subquery.
+var ErrFilteredMergeTarget = errors.New("MERGE into a filtered table")
+
+// RowFilter restricts the rows of the tables it matches to those whose Column
+// equals Value.
+type RowFilter struct {
+	Match  func(table string) bool
+	Column string
+	Value  string
+}
+
+// AddRowFilters rewrites SELECT, UPDATE and DELETE statements of the query so
+// that they only see the rows passing the filters. Matching tables in FROM and
+// USING lists are replaced with filtered subqueries, and the predicate is added
+// to the WHERE clause of updated and deleted tables. COPY of a matching table
+// to the client becomes COPY of a filtered query. The source of MERGE is
+// filtered, and MERGE into a matching table is rejected with
+// ErrFilteredMergeTarget. It reports whether the query was changed.
+func AddRowFilters(query string, filters []RowFilter) (string, bool, error) {
+	if len(filters) == 0 {
+		return query, false, nil
+	}
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return "", false, fmt.Errorf("parse query: %w", err)
+	}
+
+	r := rowFilterRewriter{filters: filters}
+	for _, stmt := range tree.Stmts {
+		r.walk(stmt.ProtoReflect(), nil)
+	}
+	if r.err != nil {
+		return "", false, r.err
+	}
+	if !r.changed {
+		return query, false, nil
+	}
+	rewritten, err := pg_query.Deparse(tree)
+	if err != nil {
+		return "", false, fmt.Errorf("deparse query: %w", err)
+	}
+	return rewritten, true, nil
+}
+
+type rowFilterRewriter struct {
+	filters []RowFilter
+	// ctes are the names of the CTEs in scope of the statement being
+	// rewritten.
+	ctes    []string
+	changed bool
+	err     error
+}
+
+// walkNodes calls visit for every message of the tree after its children, so
+// that nodes added by visit are not visited again.
+func walkNodes(msg protoreflect.Message, visit func(protoreflect.Message)) {
+	msg.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case field.IsMap() || field.Message() == nil:
+		case field.IsList():
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				walkNodes(list.Get(i).Message(), visit)
+			}
+		default:
+			walkNodes(value.Message(), visit)
+		}
+		return true
+	})
+	visit(msg)
+}
+
+// walk rewrites every statement of the tree after its children, like
+// walkNodes, keeping track of the CTE names in scope. A CTE is only in scope
+// in the statement whose WITH clause defines it and in the CTEs following it
+// in the clause, or all of them if the clause is recursive.
+func (r *rowFilterRewriter) walk(msg protoreflect.Message, ctes []string) {
+	with := withClause(msg)
+	var names []string
+	if with != nil {
+		for _, node := range with.Ctes {
+			names = append(names, node.GetCommonTableExpr().GetCtename())
+		}
+	}
+	inner := slices.Concat(ctes, names)
+	msg.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case field.IsMap() || field.Message() == nil:
+		case with != nil && field.Name() == "with_clause":
+			for i, node := range with.Ctes {
+				visible := names[:i]
+				if with.Recursive {
+					visible = names
+				}
+				r.walk(node.ProtoReflect(), slices.Concat(ctes, visible))
+			}
+		case field.IsList():
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				r.walk(list.Get(i).Message(), inner)
+			}
+		default:
+			r.walk(value.Message(), inner)
+		}
+		return true
+	})
+	r.ctes = inner
+	r.rewrite(msg)
+}
+
+// withClause returns the WITH clause of a statement, or nil.
+func withClause(msg protoreflect.Message) *pg_query.WithClause {
+	switch stmt := msg.Interface().(type) {
+	case *pg_query.SelectStmt:
+		return stmt.WithClause
+	case *pg_query.InsertStmt:
+		return stmt.WithClause
+	case *pg_query.UpdateStmt:
+		return stmt.WithClause
+	case *pg_query.DeleteStmt:
+		return stmt.WithClause
+	case *pg_query.MergeStmt:
+		return stmt.WithClause
+	default:
+		return nil
+	}
+}
+
+func (r *rowFilterRewriter) rewrite(msg protoreflect.Message) {
+	switch stmt := msg.Interface().(type) {
+	case *pg_query.SelectStmt:
+		r.filterFromList(stmt.FromClause)
+	case *pg_query.UpdateStmt:
+		r.filterFromList(stmt.FromClause)
+		stmt.WhereClause = r.filterTarget(stmt.Relation, stmt.WhereClause)
+	case *pg_query.DeleteStmt:
+		r.filterFromList(stmt.UsingClause)
+		stmt.WhereClause = r.filterTarget(stmt.Relation, stmt.WhereClause)
+	case *pg_query.CopyStmt:
+		r.filterCopy(stmt)
+	case *pg_query.MergeStmt:
+		r.filterMerge(stmt)
+	}
+}
+
+// filterMerge filters the source of MERGE. MERGE into a matching table is
+// rejected, since its target cannot be replaced with a filtered subquery.
+func (r *rowFilterRewriter) filterMerge(stmt *pg_query.MergeStmt) {
+	r.filterFromItem(stmt.SourceRelation)
+	if stmt.Relation != nil && r.matches(stmt.Relation) && r.err == nil {
+		r.err = fmt.Errorf("%w: %s", ErrFilteredMergeTarget, stmt.Relation.Relname)
+	}
+}
+
+// filterCopy turns COPY of a matching table to the client into COPY of a query
+// selecting its filtered rows.
+func (r *rowFilterRewriter) filterCopy(stmt *pg_query.CopyStmt) {
+	if stmt.IsFrom || stmt.Relation == nil {
+		return
+	}
+	where := r.predicate(stmt.Relation, "", nil)
+	if where == nil {
+		return
+	}
+	targets := []*pg_query.Node{pg_query.MakeResTargetNodeWithVal(
+		pg_query.MakeColumnRefNode([]*pg_query.Node{pg_query.MakeAStarNode()}, -1), -1,
+	)}
+	if len(stmt.Attlist) > 0 {
+		targets = nil
+		for _, column := range stmt.Attlist {
+			targets = append(targets, pg_query.MakeResTargetNodeWithVal(
+				pg_query.MakeColumnRefNode([]*pg_query.Node{column}, -1), -1,
+			))
+		}
+	}
+	stmt.Query = &pg_query.Node{Node: &pg_query.Node_SelectStmt{SelectStmt: filteredSelect(stmt.Relation, targets, where)}}
+	stmt.Relation = nil
+	stmt.Attlist = nil
+}
+
+func filteredSelect(relation *pg_query.RangeVar, targets []*pg_query.Node, where *pg_query.Node) *pg_query.SelectStmt {
+	return &pg_query.SelectStmt{
+		TargetList: targets,
+		FromClause: []*pg_query.Node{{Node: &pg_query.Node_RangeVar{RangeVar: &pg_query.RangeVar{
+			Catalogname:    relation.Catalogname,
+			Schemaname:     relation.Schemaname,
+			Relname:        relation.Relname,
+			Inh:            relation.Inh,
+			Relpersistence: relation.Relpersistence,
+			Location:       -1,
+		}}}},
+		WhereClause: where,
+		Op:          pg_query.SetOperation_SETOP_NONE,
+		LimitOption: pg_query.LimitOption_LIMIT_OPTION_DEFAULT,
+	}
+}
+
+func (r *rowFilterRewriter) filterFromList(items []*pg_query.Node) {
+	for _, item := range items {
+		r.filterFromItem(item)
+	}
+}
+
+// filterFromItem replaces a matching table reference with a subquery
+// selecting its filtered rows under the same alias.
+func (r *rowFilterRewriter) filterFromItem(item *pg_query.Node) {
+	switch node := item.GetNode().(type) {
+	case *pg_query.Node_JoinExpr:
+		r.filterFromItem(node.JoinExpr.Larg)
+		r.filterFromItem(node.JoinExpr.Rarg)
+	case *pg_query.Node_RangeVar:
+		relation := node.RangeVar
+		where := r.predicate(relation, "", nil)
+		if where == nil {
+			return
+		}
+		alias := relation.Alias
+		if alias == nil {
+			alias = &pg_query.Alias{Aliasname: relation.Relname}
+		}
+		subquery := filteredSelect(relation, []*pg_query.Node{pg_query.MakeResTargetNodeWithVal(
+			pg_query.MakeColumnRefNode([]*pg_query.Node{pg_query.MakeAStarNode()}, -1), -1,
+		)}, where)
+		item.Node = &pg_query.Node_RangeSubselect{RangeSubselect: &pg_query.RangeSubselect{
+			Subquery: &pg_query.Node{Node: &pg_query.Node_SelectStmt{SelectStmt: subquery}},
+			Alias:    alias,
+		}}
+	}
+}
+
+// filterTarget adds the predicates of a matching updated or deleted table to
+// the WHERE clause.
+func (r *rowFilterRewriter) filterTarget(relation *pg_query.RangeVar, where *pg_query.Node) *pg_query.Node {
+	if relation == nil {
+		return where
+	}
+	qualifier := relation.Relname
+	if relation.Alias != nil {
+		qualifier = relation.Alias.Aliasname
+	}
+	return r.predicate(relation, qualifier, where)
+}
+
+// matches reports whether any filter matches the relation.
+func (r *rowFilterRewriter) matches(relation *pg_query.RangeVar) bool {
+	for _, filter := range r.filters {
+		if filter.Match(relation.Relname) {
+			return true
+		}
+	}
+	return false
+}
+
+// predicate returns where combined with the predicates of the filters
+// matching the relation, or nil if none matches and where is nil. References
+// to CTEs in scope are not filtered.
+func (r *rowFilterRewriter) predicate(relation *pg_query.RangeVar, qualifier string, where *pg_query.Node) *pg_query.Node {
+	if relation.Schemaname == "" && slices.Contains(r.ctes, relation.Relname) {
+		return where
+	}
+	var args []*pg_query.Node
+	if where != nil {
+		args = append(args, where)
+	}
+	for _, filter := range r.filters {
+		if !filter.Match(relation.Relname) {
+			continue
+		}
+		column := []*pg_query.Node{pg_query.MakeStrNode(filter.Column)}
+		if qualifier != "" {
+			column = append([]*pg_query.Node{pg_query.MakeStrNode(qualifier)}, column...)
+		}
+		args = append(args, pg_query.MakeAExprNode(
+			pg_query.A_Expr_Kind_AEXPR_OP,
+			[]*pg_query.Node{pg_query.MakeStrNode("=")},
+			pg_query.MakeColumnRefNode(column, -1),
+			pg_query.MakeAConstStrNode(filter.Value, -1),
+			-1,
+		))
+		r.changed = true
+	}
+	switch {
+	case len(args) == 0:
+		return nil
+	case len(args) == 1:
+		return args[0]
+	default:
+		return pg_query.MakeBoolExprNode(pg_query.BoolExprType_AND_EXPR, args, -1)
+	}
+}
@@ -0,0 +1,130 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddRowFilters(t *testing.T) {
+	filters := []RowFilter{{
+		Match:  func(table string) bool { return table == "orders" || table == "customers" },
+		Column: "tenant_id",
+		Value:  "acme",
+	}}
+
+	for _, tt := range []struct {
+		name      string
+		query     string
+		rewritten string
+	}{
+		{
+			name:      "select",
+			query:     "SELECT id, total FROM orders WHERE total > 10",
+			rewritten: "SELECT id, total FROM (SELECT * FROM orders WHERE tenant_id = 'acme') orders WHERE total > 10",
+		},
+		{
+			name:  "join with alias",
+			query: "SELECT o.id, c.name FROM orders o LEFT JOIN customers c ON c.id = o.customer_id JOIN products p ON p.id = o.product_id",
+			rewritten: "SELECT o.id, c.name FROM (SELECT * FROM orders WHERE tenant_id = 'acme') o " +
+				"LEFT JOIN (SELECT * FROM customers WHERE tenant_id = 'acme') c ON c.id = o.customer_id " +
+				"JOIN products p ON p.id = o.product_id",
+		},
+		{
+			name:  "subquery and union",
+			query: "SELECT id FROM products WHERE id IN (SELECT product_id FROM orders) UNION SELECT id FROM public.customers",
+			rewritten: "SELECT id FROM products WHERE id IN (SELECT product_id FROM (SELECT * FROM orders WHERE tenant_id = 'acme') orders) " +
+				"UNION SELECT id FROM (SELECT * FROM public.customers WHERE tenant_id = 'acme') customers",
+		},
+		{
+			name:      "update",
+			query:     "UPDATE orders SET total = 0 WHERE id = $1",
+			rewritten: "UPDATE orders SET total = 0 WHERE id = $1 AND orders.tenant_id = 'acme'",
+		},
+		{
+			name:      "delete using",
+			query:     "DELETE FROM orders o USING customers c WHERE c.id = o.customer_id",
+			rewritten: "DELETE FROM orders o USING (SELECT * FROM customers WHERE tenant_id = 'acme') c WHERE c.id = o.customer_id AND o.tenant_id = 'acme'",
+		},
+		{
+			name:      "delete without where",
+			query:     "DELETE FROM orders",
+			rewritten: "DELETE FROM orders WHERE orders.tenant_id = 'acme'",
+		},
+		{
+			name:      "cte",
+			query:     "WITH orders AS (SELECT * FROM customers) SELECT * FROM orders",
+			rewritten: "WITH orders AS (SELECT * FROM (SELECT * FROM customers WHERE tenant_id = 'acme') customers) SELECT * FROM orders",
+		},
+		{
+			name:      "cte of another statement",
+			query:     "WITH customers AS (SELECT 1) SELECT 1; SELECT * FROM customers",
+			rewritten: "WITH customers AS (SELECT 1) SELECT 1; SELECT * FROM (SELECT * FROM customers WHERE tenant_id = 'acme') customers",
+		},
+		{
+			name:  "cte of a lateral subquery",
+			query: "SELECT * FROM customers, LATERAL (WITH customers AS (SELECT 1) SELECT * FROM customers) x",
+			rewritten: "SELECT * FROM (SELECT * FROM customers WHERE tenant_id = 'acme') customers, " +
+				"LATERAL (WITH customers AS (SELECT 1) SELECT * FROM customers) x",
+		},
+		{
+			name:  "cte shadowing the table it selects",
+			query: "WITH orders AS (SELECT * FROM orders) SELECT * FROM orders",
+			rewritten: "WITH orders AS (SELECT * FROM (SELECT * FROM orders WHERE tenant_id = 'acme') orders) " +
+				"SELECT * FROM orders",
+		},
+		{
+			name:      "recursive cte",
+			query:     "WITH RECURSIVE orders AS (SELECT 1 AS id UNION ALL SELECT id + 1 FROM orders) SELECT * FROM orders",
+			rewritten: "WITH RECURSIVE orders AS (SELECT 1 AS id UNION ALL SELECT id + 1 FROM orders) SELECT * FROM orders",
+		},
+		{
+			name:  "merge source",
+			query: "MERGE INTO products p USING orders o ON p.id = o.product_id WHEN MATCHED THEN UPDATE SET sold = true",
+			rewritten: "MERGE INTO products p USING (SELECT * FROM orders WHERE tenant_id = 'acme') o ON p.id = o.product_id " +
+				"WHEN MATCHED THEN UPDATE SET sold = true",
+		},
+		{
+			name:      "copy to",
+			query:     "COPY orders (id, total) TO STDOUT",
+			rewritten: "COPY (SELECT id, total FROM orders WHERE tenant_id = 'acme') TO STDOUT",
+		},
+		{
+			name:      "copy query",
+			query:     "COPY (SELECT * FROM orders) TO STDOUT",
+			rewritten: "COPY (SELECT * FROM (SELECT * FROM orders WHERE tenant_id = 'acme') orders) TO STDOUT",
+		},
+		{
+			name:      "not matching",
+			query:     "select * from products",
+			rewritten: "select * from products",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rewritten, changed, err := AddRowFilters(tt.query, filters)
+			require.NoError(t, err)
+			require.Equal(t, tt.rewritten, rewritten)
+			require.Equal(t, tt.query != tt.rewritten, changed)
+		})
+	}
+
+	t.Run("quoted value", func(t *testing.T) {
+		rewritten, _, err := AddRowFilters("SELECT * FROM orders", []RowFilter{{
+			Match:  func(string) bool { return true },
+			Column: "tenant_id",
+			Value:  "x' OR '1'='1",
+		}})
+		require.NoError(t, err)
+		require.Equal(t, "SELECT * FROM (SELECT * FROM orders WHERE tenant_id = 'x'' OR ''1''=''1') orders", rewritten)
+	})
+
+	t.Run("merge target", func(t *testing.T) {
+		_, _, err := AddRowFilters("MERGE INTO orders o USING products p ON p.id = o.product_id WHEN MATCHED THEN DELETE", filters)
+		require.ErrorIs(t, err, ErrFilteredMergeTarget)
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		_, _, err := AddRowFilters("SELEC 1", filters)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SourceAddressOption  = "source-address"
+	ForceCommandOption   = "force-command"
+	VerifyRequiredOption = "verify-required"
+
+	UsersExtension       = "users"
+	ValidBeforeExtension = "valid-before"
+	KeyIDExtension       = "key-id"
+	AuthMethodExtension  = "auth-method"
+	DatabasesExtension   = "databases"
+	MFAExtension         = "mfa"
+
+	AuthMethodCertificate = "certificate"
+	AuthMethodPublicKey   = "public-key"
+
+	certExtensionPrefix = "cert-extension:"
+)
+
+var (
+	ErrUnsupportedCriticalOption = errors.New("unsupported critical option")
+	ErrSourceAddressNotAllowed   = errors.New("source address is not allowed")
+)
+
+// CheckCriticalOptions rejects certificates carrying critical options the proxy
+// does not understand, as OpenSSH does, and enforces source-address against
+// the address of the client. force-command is always rejected: the proxy runs
+// no commands, so it cannot restrict the certificate to one.
+func CheckCriticalOptions(cert *ssh.Certificate, remoteAddr net.Addr, supported []string) error {
+	for option, value := range cert.CriticalOptions {
+		switch {
+		case option == SourceAddressOption:
+			if err := CheckSourceAddress(remoteAddr, value); err != nil {
+				return err
+			}
+		case option == ForceCommandOption:
+			return fmt.Errorf("%w: %s is not enforced", ErrUnsupportedCriticalOption, option)
+		case slices.Contains(supported, option):
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedCriticalOption, option)
+		}
+	}
+	return nil
+}
+
+// EnforcedCriticalOptions returns the critical options CheckCriticalOptions
+// accepts given the supported ones.
+func EnforcedCriticalOptions(supported []string) []string {
+	return append([]string{SourceAddressOption}, supported...)
+}
+
+// CheckSourceAddress checks the address of the client against a comma-separated
+// list of addresses and CIDR subnets.
+func CheckSourceAddress(remoteAddr net.Addr, sourceAddresses string) error {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("%w: unknown remote address %v", ErrSourceAddressNotAllowed, remoteAddr)
+	}
+	for _, sourceAddress := range strings.Split(sourceAddresses, ",") {
+		sourceAddress = strings.TrimSpace(sourceAddress)
+		if ip := net.ParseIP(sourceAddress); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(sourceAddress)
+		if err != nil {
+			return fmt.Errorf("%w: invalid source-address %q: %w", ErrSourceAddressNotAllowed, sourceAddress, err)
+		}
+		if subnet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSourceAddressNotAllowed, tcpAddr.IP)
+}
+
+// NewPermissions builds the permissions of an authenticated connection. Database
+// users are stored under UsersExtension and certificate extensions are kept
+// under their own prefix, so a certificate cannot override proxy's values.
+func NewPermissions(cert *ssh.Certificate, users []string) *ssh.Permissions {
+	permissions := &ssh.Permissions{
+		CriticalOptions: make(map[string]string, len(cert.CriticalOptions)),
+		Extensions:      make(map[string]string, len(cert.Extensions)+4),
+	}
+	for option, value := range cert.CriticalOptions {
+		permissions.CriticalOptions[option] = value
+	}
+	for extension, value := range cert.Extensions {
+		permissions.Extensions[certExtensionPrefix+extension] = value
+	}
+	permissions.Extensions[UsersExtension] = strings.Join(users, ",")
+	permissions.Extensions[KeyIDExtension] = cert.KeyId
+	permissions.Extensions[AuthMethodExtension] = AuthMethodCertificate
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		permissions.Extensions[ValidBeforeExtension] = strconv.FormatUint(cert.ValidBefore, 10)
+	}
+	return permissions
+}
+
+// NewKeyPermissions builds the permissions of a connection authenticated with a
+// plain public key. Non-empty databases restrict the reachable databases.
+func NewKeyPermissions(keyID string, users, databases []string) *ssh.Permissions {
+	permissions := &ssh.Permissions{
+		Extensions: map[string]string{
+			UsersExtension:      strings.Join(users, ","),
+			KeyIDExtension:      keyID,
+			AuthMethodExtension: AuthMethodPublicKey,
+		},
+	}
+	if len(databases) > 0 {
+		permissions.Extensions[DatabasesExtension] = strings.Join(databases, ",")
+	}
+	return permissions
+}
+
+// AuthMethod returns the method the connection was authenticated with.
+func AuthMethod(permissions *ssh.Permissions) string {
+	if permissions == nil {
+		return ""
+	}
+	return permissions.Extensions[AuthMethodExtension]
+}
+
+// AllowedDatabases returns the patterns of databases the connection is
+// restricted to. No patterns mean every database.
+func AllowedDatabases(permissions *ssh.Permissions) []string {
+	if permissions == nil || permissions.Extensions[DatabasesExtension] == "" {
+		return nil
+	}
+	return strings.Split(permissions.Extensions[DatabasesExtension], ",")
+}
+
+// ValidBefore returns the expiry of the certificate the connection was
+// authenticated with. It returns false if the certificate never expires.
+func ValidBefore(permissions *ssh.Permissions) (time.Time, bool) {
+	if permissions == nil {
+		return time.Time{}, false
+	}
+	value, ok := permissions.Extensions[ValidBeforeExtension]
+	if !ok {
+		return time.Time{}, false
+	}
+	validBefore, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(validBefore, 0), true
+}
+
+// CertExtensions returns the extensions of the certificate the connection was
+// authenticated with.
+func CertExtensions(permissions *ssh.Permissions) map[string]string {
+	extensions := make(map[string]string)
+	if permissions == nil {
+		return extensions
+	}
+	for key, value := range permissions.Extensions {
+		if extension, ok := strings.CutPrefix(key, certExtensionPrefix); ok {
+			extensions[extension] = value
+		}
+	}
+	return extensions
+}
@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckCriticalOptions(t *testing.T) {
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 51234}
+
+	t.Run("no-options", func(t *testing.T) {
+		require.NoError(t, CheckCriticalOptions(&ssh.Certificate{}, remoteAddr, nil))
+	})
+
+	t.Run("source-address", func(t *testing.T) {
+		cert := &ssh.Certificate{Permissions: ssh.Permissions{CriticalOptions: map[string]string{
+			SourceAddressOption: "192.168.0.0/16,10.0.0.0/8",
+		}}}
+		require.NoError(t, CheckCriticalOptions(cert, remoteAddr, nil))
+
+		cert.CriticalOptions[SourceAddressOption] = "10.1.2.3"
+		require.NoError(t, CheckCriticalOptions(cert, remoteAddr, nil))
+
+		cert.CriticalOptions[SourceAddressOption] = "192.168.0.0/16, 10.1.2.4"
+		require.ErrorIs(t, CheckCriticalOptions(cert, remoteAddr, nil), ErrSourceAddressNotAllowed)
+
+		cert.CriticalOptions[SourceAddressOption] = "not-an-address"
+		require.ErrorIs(t, CheckCriticalOptions(cert, remoteAddr, nil), ErrSourceAddressNotAllowed)
+	})
+
+	t.Run("unknown-option", func(t *testing.T) {
+		cert := &ssh.Certificate{Permissions: ssh.Permissions{CriticalOptions: map[string]string{
+			"custom@example.com": "value",
+		}}}
+		require.ErrorIs(t, CheckCriticalOptions(cert, remoteAddr, nil), ErrUnsupportedCriticalOption)
+		require.NoError(t, CheckCriticalOptions(cert, remoteAddr, []string{"custom@example.com"}))
+
+		cert.CriticalOptions = map[string]string{VerifyRequiredOption: ""}
+		require.ErrorIs(t, CheckCriticalOptions(cert, remoteAddr, nil), ErrUnsupportedCriticalOption)
+	})
+
+	t.Run("force-command", func(t *testing.T) {
+		cert := &ssh.Certificate{Permissions: ssh.Permissions{CriticalOptions: map[string]string{
+			ForceCommandOption: "/bin/true",
+		}}}
+		require.ErrorIs(t, CheckCriticalOptions(cert, remoteAddr, nil), ErrUnsupportedCriticalOption)
+		require.ErrorIs(t, CheckCriticalOptions(cert, remoteAddr, []string{ForceCommandOption}), ErrUnsupportedCriticalOption)
+	})
+
+	t.Run("enforced-options", func(t *testing.T) {
+		require.Equal(t, []string{SourceAddressOption}, EnforcedCriticalOptions(nil))
+		require.Equal(t, []string{SourceAddressOption, "custom@example.com"},
+			EnforcedCriticalOptions([]string{"custom@example.com"}))
+	})
+}
+
+func TestNewPermissions(t *testing.T) {
+	cert := &ssh.Certificate{KeyId: "alice@example.com", ValidBefore: 1767225600, Permissions: ssh.Permissions{
+		CriticalOptions: map[string]string{SourceAddressOption: "10.0.0.0/8"},
+		Extensions:      map[string]string{"permit-port-forwarding": "", UsersExtension: "root"},
+	}}
+	permissions := NewPermissions(cert, []string{"alice", "bob"})
+
+	require.Equal(t, "alice,bob", permissions.Extensions[UsersExtension])
+	require.Equal(t, "alice@example.com", permissions.Extensions[KeyIDExtension])
+	require.Equal(t, AuthMethodCertificate, AuthMethod(permissions))
+	require.Empty(t, AllowedDatabases(permissions))
+	require.Equal(t, map[string]string{SourceAddressOption: "10.0.0.0/8"}, permissions.CriticalOptions)
+	require.Equal(t, map[string]string{"permit-port-forwarding": "", UsersExtension: "root"}, CertExtensions(permissions))
+
+	validBefore, ok := ValidBefore(permissions)
+	require.True(t, ok)
+	require.Equal(t, time.Unix(1767225600, 0), validBefore)
+
+	cert.ValidBefore = ssh.CertTimeInfinity
+	_, ok = ValidBefore(NewPermissions(cert, []string{"alice"}))
+	require.False(t, ok)
+}
+
+func TestNewKeyPermissions(t *testing.T) {
+	permissions := NewKeyPermissions("ci-deploy", []string{"deploy"}, []string{"orders", "billing-*"})
+	require.Equal(t, "deploy", permissions.Extensions[UsersExtension])
+	require.Equal(t, "ci-deploy", permissions.Extensions[KeyIDExtension])
+	require.Equal(t, AuthMethodPublicKey, AuthMethod(permissions))
+	require.Equal(t, []string{"orders", "billing-*"}, AllowedDatabases(permissions))
+	require.Empty(t, CertExtensions(permissions))
+
+	_, ok := ValidBefore(permissions)
+	require.False(t, ok)
+	require.Empty(t, AllowedDatabases(NewKeyPermissions("ci", []string{"deploy"}, nil)))
+}
@@ -0,0 +1,52 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNotHostCertificate  = errors.New("not a host certificate")
+	ErrCertificateMismatch = errors.New("certificate does not match private key")
+)
+
+// LoadHostSigner loads a host private key. If certificatePath is set, the
+// signer presents the host certificate instead of the bare key.
+func LoadHostSigner(privateKeyPath, certificatePath string) (ssh.Signer, error) {
+	privateKeyBytes, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read private host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key %s: %w", privateKeyPath, err)
+	}
+	if certificatePath == "" {
+		return signer, nil
+	}
+
+	certBytes, err := os.ReadFile(certificatePath)
+	if err != nil {
+		return nil, fmt.Errorf("read host certificate: %w", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse host certificate %s: %w", certificatePath, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%w: %s", ErrNotHostCertificate, certificatePath)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("%w: %s", ErrCertificateMismatch, certificatePath)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate signer: %w", err)
+	}
+	return certSigner, nil
+}
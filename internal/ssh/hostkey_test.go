@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeHostKey(t *testing.T, dir, name string) (string, ssh.Signer) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600))
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+	return keyPath, signer
+}
+
+func writeCertificate(t *testing.T, dir, name string, key ssh.PublicKey, certType uint32, ca ssh.Signer) string {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "proxy",
+		ValidPrincipals: []string{"proxy.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	certPath := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0o644))
+	return certPath
+}
+
+func TestLoadHostSigner(t *testing.T) {
+	dir := t.TempDir()
+	keyPath, signer := writeHostKey(t, dir, "host_key")
+	_, ca := writeHostKey(t, dir, "host_ca")
+
+	t.Run("key", func(t *testing.T) {
+		hostSigner, err := LoadHostSigner(keyPath, "")
+		require.NoError(t, err)
+		require.Equal(t, signer.PublicKey().Marshal(), hostSigner.PublicKey().Marshal())
+	})
+
+	t.Run("certificate", func(t *testing.T) {
+		certPath := writeCertificate(t, dir, "host_key-cert.pub", signer.PublicKey(), ssh.HostCert, ca)
+		hostSigner, err := LoadHostSigner(keyPath, certPath)
+		require.NoError(t, err)
+		cert, ok := hostSigner.PublicKey().(*ssh.Certificate)
+		require.True(t, ok)
+		require.Equal(t, "proxy", cert.KeyId)
+	})
+
+	t.Run("user-certificate", func(t *testing.T) {
+		certPath := writeCertificate(t, dir, "user-cert.pub", signer.PublicKey(), ssh.UserCert, ca)
+		_, err := LoadHostSigner(keyPath, certPath)
+		require.ErrorIs(t, err, ErrNotHostCertificate)
+	})
+
+	t.Run("other-key", func(t *testing.T) {
+		certPath := writeCertificate(t, dir, "ca-cert.pub", ca.PublicKey(), ssh.HostCert, ca)
+		_, err := LoadHostSigner(keyPath, certPath)
+		require.ErrorIs(t, err, ErrCertificateMismatch)
+	})
+}
@@ -1,8 +1,21 @@
 package ssh
 
+const (
+	DirectTCPIPChannelType       = "direct-tcpip"
+	DirectStreamLocalChannelType = "direct-streamlocal@openssh.com"
+)
+
 type DirectTCPIPPayload struct {
 	HostToConnect       string
 	PortToConnect       uint32
 	OriginatorIPAddress string
 	OriginatorPort      uint32
 }
+
+// DirectStreamLocalPayload is the payload of a direct-streamlocal@openssh.com
+// channel as described in OpenSSH PROTOCOL, section 2.4.
+type DirectStreamLocalPayload struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
@@ -0,0 +1,179 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"ssh-db-proxy/internal/config"
+)
+
+// Modes of authentication to the database.
+const (
+	AuthCertificate = config.DatabaseAuthCertificate
+	AuthPassword    = config.DatabaseAuthPassword
+	AuthPassthrough = config.DatabaseAuthPassthrough
+)
+
+var (
+	ErrUnknownDatabase     = errors.New("unknown database")
+	ErrForbiddenPrincipals = errors.New("no principals allowed to reach database")
+)
+
+// Database is an upstream PostgreSQL server clients are allowed to reach. It
+// listens either on Host and Port or on the Unix socket Socket.
+type Database struct {
+	Name              string
+	Host              string
+	Port              uint32
+	Socket            string
+	Alias             string
+	AllowedPrincipals []string
+	CACertPool        *x509.CertPool
+	// TLSCertificate is presented to clients that request TLS. If it is nil,
+	// a certificate is issued on demand.
+	TLSCertificate *tls.Certificate
+	// Auth is the way the proxy authenticates to the database, one of the
+	// Auth* modes.
+	Auth      string
+	passwords map[string]string
+}
+
+// Password returns the password of the role for password authentication.
+func (d *Database) Password(role string) (string, bool) {
+	password, ok := d.passwords[role]
+	return password, ok
+}
+
+// Permits reports whether any of the principals is allowed to reach the database.
+func (d *Database) Permits(principals []string) bool {
+	if len(d.AllowedPrincipals) == 0 {
+		return true
+	}
+	for _, principal := range principals {
+		for _, pattern := range d.AllowedPrincipals {
+			if matched, _ := path.Match(pattern, principal); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Registry holds the configured upstream databases.
+type Registry struct {
+	mu        sync.RWMutex
+	databases []*Database
+}
+
+func NewRegistry(databases map[string]config.Database) (*Registry, error) {
+	r := &Registry{}
+	if err := r.Update(databases); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) Update(databases map[string]config.Database) error {
+	newDatabases := make([]*Database, 0, len(databases))
+	for name, database := range databases {
+		var certPool *x509.CertPool
+		if database.CAPath != "" {
+			pems, err := os.ReadFile(database.CAPath)
+			if err != nil {
+				return fmt.Errorf("read CA bundle of database %s: %w", name, err)
+			}
+			certPool = x509.NewCertPool()
+			if !certPool.AppendCertsFromPEM(pems) {
+				return fmt.Errorf("no certificates found in CA bundle of database %s", name)
+			}
+		}
+		var tlsCert *tls.Certificate
+		if database.TLSCertPath != "" {
+			cert, err := tls.LoadX509KeyPair(database.TLSCertPath, database.TLSKeyPath)
+			if err != nil {
+				return fmt.Errorf("load TLS certificate of database %s: %w", name, err)
+			}
+			tlsCert = &cert
+		}
+		auth := database.Auth.Mode
+		if auth == "" {
+			auth = AuthCertificate
+		}
+		var passwords map[string]string
+		if auth == AuthPassword {
+			data, err := os.ReadFile(database.Auth.SecretsPath)
+			if err != nil {
+				return fmt.Errorf("read secrets of database %s: %w", name, err)
+			}
+			if err := yaml.Unmarshal(data, &passwords); err != nil {
+				return fmt.Errorf("unmarshal secrets of database %s: %w", name, err)
+			}
+		}
+		newDatabases = append(newDatabases, &Database{
+			Name:              name,
+			Host:              database.Host,
+			Port:              database.Port,
+			Socket:            database.Socket,
+			Alias:             database.Alias,
+			AllowedPrincipals: database.AllowedPrincipals,
+			CACertPool:        certPool,
+			TLSCertificate:    tlsCert,
+			Auth:              auth,
+			passwords:         passwords,
+		})
+	}
+	sort.Slice(newDatabases, func(i, j int) bool {
+		return newDatabases[i].Name < newDatabases[j].Name
+	})
+
+	r.mu.Lock()
+	r.databases = newDatabases
+	r.mu.Unlock()
+	return nil
+}
+
+// Lookup finds the database the client asked to connect to. The target matches
+// either the real host and port of a database or its alias with any port.
+func (r *Registry) Lookup(host string, port uint32) (*Database, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, database := range r.databases {
+		if database.Alias != "" && database.Alias == host {
+			return database, nil
+		}
+		if database.Socket == "" && database.Host == host && database.Port == port {
+			return database, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s:%d", ErrUnknownDatabase, host, port)
+}
+
+// LookupSocket finds the database listening on the Unix socket the client
+// asked to connect to.
+func (r *Registry) LookupSocket(socketPath string) (*Database, error) {
+	socketPath = path.Clean(socketPath)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, database := range r.databases {
+		if database.Socket != "" && path.Clean(database.Socket) == socketPath {
+			return database, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownDatabase, socketPath)
+}
+
+// List returns the registered databases sorted by name.
+func (r *Registry) List() []*Database {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.databases)
+}
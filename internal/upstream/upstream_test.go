@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"ssh-db-proxy/internal/config"
+)
+
+func writeCA(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	p := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return p
+}
+
+func TestRegistry(t *testing.T) {
+	caPath := writeCA(t)
+
+	registry, err := NewRegistry(map[string]config.Database{
+		"orders": {Host: "orders.db.internal", Port: 5432, CAPath: caPath},
+		"billing": {
+			Host:              "10.0.0.5",
+			Port:              6432,
+			Alias:             "billing",
+			CAPath:            caPath,
+			AllowedPrincipals: []string{"billing-*", "alice"},
+		},
+		"local": {Socket: "/var/run/postgresql/.s.PGSQL.5432", Alias: "local"},
+	})
+	require.NoError(t, err)
+
+	databases := registry.List()
+	require.Len(t, databases, 3)
+	require.Equal(t, "billing", databases[0].Name)
+	require.Equal(t, "local", databases[1].Name)
+	require.Equal(t, "orders", databases[2].Name)
+
+	database, err := registry.LookupSocket("/var/run/postgresql//.s.PGSQL.5432")
+	require.NoError(t, err)
+	require.Equal(t, "local", database.Name)
+	require.Nil(t, database.CACertPool)
+	_, err = registry.LookupSocket("/var/run/postgresql/.s.PGSQL.5433")
+	require.ErrorIs(t, err, ErrUnknownDatabase)
+	_, err = registry.Lookup("", 0)
+	require.ErrorIs(t, err, ErrUnknownDatabase)
+	database, err = registry.Lookup("local", 5432)
+	require.NoError(t, err)
+	require.Equal(t, "local", database.Name)
+
+	database, err = registry.Lookup("orders.db.internal", 5432)
+	require.NoError(t, err)
+	require.Equal(t, "orders", database.Name)
+	require.NotNil(t, database.CACertPool)
+	require.True(t, database.Permits([]string{"anyone"}))
+
+	_, err = registry.Lookup("orders.db.internal", 5433)
+	require.ErrorIs(t, err, ErrUnknownDatabase)
+	_, err = registry.Lookup("127.0.0.1", 22)
+	require.ErrorIs(t, err, ErrUnknownDatabase)
+
+	database, err = registry.Lookup("billing", 5432)
+	require.NoError(t, err)
+	require.Equal(t, "billing", database.Name)
+	require.Equal(t, "10.0.0.5", database.Host)
+	require.True(t, database.Permits([]string{"bob", "billing-readers"}))
+	require.True(t, database.Permits([]string{"alice"}))
+	require.False(t, database.Permits([]string{"bob"}))
+
+	require.NoError(t, registry.Update(map[string]config.Database{
+		"billing": {Host: "10.0.0.5", Port: 6432, CAPath: caPath},
+	}))
+	_, err = registry.Lookup("orders.db.internal", 5432)
+	require.ErrorIs(t, err, ErrUnknownDatabase)
+	_, err = registry.Lookup("billing", 5432)
+	require.ErrorIs(t, err, ErrUnknownDatabase)
+	_, err = registry.Lookup("10.0.0.5", 6432)
+	require.NoError(t, err)
+
+	require.Error(t, registry.Update(map[string]config.Database{
+		"broken": {Host: "10.0.0.6", Port: 5432, CAPath: filepath.Join(t.TempDir(), "missing.pem")},
+	}))
+}
+
+func TestRegistryAuth(t *testing.T) {
+	caPath := writeCA(t)
+	secretsPath := filepath.Join(t.TempDir(), "orders-secrets.yaml")
+	require.NoError(t, os.WriteFile(secretsPath, []byte("app: s3cret\nanalyst: \"p@ss: word\"\n"), 0o600))
+
+	registry, err := NewRegistry(map[string]config.Database{
+		"orders": {
+			Host:   "orders.db.internal",
+			Port:   5432,
+			CAPath: caPath,
+			Auth:   config.DatabaseAuth{Mode: config.DatabaseAuthPassword, SecretsPath: secretsPath},
+		},
+		"billing": {Host: "billing.db.internal", Port: 5432, CAPath: caPath},
+	})
+	require.NoError(t, err)
+
+	database, err := registry.Lookup("orders.db.internal", 5432)
+	require.NoError(t, err)
+	require.Equal(t, AuthPassword, database.Auth)
+	password, ok := database.Password("analyst")
+	require.True(t, ok)
+	require.Equal(t, "p@ss: word", password)
+	_, ok = database.Password("postgres")
+	require.False(t, ok)
+
+	database, err = registry.Lookup("billing.db.internal", 5432)
+	require.NoError(t, err)
+	require.Equal(t, AuthCertificate, database.Auth)
+
+	require.Error(t, registry.Update(map[string]config.Database{
+		"orders": {
+			Host:   "orders.db.internal",
+			Port:   5432,
+			CAPath: caPath,
+			Auth:   config.DatabaseAuth{Mode: config.DatabaseAuthPassword, SecretsPath: filepath.Join(t.TempDir(), "missing.yaml")},
+		},
+	}))
+}
@@ -0,0 +1,323 @@
+package userca
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH key revocation list format, see PROTOCOL.krl in the OpenSSH sources.
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+var ErrInvalidKRL = errors.New("invalid KRL")
+
+type KRL struct {
+	certificates []*krlCertificates
+	keys         map[string]struct{}
+	sha1         map[string]struct{}
+	sha256       map[string]struct{}
+}
+
+type krlCertificates struct {
+	ca      []byte
+	serials map[uint64]struct{}
+	ranges  []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]struct{}
+}
+
+type serialRange struct {
+	min uint64
+	max uint64
+}
+
+type serialBitmap struct {
+	offset uint64
+	bitmap *big.Int
+}
+
+// ParseKRL parses a binary OpenSSH KRL. If data does not start with the KRL
+// magic, it is treated as a plain list of revoked public keys, one per line,
+// like sshd's RevokedKeys does.
+func ParseKRL(data []byte) (*KRL, error) {
+	krl := &KRL{
+		keys:   make(map[string]struct{}),
+		sha1:   make(map[string]struct{}),
+		sha256: make(map[string]struct{}),
+	}
+	if !bytes.HasPrefix(data, []byte(krlMagic)) {
+		keys, err := parseKeys(data, true)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKRL, err)
+		}
+		for _, key := range keys {
+			krl.keys[string(key.Marshal())] = struct{}{}
+		}
+		return krl, nil
+	}
+
+	r := &krlReader{data: data[len(krlMagic):]}
+	version, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != krlFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidKRL, version)
+	}
+	// krl_version, generated_date, flags, reserved and comment are not used.
+	for i := 0; i < 3; i++ {
+		if _, err := r.uint64(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	for len(r.data) > 0 {
+		sectionType, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		sectionData, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		section := &krlReader{data: sectionData}
+		switch sectionType {
+		case krlSectionCertificates:
+			certificates, err := parseKRLCertificates(section)
+			if err != nil {
+				return nil, err
+			}
+			krl.certificates = append(krl.certificates, certificates)
+		case krlSectionExplicitKey:
+			if err := section.strings(krl.keys); err != nil {
+				return nil, err
+			}
+		case krlSectionFingerprintSHA1:
+			if err := section.strings(krl.sha1); err != nil {
+				return nil, err
+			}
+		case krlSectionFingerprintSHA256:
+			if err := section.strings(krl.sha256); err != nil {
+				return nil, err
+			}
+		case krlSectionSignature:
+			// Signatures are always trailing, and sshd does not verify them either.
+			return krl, nil
+		default:
+			return nil, fmt.Errorf("%w: unsupported section type %d", ErrInvalidKRL, sectionType)
+		}
+	}
+	return krl, nil
+}
+
+func parseKRLCertificates(r *krlReader) (*krlCertificates, error) {
+	ca, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.string(); err != nil {
+		return nil, err
+	}
+	certificates := &krlCertificates{
+		serials: make(map[uint64]struct{}),
+		keyIDs:  make(map[string]struct{}),
+	}
+	if len(ca) > 0 {
+		certificates.ca = ca
+	}
+	for len(r.data) > 0 {
+		sectionType, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		sectionData, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		section := &krlReader{data: sectionData}
+		switch sectionType {
+		case krlSectionCertSerialList:
+			for len(section.data) > 0 {
+				serial, err := section.uint64()
+				if err != nil {
+					return nil, err
+				}
+				certificates.serials[serial] = struct{}{}
+			}
+		case krlSectionCertSerialRange:
+			min, err := section.uint64()
+			if err != nil {
+				return nil, err
+			}
+			max, err := section.uint64()
+			if err != nil {
+				return nil, err
+			}
+			if min > max {
+				return nil, fmt.Errorf("%w: invalid serial range %d-%d", ErrInvalidKRL, min, max)
+			}
+			certificates.ranges = append(certificates.ranges, serialRange{min: min, max: max})
+		case krlSectionCertSerialBitmap:
+			offset, err := section.uint64()
+			if err != nil {
+				return nil, err
+			}
+			bitmap, err := section.string()
+			if err != nil {
+				return nil, err
+			}
+			certificates.bitmaps = append(certificates.bitmaps, serialBitmap{offset: offset, bitmap: new(big.Int).SetBytes(bitmap)})
+		case krlSectionCertKeyID:
+			if err := section.strings(certificates.keyIDs); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported certificate section type %d", ErrInvalidKRL, sectionType)
+		}
+	}
+	return certificates, nil
+}
+
+// IsRevoked reports whether the key is revoked. For a certificate both the
+// certificate itself and its underlying and signing keys are checked.
+func (k *KRL) IsRevoked(key ssh.PublicKey) bool {
+	if k == nil {
+		return false
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if k.isCertificateRevoked(cert) {
+			return true
+		}
+		return k.isKeyRevoked(cert.Key) || k.isKeyRevoked(cert.SignatureKey)
+	}
+	return k.isKeyRevoked(key)
+}
+
+func (k *KRL) isKeyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	if _, ok := k.keys[string(blob)]; ok {
+		return true
+	}
+	sha1Sum := sha1.Sum(blob)
+	if _, ok := k.sha1[string(sha1Sum[:])]; ok {
+		return true
+	}
+	sha256Sum := sha256.Sum256(blob)
+	if _, ok := k.sha256[string(sha256Sum[:])]; ok {
+		return true
+	}
+	return false
+}
+
+func (k *KRL) isCertificateRevoked(cert *ssh.Certificate) bool {
+	ca := cert.SignatureKey.Marshal()
+	for _, certificates := range k.certificates {
+		if certificates.ca != nil && !bytes.Equal(certificates.ca, ca) {
+			continue
+		}
+		if _, ok := certificates.keyIDs[cert.KeyId]; ok {
+			return true
+		}
+		// Zero serial is the default when the CA does not specify one, OpenSSH ignores it as well.
+		if cert.Serial == 0 {
+			continue
+		}
+		if _, ok := certificates.serials[cert.Serial]; ok {
+			return true
+		}
+		for _, r := range certificates.ranges {
+			if r.min <= cert.Serial && cert.Serial <= r.max {
+				return true
+			}
+		}
+		for _, b := range certificates.bitmaps {
+			if cert.Serial < b.offset || cert.Serial-b.offset >= uint64(b.bitmap.BitLen()) {
+				continue
+			}
+			if b.bitmap.Bit(int(cert.Serial-b.offset)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type krlReader struct {
+	data []byte
+}
+
+func (r *krlReader) byte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidKRL)
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+func (r *krlReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidKRL)
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *krlReader) uint64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidKRL)
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v, nil
+}
+
+func (r *krlReader) string() ([]byte, error) {
+	length, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(r.data)) < length {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidKRL)
+	}
+	s := r.data[:length]
+	r.data = r.data[length:]
+	return s, nil
+}
+
+func (r *krlReader) strings(set map[string]struct{}) error {
+	for len(r.data) > 0 {
+		s, err := r.string()
+		if err != nil {
+			return err
+		}
+		set[string(s)] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package userca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/config"
+)
+
+var (
+	ErrNotChanged                = errors.New("user CAs not changed")
+	ErrUnknownAuthority          = errors.New("unknown certificate authority")
+	ErrRevoked                   = errors.New("certificate is revoked")
+	ErrForbiddenPrincipals       = errors.New("no permitted principals")
+	ErrInvalidSignature          = errors.New("invalid certificate signature")
+	ErrNotUserCertificate        = errors.New("not a user certificate")
+	ErrUnsupportedCriticalOption = errors.New("unsupported critical option")
+)
+
+type authority struct {
+	key        ssh.PublicKey
+	principals []string
+}
+
+// Authorities is a set of trusted user CAs together with the KRL that
+// certificates signed by them are checked against.
+type Authorities struct {
+	mu          sync.RWMutex
+	authorities []authority
+	krl         *KRL
+	checksum    []byte
+}
+
+func New(cas []config.UserCA, krlPath string) (*Authorities, error) {
+	a := &Authorities{}
+	if err := a.Update(cas, krlPath); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Update rereads the CA bundles and the KRL. It returns ErrNotChanged if
+// neither the files nor the principal restrictions have changed.
+func (a *Authorities) Update(cas []config.UserCA, krlPath string) error {
+	sha := sha256.New()
+	authorities := make([]authority, 0, len(cas))
+	for _, ca := range cas {
+		data, err := os.ReadFile(ca.Path)
+		if err != nil {
+			return fmt.Errorf("read user CA bundle %s: %w", ca.Path, err)
+		}
+		keys, err := parseKeys(data, false)
+		if err != nil {
+			return fmt.Errorf("parse user CA bundle %s: %w", ca.Path, err)
+		}
+		sha.Write(data)
+		for _, principal := range ca.Principals {
+			sha.Write([]byte(principal))
+		}
+		for _, key := range keys {
+			authorities = append(authorities, authority{key: key, principals: ca.Principals})
+		}
+	}
+
+	var krl *KRL
+	if krlPath != "" {
+		data, err := os.ReadFile(krlPath)
+		if err != nil {
+			return fmt.Errorf("read KRL %s: %w", krlPath, err)
+		}
+		krl, err = ParseKRL(data)
+		if err != nil {
+			return fmt.Errorf("parse KRL %s: %w", krlPath, err)
+		}
+		sha.Write(data)
+	}
+	checksum := sha.Sum(nil)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if bytes.Equal(a.checksum, checksum) {
+		return ErrNotChanged
+	}
+	a.authorities = authorities
+	a.krl = krl
+	a.checksum = checksum
+	return nil
+}
+
+// Verify checks that the user certificate is signed by a trusted CA and is
+// not revoked. Certificates with critical options other than criticalOptions,
+// the ones the caller enforces, are rejected. It returns the certificate
+// principals permitted by the signing CA.
+func (a *Authorities) Verify(cert *ssh.Certificate, criticalOptions []string) ([]string, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.krl.IsRevoked(cert) {
+		return nil, fmt.Errorf("%w: serial %d", ErrRevoked, cert.Serial)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%w: type %d", ErrNotUserCertificate, cert.CertType)
+	}
+
+	var (
+		known      bool
+		principals []string
+	)
+	signatureKey := cert.SignatureKey.Marshal()
+	for _, authority := range a.authorities {
+		if subtle.ConstantTimeCompare(authority.key.Marshal(), signatureKey) == 0 {
+			continue
+		}
+		known = true
+		for _, principal := range cert.ValidPrincipals {
+			if authority.permits(principal) && !slices.Contains(principals, principal) {
+				principals = append(principals, principal)
+			}
+		}
+	}
+	if !known {
+		return nil, ErrUnknownAuthority
+	}
+	if err := verifySignature(cert, criticalOptions); err != nil {
+		return nil, err
+	}
+	if len(principals) == 0 {
+		return nil, ErrForbiddenPrincipals
+	}
+	return principals, nil
+}
+
+// Trusts reports whether the certificate is validly signed by a trusted CA,
+// regardless of its validity period, principals and revocation. Like Verify,
+// it rejects critical options other than criticalOptions.
+func (a *Authorities) Trusts(cert *ssh.Certificate, criticalOptions []string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	signatureKey := cert.SignatureKey.Marshal()
+	for _, authority := range a.authorities {
+		if subtle.ConstantTimeCompare(authority.key.Marshal(), signatureKey) == 1 {
+			return verifySignature(cert, criticalOptions) == nil
+		}
+	}
+	return false
+}
+
+// verifySignature checks the CA signature of the certificate and rejects
+// critical options not listed in criticalOptions. CertChecker lets
+// source-address through, so options are checked here. The validity period is
+// checked by the caller.
+func verifySignature(cert *ssh.Certificate, criticalOptions []string) error {
+	for option := range cert.CriticalOptions {
+		if !slices.Contains(criticalOptions, option) {
+			return fmt.Errorf("%w: %s", ErrUnsupportedCriticalOption, option)
+		}
+	}
+	checker := ssh.CertChecker{
+		SupportedCriticalOptions: criticalOptions,
+		Clock: func() time.Time {
+			return time.Unix(int64(cert.ValidAfter), 0)
+		},
+	}
+	var principal string
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// IsRevoked reports whether the plain public key is revoked by the KRL.
+func (a *Authorities) IsRevoked(key ssh.PublicKey) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.krl.IsRevoked(key)
+}
+
+func (a authority) permits(principal string) bool {
+	if len(a.principals) == 0 {
+		return true
+	}
+	for _, pattern := range a.principals {
+		if matched, _ := path.Match(pattern, principal); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func parseKeys(data []byte, allowEmpty bool) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	rest := data
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			if len(keys) > 0 || allowEmpty {
+				break
+			}
+			return nil, err
+		}
+		keys = append(keys, key)
+		rest = next
+	}
+	if len(keys) == 0 && !allowEmpty {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
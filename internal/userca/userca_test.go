@@ -0,0 +1,242 @@
+package userca
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"ssh-db-proxy/internal/config"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+func newCertificate(t *testing.T, ca ssh.Signer, serial uint64, keyID string, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             newSigner(t).PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	p := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(p, data, 0o600))
+	return p
+}
+
+type krlBuilder struct {
+	data []byte
+}
+
+func newKRLBuilder() *krlBuilder {
+	b := &krlBuilder{data: []byte(krlMagic)}
+	b.uint32(krlFormatVersion)
+	b.uint64(1)
+	b.uint64(uint64(time.Now().Unix()))
+	b.uint64(0)
+	b.string(nil)
+	b.string([]byte("test"))
+	return b
+}
+
+func (b *krlBuilder) uint32(v uint32) {
+	b.data = binary.BigEndian.AppendUint32(b.data, v)
+}
+
+func (b *krlBuilder) uint64(v uint64) {
+	b.data = binary.BigEndian.AppendUint64(b.data, v)
+}
+
+func (b *krlBuilder) string(s []byte) {
+	b.uint32(uint32(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *krlBuilder) section(sectionType byte, section *krlBuilder) {
+	b.data = append(b.data, sectionType)
+	b.string(section.data)
+}
+
+func TestKRL(t *testing.T) {
+	ca := newSigner(t)
+	otherCA := newSigner(t)
+
+	t.Run("serials", func(t *testing.T) {
+		serials := &krlBuilder{}
+		serials.uint64(5)
+		serials.uint64(7)
+		serialRange := &krlBuilder{}
+		serialRange.uint64(100)
+		serialRange.uint64(200)
+		bitmap := &krlBuilder{}
+		bitmap.uint64(1000)
+		bitmap.string([]byte{0b101})
+
+		certificates := &krlBuilder{}
+		certificates.string(ca.PublicKey().Marshal())
+		certificates.string(nil)
+		certificates.section(krlSectionCertSerialList, serials)
+		certificates.section(krlSectionCertSerialRange, serialRange)
+		certificates.section(krlSectionCertSerialBitmap, bitmap)
+
+		b := newKRLBuilder()
+		b.section(krlSectionCertificates, certificates)
+		krl, err := ParseKRL(b.data)
+		require.NoError(t, err)
+
+		for serial, revoked := range map[uint64]bool{
+			0: false, 5: true, 6: false, 7: true, 99: false, 100: true, 150: true, 200: true, 201: false,
+			1000: true, 1001: false, 1002: true, 1003: false,
+		} {
+			require.Equal(t, revoked, krl.IsRevoked(newCertificate(t, ca, serial, "id", "user")), "serial %d", serial)
+		}
+		require.False(t, krl.IsRevoked(newCertificate(t, otherCA, 5, "id", "user")))
+	})
+
+	t.Run("key-ids-any-ca", func(t *testing.T) {
+		keyIDs := &krlBuilder{}
+		keyIDs.string([]byte("leaked"))
+
+		certificates := &krlBuilder{}
+		certificates.string(nil)
+		certificates.string(nil)
+		certificates.section(krlSectionCertKeyID, keyIDs)
+
+		b := newKRLBuilder()
+		b.section(krlSectionCertificates, certificates)
+		krl, err := ParseKRL(b.data)
+		require.NoError(t, err)
+
+		require.True(t, krl.IsRevoked(newCertificate(t, ca, 0, "leaked", "user")))
+		require.True(t, krl.IsRevoked(newCertificate(t, otherCA, 0, "leaked", "user")))
+		require.False(t, krl.IsRevoked(newCertificate(t, ca, 0, "other", "user")))
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		cert := newCertificate(t, ca, 1, "id", "user")
+		revokedCA := newSigner(t)
+
+		explicit := &krlBuilder{}
+		explicit.string(cert.Key.Marshal())
+		sum := sha256.Sum256(revokedCA.PublicKey().Marshal())
+		fingerprints := &krlBuilder{}
+		fingerprints.string(sum[:])
+
+		b := newKRLBuilder()
+		b.section(krlSectionExplicitKey, explicit)
+		b.section(krlSectionFingerprintSHA256, fingerprints)
+		b.section(krlSectionSignature, &krlBuilder{})
+		krl, err := ParseKRL(b.data)
+		require.NoError(t, err)
+
+		require.True(t, krl.IsRevoked(cert))
+		require.True(t, krl.IsRevoked(newCertificate(t, revokedCA, 1, "id", "user")))
+		require.False(t, krl.IsRevoked(newCertificate(t, ca, 1, "id", "user")))
+	})
+
+	t.Run("plain-key-list", func(t *testing.T) {
+		cert := newCertificate(t, ca, 1, "id", "user")
+		krl, err := ParseKRL(append([]byte("# revoked keys\n"), ssh.MarshalAuthorizedKey(cert.Key)...))
+		require.NoError(t, err)
+		require.True(t, krl.IsRevoked(cert))
+		require.False(t, krl.IsRevoked(newCertificate(t, ca, 1, "id", "user")))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		b := newKRLBuilder()
+		b.data = append(b.data, krlSectionCertificates, 0, 0, 1)
+		_, err := ParseKRL(b.data)
+		require.ErrorIs(t, err, ErrInvalidKRL)
+	})
+}
+
+func TestAuthorities(t *testing.T) {
+	dir := t.TempDir()
+	teamA := newSigner(t)
+	teamB := newSigner(t)
+	unknown := newSigner(t)
+
+	teamAPath := writeFile(t, dir, "team-a.pub", ssh.MarshalAuthorizedKey(teamA.PublicKey()))
+	teamBPath := writeFile(t, dir, "team-b.pub", ssh.MarshalAuthorizedKey(teamB.PublicKey()))
+
+	authorities, err := New([]config.UserCA{
+		{Path: teamAPath},
+		{Path: teamBPath, Principals: []string{"team-b-*"}},
+	}, "")
+	require.NoError(t, err)
+
+	principals, err := authorities.Verify(newCertificate(t, teamA, 1, "alice", "alice", "team-b-admin"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "team-b-admin"}, principals)
+
+	principals, err = authorities.Verify(newCertificate(t, teamB, 1, "bob", "bob", "team-b-reader"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-b-reader"}, principals)
+
+	_, err = authorities.Verify(newCertificate(t, teamB, 1, "bob", "bob"), nil)
+	require.ErrorIs(t, err, ErrForbiddenPrincipals)
+
+	_, err = authorities.Verify(newCertificate(t, unknown, 1, "eve", "eve"), nil)
+	require.ErrorIs(t, err, ErrUnknownAuthority)
+	require.False(t, authorities.Trusts(newCertificate(t, unknown, 1, "eve", "eve"), nil))
+
+	forged := newCertificate(t, unknown, 1, "eve", "alice")
+	forged.SignatureKey = teamA.PublicKey()
+	_, err = authorities.Verify(forged, nil)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+	require.False(t, authorities.Trusts(forged, nil))
+	require.True(t, authorities.Trusts(newCertificate(t, teamA, 1, "alice", "alice"), nil))
+
+	host := newCertificate(t, teamA, 1, "alice", "alice")
+	host.CertType = ssh.HostCert
+	require.NoError(t, host.SignCert(rand.Reader, teamA))
+	_, err = authorities.Verify(host, nil)
+	require.ErrorIs(t, err, ErrNotUserCertificate)
+
+	withOption := newCertificate(t, teamA, 1, "alice", "alice")
+	withOption.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+	require.NoError(t, withOption.SignCert(rand.Reader, teamA))
+	_, err = authorities.Verify(withOption, nil)
+	require.ErrorIs(t, err, ErrUnsupportedCriticalOption)
+	_, err = authorities.Verify(withOption, []string{"source-address"})
+	require.NoError(t, err)
+	require.False(t, authorities.Trusts(withOption, nil))
+	require.True(t, authorities.Trusts(withOption, []string{"source-address"}))
+
+	require.ErrorIs(t, authorities.Update([]config.UserCA{
+		{Path: teamAPath},
+		{Path: teamBPath, Principals: []string{"team-b-*"}},
+	}, ""), ErrNotChanged)
+
+	leaked := newCertificate(t, teamA, 42, "alice", "alice")
+	krlPath := writeFile(t, dir, "krl", ssh.MarshalAuthorizedKey(leaked.Key))
+	require.NoError(t, authorities.Update([]config.UserCA{{Path: teamBPath}}, krlPath))
+
+	_, err = authorities.Verify(leaked, nil)
+	require.ErrorIs(t, err, ErrRevoked)
+	_, err = authorities.Verify(newCertificate(t, teamA, 1, "alice", "alice"), nil)
+	require.ErrorIs(t, err, ErrUnknownAuthority)
+	principals, err = authorities.Verify(newCertificate(t, teamB, 1, "bob", "bob"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bob"}, principals)
+}